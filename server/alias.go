@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	gosmtp "github.com/emersion/go-smtp"
+	"gorm.io/gorm"
+)
+
+var errAliasInactive = &gosmtp.SMTPError{
+	Code:         550,
+	EnhancedCode: gosmtp.EnhancedCode{5, 1, 1},
+	Message:      "Mailbox unavailable",
+}
+
+// InactiveReason explains why an alias no longer accepts mail, or returns
+// an empty string while it is active
+func (a *Account) InactiveReason(now time.Time) string {
+	if a.Enabled != nil && !*a.Enabled {
+		return "disabled"
+	}
+	if a.ExpiresAt != nil && !now.Before(*a.ExpiresAt) {
+		return "expired"
+	}
+	if a.MaxMessages > 0 && a.HitCount >= a.MaxMessages {
+		return "used up"
+	}
+	return ""
+}
+
+// inactiveAction resolves whether mail to an inactive alias is rejected or dropped
+func inactiveAction(cfg *Config, a *Account) string {
+	action := a.InactiveAction
+	if action == "" {
+		action = cfg.InactiveAliasAction
+	}
+	if action != "drop" {
+		action = "reject"
+	}
+	return action
+}
+
+// consumeMessageQuota counts an accepted message against the alias. It fails
+// when a concurrent session used up a limited alias in the meantime.
+func consumeMessageQuota(a *Account) bool {
+	result := DB.Model(&Account{}).
+		Where("id = ? AND (max_messages = 0 OR hit_count < max_messages)", a.ID).
+		Update("hit_count", gorm.Expr("hit_count + ?", 1))
+	return result.Error == nil && result.RowsAffected > 0
+}
+
+// recordInactive leaves a trace of mail addressed to an inactive alias
+func recordInactive(a *Account, status string, reason string, from string, to string, subject string) {
+	l := Log{
+		AccountID: a.ID,
+		OwnerID:   a.OwnerID,
+		From:      from,
+		To:        to,
+		Subject:   subject,
+		Status:    status,
+		Error:     "alias " + reason,
+		CreatedAt: time.Now(),
+	}
+	DB.Create(&l)
+	publishLog(eventLogCreated, &l)
+}
+
+// validateAccount checks the rule before it is saved
+func validateAccount(a *Account) error {
+	if _, err := regexp.Compile(a.Pattern); err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	switch a.InactiveAction {
+	case "", "reject", "drop":
+	default:
+		return errors.New("inactive_action must be reject or drop")
+	}
+	if a.MaxMessages < 0 {
+		return errors.New("max_messages must not be negative")
+	}
+	if err := validateForwardTargets(a); err != nil {
+		return err
+	}
+	if err := validateNotifyTargets(a); err != nil {
+		return err
+	}
+	return validateTemplates(a)
+}
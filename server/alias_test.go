@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInactiveReason(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	off, on := false, true
+	past, future := now.Add(-time.Second), now.Add(time.Second)
+	tests := []struct {
+		name    string
+		account Account
+		want    string
+	}{
+		{"default", Account{}, ""},
+		{"enabled", Account{Enabled: &on}, ""},
+		{"disabled", Account{Enabled: &off}, "disabled"},
+		{"disabled wins", Account{Enabled: &off, ExpiresAt: &past}, "disabled"},
+		{"expired", Account{ExpiresAt: &past}, "expired"},
+		{"expires now", Account{ExpiresAt: &now}, "expired"},
+		{"not yet expired", Account{ExpiresAt: &future}, ""},
+		{"no limit", Account{HitCount: 100}, ""},
+		{"below the limit", Account{MaxMessages: 1, HitCount: 0}, ""},
+		{"at the limit", Account{MaxMessages: 1, HitCount: 1}, "used up"},
+		{"over the limit", Account{MaxMessages: 3, HitCount: 5}, "used up"},
+	}
+	for _, tt := range tests {
+		if got := tt.account.InactiveReason(now); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInactiveAction(t *testing.T) {
+	tests := []struct {
+		global, account, want string
+	}{
+		{"reject", "", "reject"},
+		{"drop", "", "drop"},
+		{"reject", "drop", "drop"},
+		{"drop", "reject", "reject"},
+		{"", "", "reject"},
+	}
+	for _, tt := range tests {
+		cfg := &Config{InactiveAliasAction: tt.global}
+		if got := inactiveAction(cfg, &Account{InactiveAction: tt.account}); got != tt.want {
+			t.Errorf("global %q, account %q: %s, want %s", tt.global, tt.account, got, tt.want)
+		}
+	}
+}
+
+func TestConsumeMessageQuota(t *testing.T) {
+	newTestDB(t)
+	limited := Account{Pattern: "^once@example\\.com$", ForwardTo: "local", MaxMessages: 2}
+	DB.Create(&limited)
+	unlimited := Account{Pattern: "^any@example\\.com$", ForwardTo: "local"}
+	DB.Create(&unlimited)
+
+	for i, want := range []bool{true, true, false, false} {
+		if got := consumeMessageQuota(&limited); got != want {
+			t.Errorf("message %d: %v, want %v", i+1, got, want)
+		}
+	}
+	DB.First(&limited, limited.ID)
+	if limited.HitCount != 2 || limited.InactiveReason(time.Now()) != "used up" {
+		t.Errorf("hit count %d", limited.HitCount)
+	}
+
+	for i := 0; i < 5; i++ {
+		if !consumeMessageQuota(&unlimited) {
+			t.Fatal("unlimited alias ran out")
+		}
+	}
+}
+
+func TestInactiveAliasSession(t *testing.T) {
+	cfg := newTestDB(t)
+	off := false
+	past := time.Now().Add(-time.Hour)
+	accounts := []Account{
+		{Pattern: "^disabled@example\\.com$", ForwardTo: "local", Enabled: &off},
+		{Pattern: "^expired@example\\.com$", ForwardTo: "local", ExpiresAt: &past, InactiveAction: "drop"},
+		{Pattern: "^limited@example\\.com$", ForwardTo: "local", MaxMessages: 1},
+	}
+	for i := range accounts {
+		DB.Create(&accounts[i])
+	}
+	lastLog := func() Log {
+		var l Log
+		DB.Order("id desc").First(&l)
+		return l
+	}
+
+	// Rejected aliases answer 550 at RCPT
+	s := &Session{Config: cfg, From: "a@shop.test"}
+	if err := s.Rcpt("disabled@example.com", nil); !errors.Is(err, errAliasInactive) {
+		t.Errorf("disabled alias: %v", err)
+	}
+	if l := lastLog(); l.Status != "rejected" || l.Error != "alias disabled" {
+		t.Errorf("disabled log %s %q", l.Status, l.Error)
+	}
+
+	// Dropped aliases accept the mail and discard it
+	s = &Session{Config: cfg, From: "a@shop.test"}
+	if err := s.Rcpt("expired@example.com", nil); err != nil {
+		t.Fatalf("expired alias with drop: %v", err)
+	}
+	if err := s.Data(strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("dropped data: %v", err)
+	}
+	if l := lastLog(); l.Status != "dropped" || l.Error != "alias expired" || l.Subject != "hi" {
+		t.Errorf("expired log %s %q %q", l.Status, l.Error, l.Subject)
+	}
+
+	// The last message of a limited alias is used up by another session
+	// between RCPT and DATA
+	s = &Session{Config: cfg, From: "a@shop.test"}
+	if err := s.Rcpt("limited@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !consumeMessageQuota(&accounts[2]) {
+		t.Fatal("the other session got no quota")
+	}
+	if err := s.Data(strings.NewReader("Subject: late\r\n\r\nbody\r\n")); !errors.Is(err, errAliasInactive) {
+		t.Errorf("used up alias: %v", err)
+	}
+	if l := lastLog(); l.Status != "rejected" || l.Error != "alias used up" {
+		t.Errorf("used up log %s %q", l.Status, l.Error)
+	}
+
+	// Once used up, RCPT refuses it right away
+	s = &Session{Config: cfg, From: "a@shop.test"}
+	if err := s.Rcpt("limited@example.com", nil); !errors.Is(err, errAliasInactive) {
+		t.Errorf("used up alias at RCPT: %v", err)
+	}
+}
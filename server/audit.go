@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	AuditLogin          = "login"
+	AuditLoginFailed    = "login.failed"
+	AuditLogout         = "logout"
+	AuditDomainCreate   = "domain.create"
+	AuditDomainOwner    = "domain.owner"
+	AuditDomainDelete   = "domain.delete"
+	AuditAccountCreate  = "account.create"
+	AuditAccountUpdate  = "account.update"
+	AuditAccountDelete  = "account.delete"
+	AuditAccountMailbox = "account.mailbox"
+	AuditUserCreate     = "user.create"
+	AuditUserUpdate     = "user.update"
+	AuditUserDelete     = "user.delete"
+	AuditSettingsUpdate = "settings.update"
+)
+
+// auditIgnoredFields change on every save and say nothing about the action
+var auditIgnoredFields = map[string]bool{"created_at": true, "updated_at": true}
+
+// auditDiff compares the JSON form of two versions of a record, so fields
+// hidden from the API such as password hashes never end up in the audit
+// log. Either side may be nil for creations and deletions.
+func auditDiff(before, after interface{}) json.RawMessage {
+	fields := func(v interface{}) map[string]interface{} {
+		m := map[string]interface{}{}
+		if rv := reflect.ValueOf(v); v == nil || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+			return m
+		}
+		b, _ := json.Marshal(v)
+		json.Unmarshal(b, &m)
+		return m
+	}
+	old, updated := fields(before), fields(after)
+
+	keys := map[string]bool{}
+	for k := range old {
+		keys[k] = true
+	}
+	for k := range updated {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		if !auditIgnoredFields[k] && !reflect.DeepEqual(old[k], updated[k]) {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	if len(sorted) == 0 {
+		return nil
+	}
+
+	changes := make(map[string]map[string]interface{}, len(sorted))
+	for _, k := range sorted {
+		changes[k] = map[string]interface{}{"before": old[k], "after": updated[k]}
+	}
+	b, _ := json.Marshal(changes)
+	return b
+}
+
+// recordAudit stores an action of the current user. before and after are
+// pointers to the record, nil when it did not exist.
+func recordAudit(c *gin.Context, action string, target string, targetID uint, before, after interface{}) {
+	entry := AuditEntry{
+		IP:       c.ClientIP(),
+		Action:   action,
+		Target:   target,
+		TargetID: targetID,
+		Changes:  auditDiff(before, after),
+	}
+	if user := currentUser(c); user != nil {
+		entry.UserID = &user.ID
+		entry.Username = user.Username
+	}
+	if v, ok := c.Get("api_token"); ok {
+		entry.TokenID = &v.(*APIToken).ID
+	}
+	saveAudit(&entry)
+}
+
+// recordLogin stores a login attempt. user is nil when the username is
+// unknown, detail names the method or the reason of a failure.
+func recordLogin(c *gin.Context, action string, username string, user *User, detail string) {
+	entry := AuditEntry{
+		Username: username,
+		IP:       c.ClientIP(),
+		Action:   action,
+		Target:   "user",
+		Detail:   detail,
+	}
+	if user != nil {
+		entry.UserID = &user.ID
+		entry.Username = user.Username
+		entry.TargetID = user.ID
+	}
+	saveAudit(&entry)
+}
+
+func saveAudit(entry *AuditEntry) {
+	if err := DB.Create(entry).Error; err != nil {
+		log.Printf("[Audit] Failed to record %s: %v", entry.Action, err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuditDiff(t *testing.T) {
+	enabled, disabled := true, false
+	owner := uint(7)
+	account := func(change func(a *Account)) *Account {
+		a := &Account{ID: 1, Pattern: "^a@x$", ForwardTo: "me@example.com", Enabled: &enabled}
+		if change != nil {
+			change(a)
+		}
+		return a
+	}
+
+	tests := []struct {
+		name   string
+		before interface{}
+		after  interface{}
+		want   string
+	}{
+		{"no change", account(nil), account(nil), ""},
+		{"timestamps only", account(nil), account(func(a *Account) { a.UpdatedAt = time.Now() }), ""},
+		{"field", account(nil), account(func(a *Account) { a.ForwardTo = "you@example.com" }),
+			`{"forward_to":{"after":"you@example.com","before":"me@example.com"}}`},
+		{"pointers", account(nil), account(func(a *Account) { a.Enabled = &disabled; a.OwnerID = &owner }),
+			`{"enabled":{"after":false,"before":true},"owner_id":{"after":7,"before":null}}`},
+		{"both nil", nil, nil, ""},
+		{"typed nil", (*Domain)(nil), (*Domain)(nil), ""},
+		{"create", (*Domain)(nil), &Domain{ID: 3, Name: "x.test"},
+			`{"id":{"after":3,"before":null},"name":{"after":"x.test","before":null}}`},
+		{"delete", &Domain{ID: 3, Name: "x.test"}, nil,
+			`{"id":{"after":null,"before":3},"name":{"after":null,"before":"x.test"}}`},
+		{"hidden fields", &User{Username: "a", PasswordHash: "old", TOTPSecret: "A"}, &User{Username: "a", PasswordHash: "new", TOTPSecret: "B"}, ""},
+	}
+	for _, tt := range tests {
+		got := auditDiff(tt.before, tt.after)
+		if string(got) != tt.want {
+			t.Errorf("%s: changes %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRecordAudit(t *testing.T) {
+	newTestDB(t)
+	user := createTestUser(t, "alice", RoleOperator)
+	token, _, _ := createAPIToken(user, "ci", []string{ScopeAccountsWrite}, 0)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPut, "/api/accounts/1", nil)
+	c.Request.RemoteAddr = "192.0.2.10:4000"
+	c.Set("user", user)
+	c.Set("api_token", token)
+	recordAudit(c, AuditAccountUpdate, "account", 1, &Account{Description: "a"}, &Account{Description: "b"})
+	recordLogin(c, AuditLoginFailed, "mallory", nil, "unknown user")
+
+	var entries []AuditEntry
+	DB.Order("id").Find(&entries)
+	if len(entries) != 2 {
+		t.Fatalf("%d audit entries", len(entries))
+	}
+	update := entries[0]
+	if update.UserID == nil || *update.UserID != user.ID || update.Username != "alice" || update.TokenID == nil || *update.TokenID != token.ID ||
+		update.IP != "192.0.2.10" || update.Action != AuditAccountUpdate || update.TargetID != 1 {
+		t.Errorf("update entry %+v", update)
+	}
+	var changes map[string]map[string]string
+	if err := json.Unmarshal(update.Changes, &changes); err != nil || changes["description"]["after"] != "b" || len(changes) != 1 {
+		t.Errorf("changes %s", update.Changes)
+	}
+	if login := entries[1]; login.UserID != nil || login.Username != "mallory" || login.Detail != "unknown user" {
+		t.Errorf("login entry %+v", login)
+	}
+}
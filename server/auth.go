@@ -1,7 +1,12 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -11,20 +16,31 @@ import (
 	"golang.org/x/time/rate"
 )
 
-// RateLimiter per IP
+// limiterIdleTimeout is how long an IP keeps its limiter without requests
+const limiterIdleTimeout = 10 * time.Minute
+
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter per IP. Idle entries are evicted so the map stays bounded by
+// the number of recently active clients.
 type IPRateLimiter struct {
-	ips map[string]*rate.Limiter
-	mu  *sync.RWMutex
-	r   rate.Limit
-	b   int
+	ips       map[string]*rateLimiterEntry
+	mu        *sync.RWMutex
+	r         rate.Limit
+	b         int
+	lastSweep time.Time
 }
 
 func NewIPRateLimiter(r rate.Limit, b int) *IPRateLimiter {
 	return &IPRateLimiter{
-		ips: make(map[string]*rate.Limiter),
-		mu:  &sync.RWMutex{},
-		r:   r,
-		b:   b,
+		ips:       make(map[string]*rateLimiterEntry),
+		mu:        &sync.RWMutex{},
+		r:         r,
+		b:         b,
+		lastSweep: time.Now(),
 	}
 }
 
@@ -32,16 +48,38 @@ func (i *IPRateLimiter) GetLimiter(ip string) *rate.Limiter {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	limiter, exists := i.ips[ip]
+	now := time.Now()
+	if now.Sub(i.lastSweep) > limiterIdleTimeout {
+		for key, entry := range i.ips {
+			if now.Sub(entry.lastSeen) > limiterIdleTimeout {
+				delete(i.ips, key)
+			}
+		}
+		i.lastSweep = now
+	}
+
+	entry, exists := i.ips[ip]
 	if !exists {
-		limiter = rate.NewLimiter(i.r, i.b)
-		i.ips[ip] = limiter
+		entry = &rateLimiterEntry{limiter: rate.NewLimiter(i.r, i.b)}
+		i.ips[ip] = entry
 	}
+	entry.lastSeen = now
+
+	return entry.limiter
+}
 
-	return limiter
+// SetLimits changes the rate of all limiters, including the existing ones
+func (i *IPRateLimiter) SetLimits(r rate.Limit, b int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.r, i.b = r, b
+	for _, entry := range i.ips {
+		entry.limiter.SetLimit(r)
+		entry.limiter.SetBurst(b)
+	}
 }
 
-var globalLimiter = NewIPRateLimiter(5, 10) // 5 req/s, burst 10
+var globalLimiter = NewIPRateLimiter(5, 10) // 5 req/s, burst 10, see RATE_LIMIT
 
 func RateLimitMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -54,8 +92,69 @@ func RateLimitMiddleware() gin.HandlerFunc {
 	}
 }
 
-func AuthMiddleware(cfg *Config) gin.HandlerFunc {
+// queryCredentials are query parameters that carry credentials
+var queryCredentials = []string{"ticket", "access_token"}
+
+// RedactQueryCredentials moves credentials out of the query string before
+// the request is logged, handlers find them with c.Get("query_<name>")
+func RedactQueryCredentials() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		query := c.Request.URL.Query()
+		changed := false
+		for _, name := range queryCredentials {
+			if query.Has(name) {
+				c.Set("query_"+name, query.Get(name))
+				query.Del(name)
+				changed = true
+			}
+		}
+		if changed {
+			c.Request.URL.RawQuery = query.Encode()
+		}
+		c.Next()
+	}
+}
+
+// StreamAuthMiddleware authenticates the live event streams. EventSource
+// and WebSocket clients cannot set headers, they pass a short-lived stream
+// ticket as ?ticket= instead.
+func StreamAuthMiddleware() gin.HandlerFunc {
+	auth := AuthMiddleware()
+	return func(c *gin.Context) {
+		cfg := currentConfig()
+		if c.GetHeader("Authorization") != "" {
+			auth(c)
+			return
+		}
+		if _, ok := c.Get("query_access_token"); ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "access_token is not accepted in the URL, request a ticket from POST /api/events/ticket"})
+			return
+		}
+		ticket := c.GetString("query_ticket")
+		if ticket == "" || isAPIToken(ticket) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		user, apiToken, session, err := authenticateStreamTicket(cfg, ticket)
+		if err != nil || (apiToken != nil && !apiToken.Allows(c.Request.Method, c.FullPath())) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired ticket"})
+			return
+		}
+		if apiToken != nil {
+			c.Set("api_token", apiToken)
+		}
+		if session != nil {
+			c.Set("session", session)
+		}
+		c.Set("user", user)
+		c.Next()
+	}
+}
+
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := currentConfig()
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
@@ -63,52 +162,550 @@ func AuthMiddleware(cfg *Config) gin.HandlerFunc {
 		}
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.JWTSecret), nil
-		})
+		var user *User
+		if isAPIToken(tokenString) {
+			apiToken, tokenUser, err := authenticateAPIToken(tokenString)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+				return
+			}
+			if !apiToken.Allows(c.Request.Method, c.FullPath()) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token scope does not allow this request"})
+				return
+			}
+			c.Set("api_token", apiToken)
+			user = tokenUser
+		} else {
+			sessionUser, session, err := authenticateJWT(cfg, tokenString)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+				return
+			}
+			c.Set("session", session)
+			user = sessionUser
+		}
 
-		if err != nil || !token.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		// Everyone may manage their own profile and tokens, tokens never
+		// grant more than the role of their user
+		if !user.CanWrite() && c.Request.Method != http.MethodGet && !isSelfServiceRoute(c.FullPath()) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Read-only users cannot make changes"})
 			return
 		}
+		c.Set("user", user)
 
 		c.Next()
 	}
 }
 
+// isSelfServiceRoute also covers the stream ticket, which changes nothing
+func isSelfServiceRoute(route string) bool {
+	return strings.HasPrefix(route, "/api/me") || strings.HasPrefix(route, "/api/tokens") || route == "/api/events/ticket"
+}
+
+// parseJWT verifies the signature, algorithm, issuer, audience and expiry
+// of a token signed by this server
+func parseJWT(cfg *Config, tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(cfg.JWTSecret), nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(cfg.JWTIssuer),
+		jwt.WithAudience(cfg.JWTAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// authenticateJWT validates an access token. The user and session are
+// loaded on every request so that role changes, disabled users and logouts
+// take effect immediately.
+func authenticateJWT(cfg *Config, tokenString string) (*User, *LoginSession, error) {
+	claims, err := parseJWT(cfg, tokenString)
+	if err != nil {
+		return nil, nil, errors.New("invalid token")
+	}
+
+	// Login challenges are not sessions
+	if claims["purpose"] != nil {
+		return nil, nil, errors.New("invalid token")
+	}
+
+	subject, _ := claims.GetSubject()
+	sid, _ := claims["sid"].(float64)
+	var user User
+	if subject == "" || sid <= 0 || DB.First(&user, subject).Error != nil || !user.IsEnabled() {
+		return nil, nil, errors.New("invalid token")
+	}
+	session, err := activeSession(uint(sid), user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &user, session, nil
+}
+
+// RequireRole only lets users with one of the roles through, it must run
+// after AuthMiddleware
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := currentUser(c)
+		for _, role := range roles {
+			if user != nil && user.Role == role {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+	}
+}
+
 type LoginRequest struct {
+	Username string `json:"username"` // Defaults to "admin" for single-user installs
 	Password string `json:"password" binding:"required"`
 }
 
-func LoginHandler(cfg *Config) gin.HandlerFunc {
+func LoginHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		cfg := currentConfig()
 		var req LoginRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		if !cfg.PasswordLogin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Password login is disabled, use single sign-on"})
+			return
+		}
+		if req.Username == "" {
+			req.Username = "admin"
+		}
 
-		// Simple password check (secure against brute force via rate limiter)
-		if req.Password != cfg.Password {
-			// Simulate timing attack resistance slightly
-			time.Sleep(100 * time.Millisecond)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		ip := c.ClientIP()
+		if wait := loginGuard.Check(ip, req.Username); wait > 0 {
+			recordLogin(c, AuditLoginFailed, req.Username, nil, "throttled")
+			tooManyAttempts(c, wait)
+			return
+		}
+		user, err := authenticateUser(req.Username, req.Password)
+		if err != nil {
+			loginGuard.Fail(ip, req.Username)
+			recordLogin(c, AuditLoginFailed, req.Username, nil, err.Error())
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
 			return
 		}
 
-		// Generate JWT
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"authorized": true,
-			"exp":        time.Now().Add(24 * time.Hour).Unix(),
-		})
+		// With two-factor authentication the password only earns a short
+		// lived challenge that is exchanged at /api/login/2fa
+		if user.TOTPEnabled || user.TOTPRequired {
+			challenge, err := issueChallenge(cfg, user)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"two_factor_required":       user.TOTPEnabled,
+				"two_factor_setup_required": !user.TOTPEnabled,
+				"challenge":                 challenge,
+			})
+			return
+		}
 
-		tokenString, err := token.SignedString([]byte(cfg.JWTSecret))
+		completeLogin(c, cfg, user, "password", nil)
+	}
+}
+
+// completeLogin starts a session once all factors are verified
+func completeLogin(c *gin.Context, cfg *Config, user *User, method string, extra gin.H) {
+	resp, err := startSession(c, cfg, user, method)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp["user"] = user
+	for k, v := range extra {
+		resp[k] = v
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// startSession creates a session for the user and returns its tokens,
+// method is recorded in the audit log
+func startSession(c *gin.Context, cfg *Config, user *User, method string) (gin.H, error) {
+	session, refreshToken, err := createSession(cfg, user, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		return nil, errors.New("could not create session")
+	}
+	tokenString, err := issueToken(cfg, user, session)
+	if err != nil {
+		return nil, errors.New("could not generate token")
+	}
+
+	now := time.Now()
+	DB.Model(user).Update("last_login_at", &now)
+	loginGuard.Succeed(user.Username)
+	recordLogin(c, AuditLogin, user.Username, user, method)
+	return gin.H{
+		"token":         tokenString,
+		"refresh_token": refreshToken,
+		"expires_in":    int(cfg.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// issueToken signs a short lived access token for a session
+func issueToken(cfg *Config, user *User, session *LoginSession) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":  cfg.JWTIssuer,
+		"aud":  cfg.JWTAudience,
+		"sub":  strconv.FormatUint(uint64(user.ID), 10),
+		"sid":  session.ID,
+		"name": user.Username,
+		"role": user.Role,
+		"iat":  now.Unix(),
+		"exp":  now.Add(cfg.AccessTokenTTL).Unix(),
+	})
+	return token.SignedString([]byte(cfg.JWTSecret))
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// RefreshHandler exchanges a refresh token for a new access token and a new
+// refresh token, the old one stops working
+func RefreshHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := currentConfig()
+		var req RefreshRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		session, user, refreshToken, err := rotateSession(cfg, req.RefreshToken, c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		tokenString, err := issueToken(cfg, user, session)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
 			return
 		}
+		c.JSON(http.StatusOK, gin.H{
+			"token":         tokenString,
+			"refresh_token": refreshToken,
+			"expires_in":    int(cfg.AccessTokenTTL.Seconds()),
+		})
+	}
+}
+
+// LogoutHandler ends the session of a refresh token. It needs no access
+// token so that clients can sign out after it expired.
+func LogoutHandler(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var session LoginSession
+	if err := DB.Where("refresh_hash = ? AND revoked_at IS NULL", hashRefreshToken(req.RefreshToken)).First(&session).Error; err == nil {
+		if err := revokeSession(&session); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var user User
+		if DB.First(&user, session.UserID).Error == nil {
+			recordLogin(c, AuditLogout, user.Username, &user, "")
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
+const challengePurpose = "2fa"
 
-		c.JSON(http.StatusOK, gin.H{"token": tokenString})
+// issueChallenge returns a token proving the password step of a login
+func issueChallenge(cfg *Config, user *User) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":     cfg.JWTIssuer,
+		"aud":     cfg.JWTAudience,
+		"sub":     strconv.FormatUint(uint64(user.ID), 10),
+		"purpose": challengePurpose,
+		"exp":     time.Now().Add(5 * time.Minute).Unix(),
+	})
+	return token.SignedString([]byte(cfg.JWTSecret))
+}
+
+// parseChallenge resolves a login challenge to its user
+func parseChallenge(cfg *Config, challenge string) (*User, error) {
+	claims, err := parseJWT(cfg, challenge)
+	if err != nil || claims["purpose"] != challengePurpose {
+		return nil, errors.New("invalid or expired challenge")
+	}
+	subject, _ := claims.GetSubject()
+	var user User
+	if subject == "" || DB.First(&user, subject).Error != nil || !user.IsEnabled() {
+		return nil, errors.New("invalid or expired challenge")
 	}
+	return &user, nil
 }
 
+const (
+	streamPurpose   = "stream"
+	streamTicketTTL = time.Minute
+)
+
+// issueStreamTicket signs a ticket that only opens the event streams. It
+// stays bound to the session or API token it was issued for.
+func issueStreamTicket(cfg *Config, user *User, session *LoginSession, apiToken *APIToken) (string, error) {
+	claims := jwt.MapClaims{
+		"iss":     cfg.JWTIssuer,
+		"aud":     cfg.JWTAudience,
+		"sub":     strconv.FormatUint(uint64(user.ID), 10),
+		"purpose": streamPurpose,
+		"exp":     time.Now().Add(streamTicketTTL).Unix(),
+	}
+	if session != nil {
+		claims["sid"] = session.ID
+	}
+	if apiToken != nil {
+		claims["tid"] = apiToken.ID
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(cfg.JWTSecret))
+}
+
+// authenticateStreamTicket resolves a stream ticket, the session or API
+// token behind it must still be valid
+func authenticateStreamTicket(cfg *Config, ticket string) (*User, *APIToken, *LoginSession, error) {
+	claims, err := parseJWT(cfg, ticket)
+	if err != nil || claims["purpose"] != streamPurpose {
+		return nil, nil, nil, errors.New("invalid ticket")
+	}
+	subject, _ := claims.GetSubject()
+	var user User
+	if subject == "" || DB.First(&user, subject).Error != nil || !user.IsEnabled() {
+		return nil, nil, nil, errors.New("invalid ticket")
+	}
+
+	if sid, ok := claims["sid"].(float64); ok {
+		session, err := activeSession(uint(sid), user.ID)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return &user, nil, session, nil
+	}
+	if tid, ok := claims["tid"].(float64); ok {
+		var t APIToken
+		if DB.Where("id = ? AND user_id = ?", uint(tid), user.ID).First(&t).Error != nil {
+			return nil, nil, nil, errors.New("token revoked")
+		}
+		if t.ExpiresAt != nil && !time.Now().Before(*t.ExpiresAt) {
+			return nil, nil, nil, errors.New("token expired")
+		}
+		return &user, &t, nil, nil
+	}
+	return nil, nil, nil, errors.New("invalid ticket")
+}
+
+// StreamTicketHandler issues a ticket for opening an event stream
+func StreamTicketHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := currentConfig()
+		var apiToken *APIToken
+		if v, ok := c.Get("api_token"); ok {
+			apiToken = v.(*APIToken)
+		}
+		ticket, err := issueStreamTicket(cfg, currentUser(c), currentSession(c), apiToken)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue ticket"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ticket": ticket, "expires_in": int(streamTicketTTL.Seconds())})
+	}
+}
+
+type SecondFactorRequest struct {
+	Challenge    string `json:"challenge" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// SecondFactorLoginHandler finishes a two-step login. Users who must enroll
+// first confirm their new secret here and receive their recovery codes.
+func SecondFactorLoginHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := currentConfig()
+		var req SecondFactorRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user, err := parseChallenge(cfg, req.Challenge)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		ip := c.ClientIP()
+		if wait := loginGuard.Check(ip, user.Username); wait > 0 {
+			recordLogin(c, AuditLoginFailed, user.Username, user, "throttled")
+			tooManyAttempts(c, wait)
+			return
+		}
+
+		if !user.TOTPEnabled {
+			if !user.TOTPRequired || user.TOTPSecret == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Start the setup at /api/login/2fa/setup first"})
+				return
+			}
+			codes, err := enableTOTP(user, req.Code)
+			if err != nil {
+				loginGuard.Fail(ip, user.Username)
+				recordLogin(c, AuditLoginFailed, user.Username, user, "totp setup: "+err.Error())
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+			completeLogin(c, cfg, user, "password+totp", gin.H{"recovery_codes": codes})
+			return
+		}
+
+		method := "password+totp"
+		if req.RecoveryCode != "" {
+			method = "password+recovery code"
+		}
+		if err := verifySecondFactor(user, req.Code, req.RecoveryCode); err != nil {
+			loginGuard.Fail(ip, user.Username)
+			recordLogin(c, AuditLoginFailed, user.Username, user, method+": "+err.Error())
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		completeLogin(c, cfg, user, method, nil)
+	}
+}
+
+type ChallengeRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+}
+
+// SecondFactorSetupHandler starts the enrollment of users whose policy
+// requires two-factor authentication before they can log in
+func SecondFactorSetupHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := currentConfig()
+		var req ChallengeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user, err := parseChallenge(cfg, req.Challenge)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if !user.TOTPRequired {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor setup is not required, enroll from your profile"})
+			return
+		}
+		secret, uri, err := startTOTPEnrollment(user)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_uri": uri})
+	}
+}
+
+// AuthProvidersHandler tells the login page which login methods are offered
+func AuthProvidersHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := currentConfig()
+		resp := gin.H{"password": cfg.PasswordLogin, "oidc": oidcEnabled(cfg)}
+		if oidcEnabled(cfg) {
+			resp["oidc_name"] = cfg.OIDCProviderName
+			resp["oidc_login_url"] = "/api/auth/oidc/login"
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// OIDCLoginHandler sends the browser to the identity provider
+func OIDCLoginHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := currentConfig()
+		if !oidcEnabled(cfg) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+			return
+		}
+		authURL, state, err := startOIDCLogin(cfg)
+		if err != nil {
+			log.Printf("[OIDC] Could not start login: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider is unavailable"})
+			return
+		}
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(oidcStateCookie, state, int(oidcStateTTL.Seconds()), "/api/auth/oidc", "",
+			c.Request.TLS != nil || strings.HasPrefix(cfg.PublicURL, "https://"), true)
+		c.Redirect(http.StatusFound, authURL)
+	}
+}
+
+// OIDCCallbackHandler completes a single sign-on login and hands the tokens
+// to the web UI in the url fragment, which never reaches server logs
+func OIDCCallbackHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := currentConfig()
+		fail := func(message string) {
+			recordLogin(c, AuditLoginFailed, "", nil, "sso: "+message)
+			v := url.Values{}
+			v.Set("error", message)
+			c.Redirect(http.StatusFound, strings.TrimSuffix(cfg.PublicURL, "/")+"/login#"+v.Encode())
+		}
+		if !oidcEnabled(cfg) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+			return
+		}
+
+		cookie, _ := c.Cookie(oidcStateCookie)
+		c.SetCookie(oidcStateCookie, "", -1, "/api/auth/oidc", "", false, true)
+		login, err := parseOIDCLogin(cfg, cookie, c.Query("state"))
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		if e := c.Query("error"); e != "" {
+			fail("Identity provider: " + e + " " + c.Query("error_description"))
+			return
+		}
+
+		idToken, err := exchangeOIDCCode(cfg, c.Query("code"), login.Verifier)
+		if err != nil {
+			log.Printf("[OIDC] Code exchange failed: %v", err)
+			fail("Could not complete the login with the identity provider")
+			return
+		}
+		claims, err := verifyIDToken(cfg, idToken, login.Nonce)
+		if err != nil {
+			log.Printf("[OIDC] %v", err)
+			fail("Could not verify the identity provider's response")
+			return
+		}
+		user, err := oidcUser(cfg, claims)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+
+		// The provider is responsible for multi-factor authentication
+		tokens, err := startSession(c, cfg, user, "sso")
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		v := url.Values{}
+		for k, val := range tokens {
+			v.Set(k, fmt.Sprint(val))
+		}
+		c.Redirect(http.StatusFound, strings.TrimSuffix(cfg.PublicURL, "/")+"/login#"+v.Encode())
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRedactQueryCredentials(t *testing.T) {
+	r := gin.New()
+	var logged, ticket string
+	r.Use(RedactQueryCredentials())
+	r.GET("/api/events", func(c *gin.Context) {
+		logged = c.Request.URL.RawQuery
+		ticket = c.GetString("query_ticket")
+		c.Status(http.StatusNoContent)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/events?account_id=1&ticket=secret&access_token=jwt", nil))
+	if logged != "account_id=1" {
+		t.Errorf("query after redaction = %q", logged)
+	}
+	if ticket != "secret" {
+		t.Errorf("ticket = %q", ticket)
+	}
+}
+
+// streamRouter serves a stream route the way main does
+func streamRouter(cfg *Config) *gin.Engine {
+	r := gin.New()
+	r.Use(RedactQueryCredentials())
+	live := r.Group("/api/events")
+	live.POST("/ticket", AuthMiddleware(), StreamTicketHandler())
+	live.Use(StreamAuthMiddleware())
+	live.GET("/poll", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user": currentUser(c).Username})
+	})
+	return r
+}
+
+func streamStatus(r *gin.Engine, query string) int {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/events/poll?"+query, nil))
+	return w.Code
+}
+
+func TestStreamTickets(t *testing.T) {
+	cfg := newTestDB(t)
+	r := streamRouter(cfg)
+	user := createTestUser(t, "viewer", RoleReadOnly)
+
+	session, _, err := createSession(cfg, user, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, _ := issueToken(cfg, user, session)
+	ticket, _ := issueStreamTicket(cfg, user, session, nil)
+	challenge, _ := issueChallenge(cfg, user)
+	_, plain, _ := createAPIToken(user, "ci", []string{ScopeLogsRead}, 0)
+	_, narrow, _ := createAPIToken(user, "ci", []string{ScopeAccountsRead}, 0)
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"ticket", "ticket=" + url.QueryEscape(ticket), http.StatusOK},
+		{"no credentials", "", http.StatusUnauthorized},
+		{"access token as ticket", "ticket=" + url.QueryEscape(access), http.StatusUnauthorized},
+		{"challenge as ticket", "ticket=" + url.QueryEscape(challenge), http.StatusUnauthorized},
+		{"api token as ticket", "ticket=" + plain, http.StatusUnauthorized},
+		{"access_token parameter", "access_token=" + url.QueryEscape(access), http.StatusUnauthorized},
+		{"api token parameter", "access_token=" + plain, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := streamStatus(r, tt.query); got != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.status)
+		}
+	}
+
+	// Read-only users and API tokens with logs:read may ask for a ticket
+	for _, bearer := range []string{access, plain} {
+		req := httptest.NewRequest(http.MethodPost, "/api/events/ticket", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("ticket request: status %d: %s", w.Code, w.Body)
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/events/ticket", nil)
+	req.Header.Set("Authorization", "Bearer "+narrow)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("ticket for a token without logs:read: status %d", w.Code)
+	}
+
+	// Ending the session invalidates its tickets
+	revokeSession(session)
+	if got := streamStatus(r, "ticket="+url.QueryEscape(ticket)); got != http.StatusUnauthorized {
+		t.Errorf("ticket of a revoked session: status %d", got)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Built-in patterns, tried after the custom ones stored in CodePattern.
+// The first capture group (or the whole match) is the extracted value.
+// English keywords start at a word boundary so "Zipcode 94103" is no code.
+var defaultCodePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(?:\b(?:code|otp|passcode|pin)|验证码|校验码|动态码)[^0-9\n]{0,25}?\b([0-9]{4,8})\b`),
+	regexp.MustCompile(`(?i)\b([0-9]{4,8})\s*(?:is your|is the|为您的|是您的|是你的)`),
+	regexp.MustCompile(`(?i)(?:\bcode|验证码)[^A-Za-z0-9\n]{0,20}\b([A-Z0-9]*[0-9][A-Z0-9]*)\b`),
+}
+
+var (
+	urlRe         = regexp.MustCompile(`https?://[^\s<>"'()\[\]]+`)
+	verifyLinkRe  = regexp.MustCompile(`(?i)verif|confirm|activat|validat|magic|signin|sign-in|login|token|reset`)
+	minCodeLength = 4
+)
+
+// validateCodePattern checks a custom extraction pattern before it is saved
+func validateCodePattern(p *CodePattern) error {
+	switch p.Kind {
+	case "code", "link":
+	default:
+		return errors.New("kind must be code or link")
+	}
+	re, err := regexp.Compile(p.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	if re.NumSubexp() > 1 {
+		return errors.New("pattern must have at most one capture group")
+	}
+	return nil
+}
+
+// firstMatch returns the first capture group of the match, or the whole match
+func firstMatch(re *regexp.Regexp, text string) string {
+	m := re.FindStringSubmatch(text)
+	if m == nil {
+		return ""
+	}
+	if len(m) > 1 {
+		return strings.TrimSpace(m[1])
+	}
+	return strings.TrimSpace(m[0])
+}
+
+// extractVerification detects a one-time code and a verification link in
+// the decoded text body
+func extractVerification(text string) (string, string) {
+	var customCodes, customLinks []*regexp.Regexp
+	var patterns []CodePattern
+	DB.Order("id asc").Find(&patterns)
+	for _, p := range patterns {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			continue
+		}
+		if p.Kind == "link" {
+			customLinks = append(customLinks, re)
+		} else {
+			customCodes = append(customCodes, re)
+		}
+	}
+
+	code := ""
+	for _, re := range append(customCodes, defaultCodePatterns...) {
+		if c := firstMatch(re, text); len(c) >= minCodeLength {
+			code = c
+			break
+		}
+	}
+
+	link := ""
+	for _, re := range customLinks {
+		if l := firstMatch(re, text); l != "" {
+			link = l
+			break
+		}
+	}
+	if link == "" {
+		for _, u := range urlRe.FindAllString(text, -1) {
+			if verifyLinkRe.MatchString(u) {
+				link = strings.TrimRight(u, ".,;:!?")
+				break
+			}
+		}
+	}
+	return code, link
+}
@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestExtractVerification(t *testing.T) {
+	newTestDB(t)
+	tests := []struct {
+		name string
+		text string
+		code string
+		link string
+	}{
+		{"keyword", "Your verification code is 482913.", "482913", ""},
+		{"keyword with colon", "OTP: 1234", "1234", ""},
+		{"passcode", "Use passcode 77881 to sign in", "77881", ""},
+		{"code first", "123456 is your login code", "123456", ""},
+		{"chinese", "您的验证码为 654321，5分钟内有效", "654321", ""},
+		{"alphanumeric", "Your code: AB12CD", "AB12CD", ""},
+		{"too short", "Your code is 123", "", ""},
+		{"too long", "Your code is 1234567890", "", ""},
+		{"no keyword", "Order 123456 has shipped", "", ""},
+		{"keyword inside a word", "Zipcode 94103, San Francisco", "", ""},
+		{"pin inside a word", "Shipping 123456 parcels", "", ""},
+		{"postcode", "Postcode: SW1A1AA", "", ""},
+		{"letters only", "Your code: ABCDEF", "", ""},
+		{"verify link", "Confirm here: https://shop.test/verify?t=abc.", "", "https://shop.test/verify?t=abc"},
+		{"other links skipped", "Visit https://shop.test/ or https://shop.test/reset/xyz", "", "https://shop.test/reset/xyz"},
+		{"plain link", "See https://shop.test/news", "", ""},
+		{"code and link", "Code 9911\nhttps://shop.test/login?token=z", "9911", "https://shop.test/login?token=z"},
+	}
+	for _, tt := range tests {
+		code, link := extractVerification(tt.text)
+		if code != tt.code || link != tt.link {
+			t.Errorf("%s: got %q %q, want %q %q", tt.name, code, link, tt.code, tt.link)
+		}
+	}
+}
+
+// Custom patterns are tried before the built-in ones
+func TestExtractVerificationCustomPatterns(t *testing.T) {
+	newTestDB(t)
+	DB.Create(&CodePattern{Kind: "code", Pattern: `Ref-([A-Z]{6})`})
+	DB.Create(&CodePattern{Kind: "code", Pattern: `PIN ([0-9]{2})`}) // Too short, falls through
+	DB.Create(&CodePattern{Kind: "link", Pattern: `https://go\.shop\.test/\S+`})
+
+	text := "Your code is 123456, Ref-QWERTY\nhttps://shop.test/verify/1 https://go.shop.test/abc"
+	code, link := extractVerification(text)
+	if code != "QWERTY" || link != "https://go.shop.test/abc" {
+		t.Errorf("got %q %q", code, link)
+	}
+
+	// Without a custom match the built-in patterns still apply
+	code, link = extractVerification("PIN 12, your code is 123456 https://shop.test/verify/1")
+	if code != "123456" || link != "https://shop.test/verify/1" {
+		t.Errorf("fallback got %q %q", code, link)
+	}
+}
+
+func TestValidateCodePattern(t *testing.T) {
+	tests := []struct {
+		pattern CodePattern
+		ok      bool
+	}{
+		{CodePattern{Kind: "code", Pattern: `Ref-([A-Z]{6})`}, true},
+		{CodePattern{Kind: "link", Pattern: `https://\S+`}, true},
+		{CodePattern{Kind: "token", Pattern: `x`}, false},
+		{CodePattern{Kind: "code", Pattern: `(`}, false},
+		{CodePattern{Kind: "code", Pattern: `(a)(b)`}, false},
+	}
+	for _, tt := range tests {
+		if err := validateCodePattern(&tt.pattern); (err == nil) != tt.ok {
+			t.Errorf("%+v: err = %v, want ok=%v", tt.pattern, err, tt.ok)
+		}
+	}
+}
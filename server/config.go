@@ -1,40 +1,368 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	defaultPassword  = "admin123"
+	defaultJWTSecret = "very-secret-key"
 )
 
 type Config struct {
+	Environment string // "development" or "production", production refuses default secrets
+	ConfigFile  string // YAML or TOML file, environment variables take precedence
+
 	Port            string
 	SMTPPort        string
 	Password        string
 	DBFile          string
 	JWTSecret       string
+	SettingsKey     string // Encrypts secrets stored in the settings table, defaults to one derived from JWT_SECRET
+	JWTIssuer       string
+	JWTAudience     string
 	SMTPRelayHost   string // e.g. "smtp.gmail.com" or "127.0.0.1"
 	SMTPRelayPort   string // e.g. "587"
 	SMTPRelayUser   string
 	SMTPRelayPass   string
 	DefaultEnvelope string // Address to use as MAIL FROM if needed to pass SPF
+	AdminEmail      string // Receives server generated mail such as quarantine digests
+
+	InactiveAliasAction string // "reject" (550) or "drop" (accept silently) for disabled/expired aliases
+
+	WebhookSecret            string // HMAC key for the X-Mail-Generator-Signature header
+	WebhookAttachmentContent bool   // Include base64 attachment data in webhook payloads
+
+	PublicURL           string // Base URL of the web UI, used for links in notifications
+	TelegramBotToken    string
+	TelegramAPIURL      string
+	NotifySnippetLength int // Number of body characters included in chat notifications
+
+	QuarantineDigestInterval time.Duration // 0 disables the periodic digest
+
+	AccessTokenTTL  time.Duration // Lifetime of the JWT access tokens
+	RefreshTokenTTL time.Duration // Idle timeout of a login session
+
+	RateLimit          int // Requests per second per IP on the public endpoints
+	RateBurst          int
+	TrustedProxies     string // Comma separated IPs/CIDRs whose X-Forwarded-For is believed
+	LoginMaxFailures   int    // Failed logins before a username is locked out
+	LoginMaxIPFailures int    // Failed logins before an IP is locked out
+	LoginLockout       time.Duration
+
+	PasswordLogin     bool   // false leaves single sign-on as the only interactive login
+	OIDCIssuer        string // Empty disables single sign-on
+	OIDCClientID      string
+	OIDCClientSecret  string // Empty for public clients, PKCE is always used
+	OIDCRedirectURL   string // Defaults to PUBLIC_URL + /api/auth/oidc/callback
+	OIDCScopes        string
+	OIDCProviderName  string // Shown on the login button
+	OIDCUsernameClaim string
+	OIDCGroupsClaim   string
+	OIDCRoleMapping   string // "group=role,..." the most privileged match wins
+	OIDCDefaultRole   string // Role for users without a mapped group, empty denies them
+
+	DisposableTTL    time.Duration // Default lifetime of disposable inboxes
+	DisposableMaxTTL time.Duration
+
+	IMAPPort    string // Empty disables the IMAP server
+	POP3Port    string // Empty disables the POP3 server
+	TLSCertFile string // Certificate used by the IMAP/POP3 servers
+	TLSKeyFile  string
+}
+
+// LoadConfig reads CONFIG_FILE, if set, and the environment and validates
+// the result
+func LoadConfig() (*Config, error) {
+	path := os.Getenv("CONFIG_FILE")
+	values, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &configLoader{file: values, keys: map[string]bool{}}
+
+	cfg := &Config{
+		Environment: l.getEnv("APP_ENV", "development"),
+		ConfigFile:  path,
+
+		Port:            l.getEnv("PORT", "8080"),
+		SMTPPort:        l.getEnv("SMTP_PORT", "2525"),
+		Password:        l.getEnv("PASSWORD", defaultPassword),
+		DBFile:          l.getEnv("DB_FILE", "mail.db"),
+		JWTSecret:       l.getEnv("JWT_SECRET", defaultJWTSecret),
+		SettingsKey:     l.getEnv("SETTINGS_KEY", ""),
+		JWTIssuer:       l.getEnv("JWT_ISSUER", "mail-generator"),
+		JWTAudience:     l.getEnv("JWT_AUDIENCE", "mail-generator-api"),
+		SMTPRelayHost:   l.getEnv("SMTP_RELAY_HOST", ""), // Empty means direct delivery (not implemented, safer to use relay) or dry-run
+		SMTPRelayPort:   l.getEnv("SMTP_RELAY_PORT", "587"),
+		SMTPRelayUser:   l.getEnv("SMTP_RELAY_USER", ""),
+		SMTPRelayPass:   l.getEnv("SMTP_RELAY_PASS", ""),
+		DefaultEnvelope: l.getEnv("DEFAULT_ENVELOPE", "postmaster@localhost"),
+		AdminEmail:      l.getEnv("ADMIN_EMAIL", ""),
+
+		InactiveAliasAction: l.getEnv("INACTIVE_ALIAS_ACTION", "reject"),
+
+		WebhookSecret:            l.getEnv("WEBHOOK_SECRET", ""),
+		WebhookAttachmentContent: l.getEnv("WEBHOOK_ATTACHMENT_CONTENT", "false") == "true",
+
+		PublicURL:           l.getEnv("PUBLIC_URL", ""),
+		TelegramBotToken:    l.getEnv("TELEGRAM_BOT_TOKEN", ""),
+		TelegramAPIURL:      l.getEnv("TELEGRAM_API_URL", "https://api.telegram.org"),
+		NotifySnippetLength: l.getEnvInt("NOTIFY_SNIPPET_LENGTH", 200),
+
+		QuarantineDigestInterval: l.getEnvDuration("QUARANTINE_DIGEST_INTERVAL", 0),
+
+		AccessTokenTTL:  l.getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL: l.getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+
+		RateLimit:          l.getEnvInt("RATE_LIMIT", 5),
+		RateBurst:          l.getEnvInt("RATE_BURST", 10),
+		TrustedProxies:     l.getEnv("TRUSTED_PROXIES", "127.0.0.1,::1"),
+		LoginMaxFailures:   l.getEnvInt("LOGIN_MAX_FAILURES", 5),
+		LoginMaxIPFailures: l.getEnvInt("LOGIN_MAX_IP_FAILURES", 20),
+		LoginLockout:       l.getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute),
+
+		PasswordLogin:     l.getEnv("PASSWORD_LOGIN", "true") == "true",
+		OIDCIssuer:        strings.TrimSuffix(l.getEnv("OIDC_ISSUER", ""), "/"),
+		OIDCClientID:      l.getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:  l.getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:   l.getEnv("OIDC_REDIRECT_URL", ""),
+		OIDCScopes:        l.getEnv("OIDC_SCOPES", "openid profile email groups"),
+		OIDCProviderName:  l.getEnv("OIDC_PROVIDER_NAME", "SSO"),
+		OIDCUsernameClaim: l.getEnv("OIDC_USERNAME_CLAIM", "preferred_username"),
+		OIDCGroupsClaim:   l.getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		OIDCRoleMapping:   l.getEnv("OIDC_ROLE_MAPPING", ""),
+		OIDCDefaultRole:   l.getEnv("OIDC_DEFAULT_ROLE", ""),
+
+		DisposableTTL:    l.getEnvDuration("DISPOSABLE_TTL", time.Hour),
+		DisposableMaxTTL: l.getEnvDuration("DISPOSABLE_MAX_TTL", 7*24*time.Hour),
+
+		IMAPPort:    l.getEnv("IMAP_PORT", ""),
+		POP3Port:    l.getEnv("POP3_PORT", ""),
+		TLSCertFile: l.getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:  l.getEnv("TLS_KEY_FILE", ""),
+	}
+
+	var keys []string
+	for key := range values {
+		if !l.keys[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		l.errors = append(l.errors, "unknown setting "+strings.ToLower(key)+" in "+path)
+	}
+	problems := append(l.errors, validateConfig(cfg)...)
+	if len(problems) > 0 {
+		return nil, errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return cfg, nil
 }
 
-func LoadConfig() *Config {
-	return &Config{
-		Port:            getEnv("PORT", "8080"),
-		SMTPPort:        getEnv("SMTP_PORT", "2525"),
-		Password:        getEnv("PASSWORD", "admin123"),
-		DBFile:          getEnv("DB_FILE", "mail.db"),
-		JWTSecret:       getEnv("JWT_SECRET", "very-secret-key"),
-		SMTPRelayHost:   getEnv("SMTP_RELAY_HOST", ""), // Empty means direct delivery (not implemented, safer to use relay) or dry-run
-		SMTPRelayPort:   getEnv("SMTP_RELAY_PORT", "587"),
-		SMTPRelayUser:   getEnv("SMTP_RELAY_USER", ""),
-		SMTPRelayPass:   getEnv("SMTP_RELAY_PASS", ""),
-		DefaultEnvelope: getEnv("DEFAULT_ENVELOPE", "postmaster@localhost"),
+// readConfigFile reads a flat YAML or TOML file whose keys are the
+// environment variable names, e.g. smtp_relay_host. Lists are joined with
+// commas.
+func readConfigFile(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("%s: config file must end in .yaml, .yml or .toml", path)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	values := map[string]string{}
+	for key, v := range raw {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			return nil, fmt.Errorf("%s: %s must not be a table", path, key)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[strings.ToUpper(key)] = strings.Join(items, ",")
+		case nil:
+			values[strings.ToUpper(key)] = ""
+		default:
+			values[strings.ToUpper(key)] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
 }
 
-func getEnv(key, fallback string) string {
+// validateConfig lists every problem of the configuration
+func validateConfig(cfg *Config) []string {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch cfg.Environment {
+	case "production":
+		if cfg.Password == defaultPassword {
+			fail("PASSWORD must not be the default in production")
+		}
+		if cfg.JWTSecret == defaultJWTSecret || len(cfg.JWTSecret) < 32 {
+			fail("JWT_SECRET must be a random string of at least 32 characters in production")
+		}
+	case "development":
+		if cfg.Password == defaultPassword || cfg.JWTSecret == defaultJWTSecret {
+			log.Printf("WARNING: running with the default PASSWORD or JWT_SECRET, set APP_ENV=production to refuse this")
+		}
+	default:
+		fail("APP_ENV must be development or production")
+	}
+
+	for _, port := range [][2]string{{"PORT", cfg.Port}, {"SMTP_PORT", cfg.SMTPPort}, {"SMTP_RELAY_PORT", cfg.SMTPRelayPort}, {"IMAP_PORT", cfg.IMAPPort}, {"POP3_PORT", cfg.POP3Port}} {
+		if n, err := strconv.Atoi(port[1]); port[1] != "" && (err != nil || n < 1 || n > 65535) {
+			fail("%s must be a port number", port[0])
+		}
+	}
+	if cfg.InactiveAliasAction != "reject" && cfg.InactiveAliasAction != "drop" {
+		fail("INACTIVE_ALIAS_ACTION must be reject or drop")
+	}
+	for _, u := range [][2]string{{"PUBLIC_URL", cfg.PublicURL}, {"TELEGRAM_API_URL", cfg.TelegramAPIURL}, {"OIDC_ISSUER", cfg.OIDCIssuer}, {"OIDC_REDIRECT_URL", cfg.OIDCRedirectURL}} {
+		if parsed, err := url.Parse(u[1]); u[1] != "" && (err != nil || parsed.Scheme == "" || parsed.Host == "") {
+			fail("%s must be an absolute url", u[0])
+		}
+	}
+
+	if cfg.AccessTokenTTL <= 0 || cfg.RefreshTokenTTL < cfg.AccessTokenTTL {
+		fail("ACCESS_TOKEN_TTL must be positive and not longer than REFRESH_TOKEN_TTL")
+	}
+	if cfg.DisposableTTL <= 0 || cfg.DisposableMaxTTL < cfg.DisposableTTL {
+		fail("DISPOSABLE_TTL must be positive and not longer than DISPOSABLE_MAX_TTL")
+	}
+	if cfg.QuarantineDigestInterval < 0 {
+		fail("QUARANTINE_DIGEST_INTERVAL must not be negative")
+	}
+	if cfg.LoginLockout <= 0 {
+		fail("LOGIN_LOCKOUT must be positive")
+	}
+	if cfg.RateLimit <= 0 || cfg.RateBurst <= 0 || cfg.LoginMaxFailures < 0 || cfg.LoginMaxIPFailures < 0 || cfg.NotifySnippetLength < 0 {
+		fail("RATE_LIMIT and RATE_BURST must be positive, the LOGIN_MAX_* limits and NOTIFY_SNIPPET_LENGTH must not be negative")
+	}
+
+	for _, proxy := range splitTargets(cfg.TrustedProxies) {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				fail("TRUSTED_PROXIES: %q is not an IP or CIDR", proxy)
+			}
+		}
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		fail("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	} else if cfg.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			fail("TLS certificate: %v", err)
+		}
+	}
+
+	if cfg.OIDCIssuer != "" && cfg.OIDCClientID == "" {
+		fail("OIDC_CLIENT_ID is required with OIDC_ISSUER")
+	}
+	if cfg.OIDCDefaultRole != "" && !validRoles[cfg.OIDCDefaultRole] {
+		fail("OIDC_DEFAULT_ROLE must be admin, operator, owner or readonly")
+	}
+	for _, pair := range splitTargets(cfg.OIDCRoleMapping) {
+		if _, role, ok := strings.Cut(pair, "="); !ok || !validRoles[strings.TrimSpace(role)] {
+			fail("OIDC_ROLE_MAPPING: %q is not group=role", pair)
+		}
+	}
+	if !cfg.PasswordLogin && cfg.OIDCIssuer == "" {
+		fail("PASSWORD_LOGIN=false needs single sign-on (OIDC_ISSUER)")
+	}
+	return problems
+}
+
+// serverTLSConfig serves the configured certificate, nil when none is set.
+// The certificate is reloaded together with the configuration.
+func serverTLSConfig(cfg *Config) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		return nil, nil
+	}
+	if err := certificates.Load(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: certificates.GetCertificate, MinVersion: tls.VersionTLS12}, nil
+}
+
+// configLoader reads the settings of one LoadConfig call: the values from
+// CONFIG_FILE, the keys looked up so far and the values that did not parse
+type configLoader struct {
+	file   map[string]string
+	keys   map[string]bool
+	errors []string
+}
+
+// lookup returns the environment variable or, when it is not set, the
+// value from the config file
+func (l *configLoader) lookup(key string) (string, bool) {
+	l.keys[key] = true
 	if value, exists := os.LookupEnv(key); exists {
+		return value, true
+	}
+	value, exists := l.file[key]
+	return value, exists
+}
+
+func (l *configLoader) getEnv(key, fallback string) string {
+	if value, exists := l.lookup(key); exists {
 		return value
 	}
 	return fallback
 }
+
+func (l *configLoader) getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, exists := l.lookup(key); exists && value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			l.errors = append(l.errors, key+" must be a duration such as 15m")
+			return fallback
+		}
+		return d
+	}
+	return fallback
+}
+
+func (l *configLoader) getEnvInt(key string, fallback int) int {
+	if value, exists := l.lookup(key); exists && value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			l.errors = append(l.errors, key+" must be a number")
+			return fallback
+		}
+		return n
+	}
+	return fallback
+}
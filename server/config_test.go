@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	yamlFile := writeConfigFile(t, "config.yaml", `
+smtp_relay_host: smtp.example.com
+SMTP_RELAY_PORT: 587
+login_lockout: 5m
+trusted_proxies: [127.0.0.1, 10.0.0.0/8]
+`)
+	tomlFile := writeConfigFile(t, "config.toml", `
+smtp_relay_host = "smtp.example.com"
+smtp_relay_port = 587
+login_lockout = "5m"
+trusted_proxies = ["127.0.0.1", "10.0.0.0/8"]
+`)
+	for _, path := range []string{yamlFile, tomlFile} {
+		t.Setenv("CONFIG_FILE", path)
+		t.Setenv("SMTP_RELAY_HOST", "env.example.com") // The environment wins
+
+		cfg, err := LoadConfig()
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if cfg.SMTPRelayHost != "env.example.com" || cfg.SMTPRelayPort != "587" || cfg.LoginLockout != 5*time.Minute || cfg.TrustedProxies != "127.0.0.1,10.0.0.0/8" {
+			t.Errorf("%s: %+v", path, cfg)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		want    []string
+	}{
+		{"unknown key", "smtp_relay_hots: x\n", nil, []string{"unknown setting smtp_relay_hots"}},
+		{"bad duration", "login_lockout: soon\n", nil, []string{"LOGIN_LOCKOUT must be a duration"}},
+		{"zero lockout", "login_lockout: 0s\n", nil, []string{"LOGIN_LOCKOUT must be positive"}},
+		{"bad number", "rate_limit: many\n", nil, []string{"RATE_LIMIT must be a number"}},
+		{"bad port", "port: 70000\n", nil, []string{"PORT must be a port number"}},
+		{"nested", "smtp:\n  host: x\n", nil, []string{"must not be a table"}},
+		{"half tls", "tls_cert_file: /tmp/cert.pem\n", nil, []string{"TLS_CERT_FILE and TLS_KEY_FILE must be set together"}},
+		{"bad role", "oidc_role_mapping: admins=root\n", nil, []string{"OIDC_ROLE_MAPPING"}},
+		{"production defaults", "app_env: production\n", nil, []string{"PASSWORD must not be the default", "JWT_SECRET must be a random string"}},
+		{"production short secret", "app_env: production\n", map[string]string{"PASSWORD": "a-real-password", "JWT_SECRET": "short"}, []string{"JWT_SECRET must be a random string"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", writeConfigFile(t, "config.yaml", tt.content))
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := LoadConfig()
+			if err == nil {
+				t.Fatal("configuration was accepted")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigProduction(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "config.yaml", "app_env: production\n"))
+	t.Setenv("PASSWORD", "a-real-password")
+	t.Setenv("JWT_SECRET", strings.Repeat("k", 32))
+	if _, err := LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Every load starts from scratch, problems of a previous load do not leak
+// into the next one
+func TestLoadConfigIndependentLoads(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "bad.yaml", "bogus: 1\nrate_limit: x\n"))
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("bad configuration was accepted")
+	}
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "good.yaml", "rate_limit: 3\n"))
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RateLimit != 3 {
+		t.Errorf("RateLimit = %d", cfg.RateLimit)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 
 	"gorm.io/driver/sqlite"
@@ -11,35 +12,199 @@ import (
 type Domain struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
 	Name      string    `gorm:"uniqueIndex;not null" json:"name"`
+	OwnerID   *uint     `gorm:"index" json:"owner_id"` // User with the owner role, nil for staff-managed domains
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
 // Account represents an email account or forwarding rule
 type Account struct {
-	ID          uint      `gorm:"primaryKey" json:"id"`
-	Pattern     string    `gorm:"uniqueIndex;not null" json:"pattern"` // Regex or wildcards like *@domain.com
-	ForwardTo   string    `gorm:"not null" json:"forward_to"`          // Target email(s), comma separated
-	Description string    `json:"description"`
-	HitCount    int64     `gorm:"default:0" json:"hit_count"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	Pattern     string `gorm:"uniqueIndex;not null" json:"pattern"` // Regex or wildcards like *@domain.com
+	ForwardTo   string `gorm:"not null" json:"forward_to"`          // Target email(s), comma separated
+	Notify      string `json:"notify"`                              // Chat targets (kind:target), comma separated
+	Description string `json:"description"`
+	HitCount    int64  `gorm:"default:0" json:"hit_count"`
+	OwnerID     *uint  `gorm:"index" json:"owner_id"` // Only receives mail for domains of the same owner
+
+	Enabled        *bool      `gorm:"default:true" json:"enabled"`
+	ExpiresAt      *time.Time `json:"expires_at"`                    // nil means never
+	MaxMessages    int64      `gorm:"default:0" json:"max_messages"` // 0 means unlimited, 1 makes a single-use alias
+	InactiveAction string     `json:"inactive_action"`               // "reject", "drop"; empty uses the server default
+
+	UsedFor           string `json:"used_for"`            // Website/service the alias was handed to
+	ServiceDomain     string `json:"service_domain"`      // Domain expected to send mail, derived from UsedFor when empty
+	Tags              string `json:"tags"`                // Comma separated
+	FirstSenderDomain string `json:"first_sender_domain"` // Recorded from the first forwarded mail
+	LeakDomains       string `json:"leak_domains"`        // Unrelated sender domains seen so far, comma separated
+
+	SubjectTemplate string `json:"subject_template"` // Go text/template, empty uses "[Fwd: {{.From}}] {{.Subject}}"
+	BannerTemplate  string `json:"banner_template"`  // Prepended to the forwarded body
+	AddHeaders      string `json:"add_headers"`      // One "Name: value template" per line
+	RemoveHeaders   string `json:"remove_headers"`   // Comma separated header names
+
+	NotifyCodeOnly bool `gorm:"default:false" json:"notify_code_only"` // Only send the extracted code in chat/webhook notifications
+
+	MailboxUser         string `gorm:"index" json:"mailbox_user"` // Login for IMAP access to the local mailbox
+	MailboxPasswordHash string `json:"-"`
+	NextUID             uint32 `gorm:"default:1" json:"-"` // Next IMAP UID of the local mailbox
+
+	Disposable     bool   `gorm:"default:false;index" json:"disposable"` // Deleted with its mail once expired
+	InboxTokenHash string `gorm:"index" json:"-"`                        // SHA-256 of the public inbox token
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 // Log represents a forwarding log
 type Log struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
+	AccountID uint      `gorm:"index" json:"account_id"`
+	OwnerID   *uint     `gorm:"index" json:"owner_id"` // Copied from the account
 	From      string    `gorm:"index" json:"from"`
 	To        string    `gorm:"index" json:"to"`
 	Subject   string    `json:"subject"`
 	Content   string    `json:"content"` // Decoded text/plain content (truncated)
 	Raw       string    `json:"raw"`     // Raw RFC822 content (truncated)
-	Status    string    `json:"status"`  // "success", "failed"
+	Status    string    `json:"status"`  // "success", "partial", "failed", "quarantined", "rejected", "dropped"
 	Error     string    `json:"error,omitempty"`
 	ClientIP  string    `json:"client_ip"`
+	Alert     string    `json:"alert,omitempty"` // Set when the sender looks unrelated to the alias' service
+	Code      string    `json:"code,omitempty"`  // Extracted one-time code
+	Link      string    `json:"link,omitempty"`  // Extracted verification link
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// Quarantine holds the full raw message of a mail that could not be delivered
+type Quarantine struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	LogID     uint      `gorm:"index" json:"log_id"`
+	AccountID uint      `gorm:"index" json:"account_id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Subject   string    `json:"subject"`
+	Raw       string    `json:"raw,omitempty"` // Full raw RFC822 content
+	Reason    string    `json:"reason"`
+	Attempts  int       `gorm:"default:1" json:"attempts"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SenderFilter allows or blocks mail from specific senders, either globally
+// (AccountID nil) or for a single account
+type SenderFilter struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	AccountID   *uint     `gorm:"index" json:"account_id"`    // nil means global
+	Action      string    `gorm:"not null" json:"action"`     // "allow", "block"
+	MatchType   string    `gorm:"not null" json:"match_type"` // "address", "domain", "regex"
+	Value       string    `gorm:"not null" json:"value"`
+	Description string    `json:"description"`
+	HitCount    int64     `gorm:"default:0" json:"hit_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// CodePattern is a custom regex used to extract verification codes or links
+type CodePattern struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Kind        string    `gorm:"not null" json:"kind"`    // "code", "link"
+	Pattern     string    `gorm:"not null" json:"pattern"` // The first capture group (or whole match) is extracted
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Message is a mail stored in the local mailbox of an account
+type Message struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	AccountID uint      `gorm:"index:idx_messages_account_uid" json:"account_id"`
+	UID       uint32    `gorm:"index:idx_messages_account_uid" json:"uid"`
+	LogID     uint      `gorm:"index" json:"log_id"`
+	Mailbox   string    `gorm:"not null;default:INBOX" json:"mailbox"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Subject   string    `json:"subject"`
+	Flags     string    `json:"flags"` // Space separated IMAP flags, e.g. "\\Seen \\Flagged"
+	Size      int       `json:"size"`
+	Raw       string    `json:"-"` // Full raw RFC822 content
+	Unread    bool      `gorm:"-" json:"unread"`
 	CreatedAt time.Time `gorm:"index" json:"created_at"`
 }
 
+// User is a person logging into the web UI and API
+type User struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	Username     string     `gorm:"uniqueIndex;not null" json:"username"`
+	PasswordHash string     `json:"-"`
+	Role         string     `gorm:"not null;default:readonly" json:"role"` // "admin", "operator", "readonly", "owner"
+	Enabled      *bool      `gorm:"default:true" json:"enabled"`
+	LastLoginAt  *time.Time `json:"last_login_at"`
+
+	TOTPEnabled   bool   `gorm:"column:totp_enabled;default:false" json:"totp_enabled"`
+	TOTPRequired  bool   `gorm:"column:totp_required;default:false" json:"totp_required"` // Must enroll before the next login completes
+	TOTPSecret    string `gorm:"column:totp_secret" json:"-"`                             // Base32, also set while enrollment is pending
+	TOTPLastStep  int64  `gorm:"column:totp_last_step;default:0" json:"-"`                // Last accepted time step, prevents code reuse
+	RecoveryCodes string `json:"-"`                                                       // SHA-256 hashes, comma separated
+
+	SSOSubject string `gorm:"column:sso_subject;index" json:"sso_subject,omitempty"` // "issuer|sub" of users created by single sign-on
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// APIToken is a long-lived credential for scripts, acting as its user
+// within the granted scopes
+type APIToken struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"index" json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // First characters, to recognise the token
+	TokenHash  string     `gorm:"uniqueIndex" json:"-"`
+	Scopes     string     `json:"scopes"` // Comma separated, e.g. "logs:read,aliases:generate"
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// LoginSession is a login on one device. Its refresh token rotates on every
+// use and the short lived access tokens carry the session id, so revoking
+// the session signs the device out.
+type LoginSession struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	UserID       uint       `gorm:"index" json:"user_id"`
+	RefreshHash  string     `gorm:"uniqueIndex" json:"-"`
+	PreviousHash string     `gorm:"index" json:"-"` // Rotated out refresh token, replaying it revokes the session
+	UserAgent    string     `json:"user_agent"`
+	IP           string     `json:"ip"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	LastUsedAt   time.Time  `json:"last_used_at"`
+	RevokedAt    *time.Time `json:"revoked_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// AuditEntry records an administrative action or login attempt
+type AuditEntry struct {
+	ID        uint            `gorm:"primaryKey" json:"id"`
+	UserID    *uint           `gorm:"index" json:"user_id"`
+	Username  string          `gorm:"index" json:"username"`
+	TokenID   *uint           `json:"token_id,omitempty"` // Set when the action used an API token
+	IP        string          `gorm:"index" json:"ip"`
+	Action    string          `gorm:"index" json:"action"` // e.g. "domain.create", "login.failed"
+	Target    string          `json:"target"`              // e.g. "domain"
+	TargetID  uint            `gorm:"index" json:"target_id"`
+	Detail    string          `json:"detail"`
+	Changes   json.RawMessage `json:"changes"` // {"field": {"before": x, "after": y}}
+	CreatedAt time.Time       `gorm:"index" json:"created_at"`
+}
+
+// Setting overrides a Config value at runtime, see runtimeSettings
+type Setting struct {
+	Key       string    `gorm:"primaryKey" json:"key"`
+	Value     string    `json:"-"` // AES-GCM sealed and base64 encoded for secrets
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
 var DB *gorm.DB
 
 func InitDB(cfg *Config) {
@@ -50,8 +215,12 @@ func InitDB(cfg *Config) {
 	}
 
 	// Migrate the schema
-	err = DB.AutoMigrate(&Domain{}, &Account{}, &Log{})
+	err = DB.AutoMigrate(&Domain{}, &Account{}, &Log{}, &Quarantine{}, &SenderFilter{}, &CodePattern{}, &Message{}, &User{}, &APIToken{}, &LoginSession{}, &AuditEntry{}, &Setting{})
 	if err != nil {
 		panic("failed to migrate database: " + err.Error())
 	}
+
+	if err := ensureAdminUser(cfg); err != nil {
+		panic("failed to create admin user: " + err.Error())
+	}
 }
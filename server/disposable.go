@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DisposableRequest describes a throwaway inbox to create
+type DisposableRequest struct {
+	DomainID    uint   `json:"domain_id" binding:"required"`
+	Scheme      string `json:"scheme"`
+	Prefix      string `json:"prefix"`
+	TTL         string `json:"ttl"` // Go duration such as "30m", empty uses DISPOSABLE_TTL
+	Description string `json:"description"`
+}
+
+// PublicMessage is a stored message as returned by the public inbox API
+type PublicMessage struct {
+	ID          uint         `json:"id"`
+	From        string       `json:"from"`
+	To          string       `json:"to"`
+	Subject     string       `json:"subject"`
+	Text        string       `json:"text"`
+	HTML        string       `json:"html"`
+	Code        string       `json:"code,omitempty"`
+	Link        string       `json:"link,omitempty"`
+	Attachments []Attachment `json:"attachments"`
+	Received    time.Time    `json:"received"`
+}
+
+func hashInboxToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createDisposable generates an alias that stores mail locally, expires
+// after the TTL and can be read with the returned token
+func createDisposable(cfg *Config, req *DisposableRequest) (*Account, string, string, error) {
+	ttl := cfg.DisposableTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			return nil, "", "", errors.New("ttl must be a positive duration such as 30m or 2h")
+		}
+		ttl = d
+	}
+	if cfg.DisposableMaxTTL > 0 && ttl > cfg.DisposableMaxTTL {
+		return nil, "", "", errors.New("ttl must not exceed " + cfg.DisposableMaxTTL.String())
+	}
+
+	description := req.Description
+	if description == "" {
+		description = "Disposable inbox"
+	}
+	expiresAt := time.Now().Add(ttl)
+	account, address, err := generateAlias(&GenerateRequest{
+		DomainID:    req.DomainID,
+		Scheme:      req.Scheme,
+		Prefix:      req.Prefix,
+		ForwardTo:   localTarget,
+		Description: description,
+		ExpiresAt:   &expiresAt,
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	token := randomHex(40)
+	account.Disposable = true
+	account.InboxTokenHash = hashInboxToken(token)
+	if err := DB.Model(account).Select("disposable", "inbox_token_hash").Updates(account).Error; err != nil {
+		DB.Unscoped().Delete(account)
+		return nil, "", "", err
+	}
+	return account, address, token, nil
+}
+
+// findDisposable resolves a public inbox token, expired inboxes are not found
+func findDisposable(token string) (*Account, error) {
+	var account Account
+	if token == "" || DB.Where("disposable = ? AND inbox_token_hash = ?", true, hashInboxToken(token)).First(&account).Error != nil {
+		return nil, errors.New("inbox not found")
+	}
+	if account.ExpiresAt != nil && !time.Now().Before(*account.ExpiresAt) {
+		return nil, errors.New("inbox not found")
+	}
+	return &account, nil
+}
+
+// publicMessages returns the newest messages of an inbox, parsed and with
+// the extracted verification codes of their logs
+func publicMessages(account *Account, since *time.Time, limit int) ([]PublicMessage, error) {
+	query := DB.Where("account_id = ? AND mailbox = ?", account.ID, defaultMailbox)
+	if since != nil {
+		query = query.Where("created_at > ?", *since)
+	}
+	var messages []Message
+	if err := query.Order("uid desc").Limit(limit).Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	result := []PublicMessage{}
+	for _, m := range messages {
+		pm := PublicMessage{
+			ID:          m.ID,
+			From:        m.From,
+			To:          m.To,
+			Subject:     m.Subject,
+			Attachments: []Attachment{},
+			Received:    m.CreatedAt,
+		}
+		if parsed, err := parseMessage(m.Raw); err == nil {
+			pm.Text = parsed.Text
+			pm.HTML = sanitizeHTML(parsed.HTML, false)
+			pm.Attachments = parsed.Attachments
+		}
+		var l Log
+		if m.LogID != 0 && DB.Select("id", "code", "link").First(&l, m.LogID).Error == nil {
+			pm.Code = l.Code
+			pm.Link = l.Link
+		}
+		result = append(result, pm)
+	}
+	return result, nil
+}
+
+// literalAddress returns the address matched by an exact alias pattern
+func literalAddress(pattern string) string {
+	re, err := regexp.Compile(strings.TrimSuffix(strings.TrimPrefix(pattern, "^"), "$"))
+	if err != nil {
+		return pattern
+	}
+	prefix, _ := re.LiteralPrefix()
+	return prefix
+}
+
+// StartDisposableCleanup removes expired disposable inboxes and their mail
+func StartDisposableCleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		cleanupDisposable(time.Now())
+	}
+}
+
+func cleanupDisposable(now time.Time) {
+	var expired []Account
+	DB.Where("disposable = ? AND expires_at <= ?", true, now).Find(&expired)
+	for _, account := range expired {
+		DB.Where("account_id = ?", account.ID).Delete(&Message{})
+		DB.Unscoped().Delete(&Account{}, account.ID)
+		log.Printf("Removed expired disposable inbox %s", literalAddress(account.Pattern))
+	}
+}
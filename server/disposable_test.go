@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCreateDisposable(t *testing.T) {
+	cfg := newTestDB(t)
+	cfg.DisposableTTL = time.Hour
+	cfg.DisposableMaxTTL = 24 * time.Hour
+	domain := Domain{Name: "example.com"}
+	DB.Create(&domain)
+
+	for _, ttl := range []string{"soon", "-1h", "0s", "25h"} {
+		if _, _, _, err := createDisposable(cfg, &DisposableRequest{DomainID: domain.ID, TTL: ttl}); err == nil {
+			t.Errorf("ttl %q was accepted", ttl)
+		}
+	}
+
+	account, address, token, err := createDisposable(cfg, &DisposableRequest{DomainID: domain.ID, Scheme: "hex"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored Account
+	DB.First(&stored, account.ID)
+	if !stored.Disposable || stored.ForwardTo != localTarget || stored.InboxTokenHash != hashInboxToken(token) {
+		t.Errorf("stored inbox %+v", stored)
+	}
+	if stored.InboxTokenHash == token || literalAddress(stored.Pattern) != address {
+		t.Errorf("token stored in plain text or address %s for %s", address, stored.Pattern)
+	}
+	if left := time.Until(*stored.ExpiresAt); left <= 59*time.Minute || left > time.Hour {
+		t.Errorf("expires in %s", left)
+	}
+}
+
+func TestFindDisposable(t *testing.T) {
+	newTestDB(t)
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	accounts := []Account{
+		{Pattern: "^live@example\\.com$", ForwardTo: "local", Disposable: true, InboxTokenHash: hashInboxToken("live-token"), ExpiresAt: &future},
+		{Pattern: "^old@example\\.com$", ForwardTo: "local", Disposable: true, InboxTokenHash: hashInboxToken("old-token"), ExpiresAt: &past},
+		// A regular alias is never readable through the public API
+		{Pattern: "^kept@example\\.com$", ForwardTo: "local", InboxTokenHash: hashInboxToken("kept-token")},
+	}
+	for i := range accounts {
+		DB.Create(&accounts[i])
+	}
+
+	tests := []struct {
+		token string
+		want  uint
+	}{
+		{"live-token", accounts[0].ID},
+		{"old-token", 0},
+		{"kept-token", 0},
+		{"", 0},
+		{"unknown", 0},
+		{accounts[0].InboxTokenHash, 0},
+	}
+	for _, tt := range tests {
+		var got uint
+		account, err := findDisposable(tt.token)
+		if err == nil {
+			got = account.ID
+		}
+		if got != tt.want {
+			t.Errorf("findDisposable(%q) = #%d, want #%d", tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestCleanupDisposable(t *testing.T) {
+	newTestDB(t)
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	expired := Account{Pattern: "^old@example\\.com$", ForwardTo: "local", Disposable: true, ExpiresAt: &past}
+	live := Account{Pattern: "^live@example\\.com$", ForwardTo: "local", Disposable: true, ExpiresAt: &future}
+	// Regular aliases only stop accepting mail when they expire
+	regular := Account{Pattern: "^alias@example\\.com$", ForwardTo: "local", ExpiresAt: &past}
+	for _, a := range []*Account{&expired, &live, &regular} {
+		DB.Create(a)
+		DB.Create(&Message{AccountID: a.ID, Mailbox: defaultMailbox, UID: 1, Raw: "Subject: x\r\n\r\nx\r\n"})
+	}
+
+	cleanupDisposable(now)
+
+	var ids []uint
+	DB.Model(&Account{}).Order("id").Pluck("id", &ids)
+	if len(ids) != 2 || ids[0] != live.ID || ids[1] != regular.ID {
+		t.Errorf("accounts left %v", ids)
+	}
+	var owners []uint
+	DB.Model(&Message{}).Order("account_id").Pluck("account_id", &owners)
+	if len(owners) != 2 || owners[0] != live.ID || owners[1] != regular.ID {
+		t.Errorf("messages left for accounts %v", owners)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	eventLogCreated = "log.created"
+	eventLogUpdated = "log.updated"
+)
+
+// Event is pushed to /api/events subscribers when a log is created or its
+// delivery status changes
+type Event struct {
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	LogID     uint      `json:"log_id"`
+	AccountID uint      `json:"account_id"`
+	OwnerID   *uint     `json:"owner_id,omitempty"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Subject   string    `json:"subject"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Alert     string    `json:"alert,omitempty"`
+	Code      string    `json:"code,omitempty"`
+	Link      string    `json:"link,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// EventFilter selects the events a subscriber receives, zero values match all
+type EventFilter struct {
+	AccountIDs map[uint]bool
+	OwnerID    *uint // Set for tenants
+}
+
+// parseEventFilter reads ?account_id=1,2 style filters
+func parseEventFilter(accountIDs string) (EventFilter, error) {
+	f := EventFilter{}
+	for _, s := range splitTargets(accountIDs) {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return f, err
+		}
+		if f.AccountIDs == nil {
+			f.AccountIDs = map[uint]bool{}
+		}
+		f.AccountIDs[uint(id)] = true
+	}
+	return f, nil
+}
+
+func (f EventFilter) Matches(e *Event) bool {
+	if f.OwnerID != nil && (e.OwnerID == nil || *e.OwnerID != *f.OwnerID) {
+		return false
+	}
+	return f.AccountIDs == nil || f.AccountIDs[e.AccountID]
+}
+
+type eventSubscriber struct {
+	ch     chan Event
+	filter EventFilter
+}
+
+// EventHub fans out events to the connected SSE, WebSocket and long-poll
+// clients. Slow clients miss events instead of blocking delivery.
+type EventHub struct {
+	mu   sync.Mutex
+	seq  uint64
+	subs map[*eventSubscriber]struct{}
+}
+
+var events = &EventHub{subs: map[*eventSubscriber]struct{}{}}
+
+func (h *EventHub) Subscribe(filter EventFilter) *eventSubscriber {
+	sub := &eventSubscriber{ch: make(chan Event, 32), filter: filter}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *EventHub) Unsubscribe(sub *eventSubscriber) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+func (h *EventHub) Publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	e.ID = h.seq
+	for sub := range h.subs {
+		if !sub.filter.Matches(&e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	}
+}
+
+// publishLog notifies subscribers about a created or updated log
+func publishLog(eventType string, l *Log) {
+	events.Publish(Event{
+		Type:      eventType,
+		LogID:     l.ID,
+		AccountID: l.AccountID,
+		OwnerID:   l.OwnerID,
+		From:      l.From,
+		To:        l.To,
+		Subject:   l.Subject,
+		Status:    l.Status,
+		Error:     l.Error,
+		Alert:     l.Alert,
+		Code:      l.Code,
+		Link:      l.Link,
+		Time:      time.Now(),
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	gosmtp "github.com/emersion/go-smtp"
+	"gorm.io/gorm"
+)
+
+var errSenderRejected = &gosmtp.SMTPError{
+	Code:         550,
+	EnhancedCode: gosmtp.EnhancedCode{5, 7, 1},
+	Message:      "Sender rejected",
+}
+
+// validateSenderFilter checks the action, match type and value of a filter
+func validateSenderFilter(f *SenderFilter) error {
+	f.Value = strings.TrimSpace(f.Value)
+	if f.Value == "" {
+		return errors.New("value is required")
+	}
+
+	switch f.Action {
+	case "allow", "block":
+	default:
+		return errors.New("action must be allow or block")
+	}
+
+	switch f.MatchType {
+	case "address", "domain":
+		f.Value = strings.ToLower(f.Value)
+	case "regex":
+		if _, err := regexp.Compile(f.Value); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+	default:
+		return errors.New("match_type must be address, domain or regex")
+	}
+	return nil
+}
+
+// Matches reports whether the sender address is covered by the filter
+func (f *SenderFilter) Matches(from string) bool {
+	from = strings.ToLower(strings.TrimSpace(from))
+	switch f.MatchType {
+	case "address":
+		return from == f.Value
+	case "domain":
+		at := strings.LastIndex(from, "@")
+		if at == -1 {
+			return false
+		}
+		domain := from[at+1:]
+		return domain == f.Value || strings.HasSuffix(domain, "."+f.Value)
+	case "regex":
+		matched, err := regexp.MatchString(f.Value, from)
+		return err == nil && matched
+	}
+	return false
+}
+
+// checkSender evaluates the filters of one scope (global when accountID is
+// nil). An allow entry wins over any block entry of the same scope. The
+// returned filter is the block entry that rejected the sender, if any.
+func checkSender(accountID *uint, from string) *SenderFilter {
+	var filters []SenderFilter
+	query := DB.Where("account_id IS NULL")
+	if accountID != nil {
+		query = DB.Where("account_id = ?", *accountID)
+	}
+	query.Find(&filters)
+
+	var blockedBy *SenderFilter
+	for i := range filters {
+		f := &filters[i]
+		if !f.Matches(from) {
+			continue
+		}
+		if f.Action == "allow" {
+			return nil
+		}
+		if blockedBy == nil {
+			blockedBy = f
+		}
+	}
+	return blockedBy
+}
+
+// recordRejection counts the filter hit and leaves a trace in the logs
+func recordRejection(f *SenderFilter, accountID uint, from string, to string) {
+	DB.Model(f).Update("hit_count", gorm.Expr("hit_count + ?", 1))
+
+	scope := "global"
+	if f.AccountID != nil {
+		scope = "account"
+	}
+	var account Account
+	if accountID != 0 {
+		DB.Select("id", "owner_id").First(&account, accountID)
+	}
+	l := Log{
+		AccountID: accountID,
+		OwnerID:   account.OwnerID,
+		From:      from,
+		To:        to,
+		Status:    "rejected",
+		Error:     fmt.Sprintf("blocked by %s sender filter #%d (%s %s)", scope, f.ID, f.MatchType, f.Value),
+		CreatedAt: time.Now(),
+	}
+	DB.Create(&l)
+	publishLog(eventLogCreated, &l)
+}
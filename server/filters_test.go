@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestSenderFilterMatches(t *testing.T) {
+	tests := []struct {
+		filter SenderFilter
+		from   string
+		want   bool
+	}{
+		{SenderFilter{MatchType: "address", Value: "spam@bad.test"}, "Spam@Bad.test", true},
+		{SenderFilter{MatchType: "address", Value: "spam@bad.test"}, "other@bad.test", false},
+		{SenderFilter{MatchType: "domain", Value: "bad.test"}, "a@bad.test", true},
+		{SenderFilter{MatchType: "domain", Value: "bad.test"}, "a@mail.bad.test", true},
+		{SenderFilter{MatchType: "domain", Value: "bad.test"}, "a@notbad.test", false},
+		{SenderFilter{MatchType: "domain", Value: "bad.test"}, "bad.test", false},
+		{SenderFilter{MatchType: "regex", Value: `^news-\d+@`}, "news-12@shop.test", true},
+		{SenderFilter{MatchType: "regex", Value: `(`}, "news@shop.test", false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Matches(tt.from); got != tt.want {
+			t.Errorf("%s %s matches %s = %v, want %v", tt.filter.MatchType, tt.filter.Value, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSender(t *testing.T) {
+	newTestDB(t)
+	account := Account{Pattern: "^a@example\\.com$", ForwardTo: "local"}
+	DB.Create(&account)
+	other := Account{Pattern: "^b@example\\.com$", ForwardTo: "local"}
+	DB.Create(&other)
+
+	filters := []SenderFilter{
+		// Global: block the domain but allow one address of it
+		{Action: "block", MatchType: "domain", Value: "bad.test"},
+		{Action: "allow", MatchType: "address", Value: "billing@bad.test"},
+		// Account: block a sender the global scope allows, and allow one
+		// the global scope blocks
+		{AccountID: &account.ID, Action: "block", MatchType: "regex", Value: `^billing@`},
+		{AccountID: &account.ID, Action: "block", MatchType: "domain", Value: "spam.test"},
+		{AccountID: &account.ID, Action: "allow", MatchType: "domain", Value: "ok.spam.test"},
+	}
+	for i := range filters {
+		if err := DB.Create(&filters[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		accountID *uint
+		from      string
+		blockedBy uint // 0 when the sender passes
+	}{
+		{"global block", nil, "x@bad.test", filters[0].ID},
+		{"global allow beats block", nil, "billing@bad.test", 0},
+		{"global, no match", nil, "x@good.test", 0},
+		{"global ignores account filters", nil, "x@spam.test", 0},
+		{"account block", &account.ID, "x@spam.test", filters[3].ID},
+		{"account allow beats block", &account.ID, "x@ok.spam.test", 0},
+		{"account block of a globally allowed sender", &account.ID, "billing@bad.test", filters[2].ID},
+		{"account ignores global filters", &account.ID, "x@bad.test", 0},
+		{"other account", &other.ID, "x@spam.test", 0},
+	}
+	for _, tt := range tests {
+		var got uint
+		if f := checkSender(tt.accountID, tt.from); f != nil {
+			got = f.ID
+		}
+		if got != tt.blockedBy {
+			t.Errorf("%s: blocked by #%d, want #%d", tt.name, got, tt.blockedBy)
+		}
+	}
+}
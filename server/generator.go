@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var generatorAdjectives = []string{
+	"amber", "brave", "calm", "clever", "crisp", "dusty", "eager", "fancy",
+	"gentle", "golden", "happy", "hidden", "icy", "jolly", "keen", "lively",
+	"lucky", "mellow", "misty", "noble", "olive", "proud", "quiet", "rapid",
+	"rusty", "shy", "silent", "silver", "sunny", "swift", "tidy", "witty",
+}
+
+var generatorNouns = []string{
+	"badger", "breeze", "canyon", "cedar", "comet", "coral", "falcon", "fern",
+	"forest", "harbor", "heron", "island", "lantern", "maple", "meadow", "otter",
+	"panda", "pebble", "pine", "planet", "raven", "river", "robin", "sparrow",
+	"stone", "thunder", "tiger", "tulip", "valley", "walrus", "willow", "zebra",
+}
+
+var localPartPrefixRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// GenerateRequest describes the alias to generate
+type GenerateRequest struct {
+	DomainID    uint       `json:"domain_id" binding:"required"`
+	Scheme      string     `json:"scheme"` // "words" (default), "hex", "uuid", "prefix_date"
+	Prefix      string     `json:"prefix"` // Required for prefix_date, optional for the others
+	Length      int        `json:"length"` // Number of hex characters for the hex scheme
+	ForwardTo   string     `json:"forward_to" binding:"required"`
+	Description string     `json:"description"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	MaxMessages int64      `json:"max_messages"`
+}
+
+// generateLocalPart builds a candidate local part for the given scheme
+func generateLocalPart(req *GenerateRequest, now time.Time) (string, error) {
+	prefix := strings.ToLower(strings.TrimSpace(req.Prefix))
+	if prefix != "" && !localPartPrefixRe.MatchString(prefix) {
+		return "", errors.New("prefix may only contain a-z, 0-9, '.', '_' and '-'")
+	}
+
+	var local string
+	switch req.Scheme {
+	case "", "words":
+		local = fmt.Sprintf("%s.%s%s", randomChoice(generatorAdjectives), randomChoice(generatorNouns), randomDigits(2))
+	case "hex":
+		length := req.Length
+		if length <= 0 {
+			length = 10
+		}
+		if length > 32 {
+			return "", errors.New("length must not exceed 32")
+		}
+		local = randomHex(length)
+	case "uuid":
+		local = randomUUID()
+	case "prefix_date":
+		if prefix == "" {
+			return "", errors.New("prefix is required for the prefix_date scheme")
+		}
+		return fmt.Sprintf("%s.%s.%s", prefix, now.Format("20060102"), randomHex(4)), nil
+	default:
+		return "", errors.New("scheme must be words, hex, uuid or prefix_date")
+	}
+
+	if prefix != "" {
+		local = prefix + "." + local
+	}
+	return local, nil
+}
+
+// generateAlias creates a new single-address account on the domain. The
+// address is guaranteed not to be routed by any existing account.
+func generateAlias(req *GenerateRequest) (*Account, string, error) {
+	var domain Domain
+	if err := DB.First(&domain, req.DomainID).Error; err != nil {
+		return nil, "", errors.New("domain not found")
+	}
+
+	// The same accounts matchAccount considers for mail to this domain
+	query := DB.Where("owner_id IS NULL")
+	if domain.OwnerID != nil {
+		query = DB.Where("owner_id = ?", *domain.OwnerID)
+	}
+	var accounts []Account
+	query.Find(&accounts)
+
+	now := time.Now()
+	for attempt := 0; attempt < 10; attempt++ {
+		local, err := generateLocalPart(req, now)
+		if err != nil {
+			return nil, "", err
+		}
+		address := local + "@" + strings.ToLower(domain.Name)
+		if aliasTaken(accounts, address) {
+			continue
+		}
+
+		description := req.Description
+		if description == "" {
+			description = "Generated alias"
+		}
+		account := Account{
+			OwnerID:     domain.OwnerID,
+			Pattern:     "^" + regexp.QuoteMeta(address) + "$",
+			ForwardTo:   req.ForwardTo,
+			Description: description,
+			ExpiresAt:   req.ExpiresAt,
+			MaxMessages: req.MaxMessages,
+		}
+		if err := validateAccount(&account); err != nil {
+			return nil, "", err
+		}
+		if err := DB.Create(&account).Error; err != nil {
+			return nil, "", err
+		}
+		return &account, address, nil
+	}
+	return nil, "", errors.New("could not generate a unique address, try another scheme")
+}
+
+// aliasTaken reports whether an existing account, exact alias or
+// wildcard, already routes the address
+func aliasTaken(accounts []Account, address string) bool {
+	for _, acc := range accounts {
+		re, err := regexp.Compile(acc.Pattern)
+		if err == nil && re.MatchString(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLiteralPattern reports whether the pattern only matches one fixed address
+func isLiteralPattern(pattern string) bool {
+	if !strings.HasPrefix(pattern, "^") || !strings.HasSuffix(pattern, "$") {
+		return false
+	}
+	re, err := regexp.Compile(strings.TrimSuffix(strings.TrimPrefix(pattern, "^"), "$"))
+	if err != nil {
+		return false
+	}
+	_, complete := re.LiteralPrefix()
+	return complete
+}
+
+func randomChoice(words []string) string {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+	if err != nil {
+		return words[0]
+	}
+	return words[n.Int64()]
+}
+
+func randomDigits(n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			sb.WriteByte('0')
+			continue
+		}
+		sb.WriteByte(byte('0' + d.Int64()))
+	}
+	return sb.String()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, (n+1)/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)[:n]
+}
+
+func randomUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestAliasTaken(t *testing.T) {
+	accounts := []Account{
+		{Pattern: `^exact\.one@example\.com$`},
+		{Pattern: `^shop\..*@example\.com$`},
+		{Pattern: `[`}, // Invalid patterns never match
+	}
+	tests := []struct {
+		address string
+		taken   bool
+	}{
+		{"exact.one@example.com", true},
+		{"shop.amber42@example.com", true},
+		{"calm.otter17@example.com", false},
+		{"exact.one@example.org", false},
+	}
+	for _, tt := range tests {
+		if got := aliasTaken(accounts, tt.address); got != tt.taken {
+			t.Errorf("aliasTaken(%q) = %v, want %v", tt.address, got, tt.taken)
+		}
+	}
+}
+
+func TestGenerateLocalPart(t *testing.T) {
+	now := time.Date(2024, 5, 17, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		req   GenerateRequest
+		match string
+		err   bool
+	}{
+		{GenerateRequest{}, `^[a-z]+\.[a-z]+[0-9]{2}$`, false},
+		{GenerateRequest{Scheme: "hex", Length: 12}, `^[0-9a-f]{12}$`, false},
+		{GenerateRequest{Scheme: "hex", Length: 33}, ``, true},
+		{GenerateRequest{Scheme: "uuid"}, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, false},
+		{GenerateRequest{Scheme: "prefix_date", Prefix: "Shop"}, `^shop\.20240517\.[0-9a-f]{4}$`, false},
+		{GenerateRequest{Scheme: "prefix_date"}, ``, true},
+		{GenerateRequest{Scheme: "words", Prefix: "bad prefix"}, ``, true},
+		{GenerateRequest{Scheme: "emoji"}, ``, true},
+	}
+	for _, tt := range tests {
+		local, err := generateLocalPart(&tt.req, now)
+		if tt.err {
+			if err == nil {
+				t.Errorf("generateLocalPart(%+v) = %q, want an error", tt.req, local)
+			}
+			continue
+		}
+		if err != nil || !regexp.MustCompile(tt.match).MatchString(local) {
+			t.Errorf("generateLocalPart(%+v) = %q, %v, want a match for %s", tt.req, local, err, tt.match)
+		}
+	}
+}
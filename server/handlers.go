@@ -1,17 +1,24 @@
 package main
 
 import (
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+	"gorm.io/gorm"
 )
 
 // -- Domains --
 
 func GetDomains(c *gin.Context) {
 	var domains []Domain
-	if err := DB.Find(&domains).Error; err != nil {
+	if err := DB.Scopes(ownedBy(c, "owner_id")).Find(&domains).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -24,20 +31,60 @@ func CreateDomain(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := validateOwner(domain.OwnerID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err := DB.Create(&domain).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(c, AuditDomainCreate, "domain", domain.ID, nil, &domain)
+	c.JSON(http.StatusOK, domain)
+}
+
+type DomainOwnerRequest struct {
+	OwnerID *uint `json:"owner_id"`
+}
+
+// SetDomainOwner hands a domain and the accounts anchored to it to another
+// owner, null returns it to the staff
+func SetDomainOwner(c *gin.Context) {
+	var domain Domain
+	if err := DB.First(&domain, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+		return
+	}
+	var req DomainOwnerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateOwner(req.OwnerID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before := domain
+	if err := transferDomain(&domain, req.OwnerID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditDomainOwner, "domain", domain.ID, &before, &domain)
 	c.JSON(http.StatusOK, domain)
 }
 
 func DeleteDomain(c *gin.Context) {
-	id := c.Param("id")
+	var domain Domain
+	if err := DB.First(&domain, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+		return
+	}
 	// Use Unscoped() for hard delete to avoid UNIQUE constraint issues
-	if err := DB.Unscoped().Delete(&Domain{}, id).Error; err != nil {
+	if err := DB.Unscoped().Delete(&Domain{}, domain.ID).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(c, AuditDomainDelete, "domain", domain.ID, &domain, nil)
 	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
 }
 
@@ -45,10 +92,23 @@ func DeleteDomain(c *gin.Context) {
 
 func GetAccounts(c *gin.Context) {
 	var accounts []Account
-	if err := DB.Find(&accounts).Error; err != nil {
+	if err := DB.Scopes(ownedBy(c, "owner_id")).Find(&accounts).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
+	if tag := strings.TrimSpace(c.Query("tag")); tag != "" {
+		filtered := make([]Account, 0, len(accounts))
+		for _, acc := range accounts {
+			for _, t := range strings.Split(acc.Tags, ",") {
+				if strings.EqualFold(strings.TrimSpace(t), tag) {
+					filtered = append(filtered, acc)
+					break
+				}
+			}
+		}
+		accounts = filtered
+	}
 	c.JSON(http.StatusOK, accounts)
 }
 
@@ -58,40 +118,193 @@ func CreateAccount(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// The owner decides which webhook targets are allowed
+	if err := assignAccountOwner(c, &account); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateAccount(&account); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Mailbox credentials are set through their own endpoint
+	account.MailboxUser = ""
+	account.Disposable = false
 	if err := DB.Create(&account).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(c, AuditAccountCreate, "account", account.ID, nil, &account)
 	c.JSON(http.StatusOK, account)
 }
 
+func GenerateAccount(c *gin.Context) {
+	var req GenerateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := findDomain(c, req.DomainID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, address, err := generateAlias(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditAccountCreate, "account", account.ID, nil, account)
+	c.JSON(http.StatusOK, gin.H{
+		"address": address,
+		"account": account,
+	})
+}
+
 func UpdateAccount(c *gin.Context) {
-	id := c.Param("id")
-	var account Account
-	if err := DB.First(&account, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+	account, ok := findAccount(c, c.Param("id"))
+	if !ok {
 		return
 	}
+	before := *account
 
-	if err := c.ShouldBindJSON(&account); err != nil {
+	if err := c.ShouldBindJSON(account); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// The body may carry an id, the update always targets the checked row
+	account.ID = before.ID
+	if err := assignAccountOwner(c, account); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateAccount(account); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := DB.Save(&account).Error; err != nil {
+	// The mailbox, disposable inbox and usage fields are managed by
+	// deliveries and their own endpoints, never overwrite them with the
+	// bound copy
+	if err := DB.Omit("mailbox_user", "mailbox_password_hash", "next_uid", "disposable", "inbox_token_hash",
+		"hit_count", "first_sender_domain", "leak_domains").Save(account).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	DB.First(account, account.ID)
+	recordAudit(c, AuditAccountUpdate, "account", account.ID, &before, account)
+	c.JSON(http.StatusOK, account)
+}
+
+type MailboxCredentialsRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// SetMailboxCredentials sets the IMAP/POP3 login of an account
+func SetMailboxCredentials(c *gin.Context) {
+	account, ok := findAccount(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	var req MailboxCredentialsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before := *account
+	if err := setMailboxCredentials(account, req.Username, req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditAccountMailbox, "account", account.ID, &before, account)
 	c.JSON(http.StatusOK, account)
 }
 
+// PreviewRequest renders the account templates against a stored log. The
+// optional template fields override the saved ones to preview unsaved edits.
+type PreviewRequest struct {
+	LogID           uint    `json:"log_id" binding:"required"`
+	SubjectTemplate *string `json:"subject_template"`
+	BannerTemplate  *string `json:"banner_template"`
+	AddHeaders      *string `json:"add_headers"`
+	RemoveHeaders   *string `json:"remove_headers"`
+}
+
+func PreviewAccountTemplate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		account, ok := findAccount(c, c.Param("id"))
+		if !ok {
+			return
+		}
+
+		var req PreviewRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var logEntry Log
+		if err := DB.Scopes(ownedBy(c, "owner_id")).First(&logEntry, req.LogID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Log not found"})
+			return
+		}
+
+		if req.SubjectTemplate != nil {
+			account.SubjectTemplate = *req.SubjectTemplate
+		}
+		if req.BannerTemplate != nil {
+			account.BannerTemplate = *req.BannerTemplate
+		}
+		if req.AddHeaders != nil {
+			account.AddHeaders = *req.AddHeaders
+		}
+		if req.RemoveHeaders != nil {
+			account.RemoveHeaders = *req.RemoveHeaders
+		}
+
+		msg := InboundMessage{
+			From:     logEntry.From,
+			To:       logEntry.To,
+			Subject:  logEntry.Subject,
+			Body:     logEntry.Content,
+			Received: logEntry.CreatedAt,
+		}
+		rendered, err := renderForward(*account, msg)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		target := strings.TrimSpace(strings.Split(account.ForwardTo, ",")[0])
+		fullMsg, err := buildForwardMessage(envelopeSender(currentConfig()), target, *account, msg)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"subject": rendered.Subject,
+			"banner":  rendered.Banner,
+			"headers": rendered.Headers,
+			"message": string(fullMsg),
+		})
+	}
+}
+
 func DeleteAccount(c *gin.Context) {
-	id := c.Param("id")
+	account, ok := findAccount(c, c.Param("id"))
+	if !ok {
+		return
+	}
 	// Use Unscoped() for hard delete to avoid UNIQUE constraint issues
-	if err := DB.Unscoped().Delete(&Account{}, id).Error; err != nil {
+	if err := DB.Unscoped().Delete(&Account{}, account.ID).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	DB.Where("account_id = ?", account.ID).Delete(&Message{})
+	recordAudit(c, AuditAccountDelete, "account", account.ID, account, nil)
 	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
 }
 
@@ -105,8 +318,8 @@ func GetLogs(c *gin.Context) {
 	var logs []Log
 	var total int64
 
-	DB.Model(&Log{}).Count(&total)
-	if err := DB.Order("created_at desc").Limit(pageSize).Offset(offset).Find(&logs).Error; err != nil {
+	DB.Model(&Log{}).Scopes(ownedBy(c, "owner_id")).Count(&total)
+	if err := DB.Scopes(ownedBy(c, "owner_id")).Order("created_at desc").Limit(pageSize).Offset(offset).Find(&logs).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -117,3 +330,1217 @@ func GetLogs(c *gin.Context) {
 		"page":  page,
 	})
 }
+
+func GetLog(c *gin.Context) {
+	id := c.Param("id")
+	var logEntry Log
+	if err := DB.Scopes(ownedBy(c, "owner_id")).First(&logEntry, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Log not found"})
+		return
+	}
+	c.JSON(http.StatusOK, logEntry)
+}
+
+// GetLatestCode returns the most recent verification code received by an alias
+func GetLatestCode(c *gin.Context) {
+	alias := strings.ToLower(strings.TrimSpace(c.Query("alias")))
+	if alias == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "alias is required"})
+		return
+	}
+
+	query := DB.Scopes(ownedBy(c, "owner_id")).Where("LOWER(\"to\") = ? AND (code <> '' OR link <> '')", alias)
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be an RFC3339 time"})
+			return
+		}
+		query = query.Where("created_at > ?", t)
+	}
+
+	var logEntry Log
+	if err := query.Order("created_at desc").First(&logEntry).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No code received yet"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":       logEntry.Code,
+		"link":       logEntry.Link,
+		"log_id":     logEntry.ID,
+		"from":       logEntry.From,
+		"subject":    logEntry.Subject,
+		"created_at": logEntry.CreatedAt,
+	})
+}
+
+// -- Code Patterns --
+
+func GetCodePatterns(c *gin.Context) {
+	var patterns []CodePattern
+	if err := DB.Order("id asc").Find(&patterns).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, patterns)
+}
+
+func CreateCodePattern(c *gin.Context) {
+	var pattern CodePattern
+	if err := c.ShouldBindJSON(&pattern); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateCodePattern(&pattern); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Create(&pattern).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, pattern)
+}
+
+func DeleteCodePattern(c *gin.Context) {
+	id := c.Param("id")
+	if err := DB.Delete(&CodePattern{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+// -- Quarantine --
+
+func GetQuarantine(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+	offset := (page - 1) * pageSize
+
+	var items []Quarantine
+	var total int64
+
+	DB.Model(&Quarantine{}).Scopes(ownedAccounts(c, "account_id")).Count(&total)
+	if err := DB.Scopes(ownedAccounts(c, "account_id")).Omit("raw").Order("created_at desc").Limit(pageSize).Offset(offset).Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  items,
+		"total": total,
+		"page":  page,
+	})
+}
+
+func GetQuarantineItem(c *gin.Context) {
+	id := c.Param("id")
+	var q Quarantine
+	if err := DB.Scopes(ownedAccounts(c, "account_id")).First(&q, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quarantined message not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"item":    q,
+		"content": extractTextBody(q.Raw),
+	})
+}
+
+func ReleaseQuarantine() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		var q Quarantine
+		if err := DB.Scopes(ownedAccounts(c, "account_id")).First(&q, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Quarantined message not found"})
+			return
+		}
+
+		status, errMsg, err := releaseQuarantine(currentConfig(), &q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if status == "failed" {
+			c.JSON(http.StatusBadGateway, gin.H{"status": status, "error": errMsg})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": status, "error": errMsg})
+	}
+}
+
+func DeleteQuarantine(c *gin.Context) {
+	id := c.Param("id")
+	if err := DB.Scopes(ownedAccounts(c, "account_id")).Delete(&Quarantine{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+// -- Sender Filters --
+
+func GetSenderFilters(c *gin.Context) {
+	var filters []SenderFilter
+	query := DB.Scopes(ownedAccounts(c, "account_id")).Order("id asc")
+	if accountID := c.Query("account_id"); accountID != "" {
+		if accountID == "global" {
+			query = query.Where("account_id IS NULL")
+		} else {
+			query = query.Where("account_id = ?", accountID)
+		}
+	}
+	if err := query.Find(&filters).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, filters)
+}
+
+func CreateSenderFilter(c *gin.Context) {
+	var filter SenderFilter
+	loadedID := filter.ID
+	if err := c.ShouldBindJSON(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// The body may carry an id, the update always targets the checked row
+	filter.ID = loadedID
+	if err := validateSenderFilter(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !canManageFilter(c, &filter) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Filters must belong to one of your accounts"})
+		return
+	}
+	if err := DB.Create(&filter).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, filter)
+}
+
+func UpdateSenderFilter(c *gin.Context) {
+	id := c.Param("id")
+	var filter SenderFilter
+	if err := DB.Scopes(ownedAccounts(c, "account_id")).First(&filter, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Filter not found"})
+		return
+	}
+
+	loadedID := filter.ID
+	if err := c.ShouldBindJSON(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// The body may carry an id, the update always targets the checked row
+	filter.ID = loadedID
+	if err := validateSenderFilter(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !canManageFilter(c, &filter) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Filters must belong to one of your accounts"})
+		return
+	}
+
+	if err := DB.Omit("hit_count").Save(&filter).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	DB.First(&filter, filter.ID)
+	c.JSON(http.StatusOK, filter)
+}
+
+func DeleteSenderFilter(c *gin.Context) {
+	id := c.Param("id")
+	if err := DB.Scopes(ownedAccounts(c, "account_id")).Delete(&SenderFilter{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+// -- Mailbox --
+
+// findMessage loads a stored message (without raw content) and its account
+func findMessage(c *gin.Context) (*Message, *Account, bool) {
+	var m Message
+	if err := DB.Omit("raw").First(&m, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return nil, nil, false
+	}
+	var account Account
+	if err := DB.Scopes(ownedBy(c, "owner_id")).First(&account, m.AccountID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return nil, nil, false
+	}
+	return &m, &account, true
+}
+
+func GetAccountMessages(c *gin.Context) {
+	account, ok := findAccount(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+	offset := (page - 1) * pageSize
+
+	unseen := "(' ' || flags || ' ') NOT LIKE ?"
+	query := DB.Model(&Message{}).Where("account_id = ? AND mailbox = ?", account.ID, defaultMailbox)
+	var total, unread int64
+	query.Session(&gorm.Session{}).Count(&total)
+	query.Session(&gorm.Session{}).Where(unseen, "% "+seenFlag+" %").Count(&unread)
+	if c.Query("unread") == "true" {
+		query = query.Where(unseen, "% "+seenFlag+" %")
+	}
+
+	var messages []Message
+	if err := query.Omit("raw").Order("uid desc").Limit(pageSize).Offset(offset).Find(&messages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range messages {
+		messages[i].Unread = !messages[i].HasFlag(seenFlag)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":   messages,
+		"total":  total,
+		"unread": unread,
+		"page":   page,
+	})
+}
+
+// GetMessage returns a stored message parsed into headers, bodies and
+// attachment metadata. The html body is sanitized, remote images are only
+// kept with ?remote_images=true.
+func GetMessage(c *gin.Context) {
+	m, _, ok := findMessage(c)
+	if !ok {
+		return
+	}
+	raw, err := loadRaw(m.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	parsed, err := parseMessage(raw)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to parse message: " + err.Error()})
+		return
+	}
+	parsed.HTML = sanitizeHTML(parsed.HTML, c.Query("remote_images") == "true")
+
+	m.Unread = !m.HasFlag(seenFlag)
+	c.JSON(http.StatusOK, gin.H{
+		"message": m,
+		"parsed":  parsed,
+	})
+}
+
+func GetMessageAttachment(c *gin.Context) {
+	m, _, ok := findMessage(c)
+	if !ok {
+		return
+	}
+	raw, err := loadRaw(m.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	parsed, err := parseMessage(raw)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to parse message: " + err.Error()})
+		return
+	}
+
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil || index < 0 || index >= len(parsed.Attachments) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+	att := parsed.Attachments[index]
+	filename := att.Filename
+	if filename == "" {
+		filename = "attachment-" + strconv.Itoa(index)
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, "application/octet-stream", att.data)
+}
+
+type MarkReadRequest struct {
+	Read *bool `json:"read"`
+}
+
+// MarkMessageRead sets or clears the \Seen flag, {"read": false} marks unread
+func MarkMessageRead(c *gin.Context) {
+	m, _, ok := findMessage(c)
+	if !ok {
+		return
+	}
+	var req MarkReadRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	read := req.Read == nil || *req.Read
+
+	var flags []string
+	for _, f := range m.FlagList() {
+		if !strings.EqualFold(f, seenFlag) {
+			flags = append(flags, f)
+		}
+	}
+	if read {
+		flags = append(flags, seenFlag)
+	}
+	if err := setFlags(m, flags); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	m.Unread = !read
+	c.JSON(http.StatusOK, m)
+}
+
+func DeleteMessage(c *gin.Context) {
+	m, account, ok := findMessage(c)
+	if !ok {
+		return
+	}
+	if err := deleteMessages(account, []uint{m.ID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+func QuarantineStoredMessage(c *gin.Context) {
+	m, account, ok := findMessage(c)
+	if !ok {
+		return
+	}
+	q, err := quarantineStored(account, m)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, q)
+}
+
+// -- Disposable Inboxes --
+
+func CreateDisposableInbox() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := currentConfig()
+		var req DisposableRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if _, err := findDomain(c, req.DomainID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		account, address, token, err := createDisposable(cfg, &req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		recordAudit(c, AuditAccountCreate, "account", account.ID, nil, account)
+		// The token is only shown once, it is stored hashed
+		c.JSON(http.StatusOK, gin.H{
+			"address":   address,
+			"account":   account,
+			"token":     token,
+			"inbox_url": strings.TrimRight(cfg.PublicURL, "/") + "/api/public/inbox/" + token,
+		})
+	}
+}
+
+// GetPublicInbox returns the messages of a disposable inbox without
+// authentication, the token in the url is the only credential
+func GetPublicInbox(c *gin.Context) {
+	account, err := findDisposable(c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Inbox not found"})
+		return
+	}
+
+	var since *time.Time
+	if s := c.Query("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be an RFC3339 timestamp"})
+			return
+		}
+		since = &t
+	}
+
+	messages, err := publicMessages(account, since, 50)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.JSON(http.StatusOK, gin.H{
+		"address":    literalAddress(account.Pattern),
+		"expires_at": account.ExpiresAt,
+		"messages":   messages,
+	})
+}
+
+// -- Events --
+
+// subscribeEvents registers a subscriber for the ?account_id= filter of the request
+func subscribeEvents(c *gin.Context) (*eventSubscriber, bool) {
+	filter, err := parseEventFilter(c.Query("account_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "account_id must be a comma separated list of ids"})
+		return nil, false
+	}
+	filter.OwnerID = tenantID(c)
+	return events.Subscribe(filter), true
+}
+
+// StreamEvents pushes log events as Server-Sent Events
+func StreamEvents(c *gin.Context) {
+	sub, ok := subscribeEvents(c)
+	if !ok {
+		return
+	}
+	defer events.Unsubscribe(sub)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e := <-sub.ch:
+			c.Render(-1, sse.Event{Id: strconv.FormatUint(e.ID, 10), Event: e.Type, Data: e})
+			return true
+		case <-heartbeat.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// WebSocketEvents pushes log events as JSON WebSocket messages
+func WebSocketEvents(c *gin.Context) {
+	sub, ok := subscribeEvents(c)
+	if !ok {
+		return
+	}
+	defer events.Unsubscribe(sub)
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		closed := make(chan struct{})
+		go func() {
+			// Clients do not send anything, reading only detects the close
+			var discard string
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+			close(closed)
+		}()
+
+		for {
+			select {
+			case e := <-sub.ch:
+				if websocket.JSON.Send(ws, e) != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}).ServeHTTP(c.Writer, c.Request)
+}
+
+// PollEvents waits up to ?timeout= (default 30s, max 120s) for the next
+// event and answers 204 when none arrived
+func PollEvents(c *gin.Context) {
+	timeout := 30 * time.Second
+	if s := c.Query("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || d > 2*time.Minute {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "timeout must be a duration up to 2m"})
+			return
+		}
+		timeout = d
+	}
+
+	sub, ok := subscribeEvents(c)
+	if !ok {
+		return
+	}
+	defer events.Unsubscribe(sub)
+
+	select {
+	case e := <-sub.ch:
+		c.JSON(http.StatusOK, e)
+	case <-time.After(timeout):
+		c.Status(http.StatusNoContent)
+	case <-c.Request.Context().Done():
+	}
+}
+
+// -- Users --
+
+type UserRequest struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	Role         string `json:"role"`
+	Enabled      *bool  `json:"enabled"`
+	TOTPRequired *bool  `json:"totp_required"`
+}
+
+func GetUsers(c *gin.Context) {
+	var users []User
+	DB.Order("username asc").Find(&users)
+	c.JSON(http.StatusOK, users)
+}
+
+func CreateUser(c *gin.Context) {
+	var req UserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user := User{Username: req.Username, Role: req.Role, Enabled: req.Enabled}
+	if req.TOTPRequired != nil {
+		user.TOTPRequired = *req.TOTPRequired
+	}
+	if err := validateUser(&user); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := user.SetPassword(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var count int64
+	DB.Model(&User{}).Where("username = ?", user.Username).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+		return
+	}
+	if err := DB.Create(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditUserCreate, "user", user.ID, nil, &user)
+	c.JSON(http.StatusOK, user)
+}
+
+// UpdateUser changes the role, enabled state or password of a user. The
+// username cannot be changed.
+func UpdateUser(c *gin.Context) {
+	var user User
+	if err := DB.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	var req UserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updated := user
+	if req.Role != "" {
+		updated.Role = req.Role
+	}
+	if req.Enabled != nil {
+		updated.Enabled = req.Enabled
+	}
+	if req.TOTPRequired != nil {
+		updated.TOTPRequired = *req.TOTPRequired
+	}
+	if err := validateUser(&updated); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (updated.Role != RoleAdmin || !updated.IsEnabled()) && isLastAdmin(&user) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot demote or disable the last admin"})
+		return
+	}
+	if req.Password != "" {
+		if err := updated.SetPassword(req.Password); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&updated).Error; err != nil {
+			return err
+		}
+		// A new password or disabling the user ends all of their sessions
+		if req.Password != "" || !updated.IsEnabled() {
+			return revokeUserSessions(tx, user.ID, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditUserUpdate, "user", user.ID, &user, &updated)
+	c.JSON(http.StatusOK, updated)
+}
+
+func DeleteUser(c *gin.Context) {
+	var user User
+	if err := DB.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.ID == currentUser(c).ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot delete yourself"})
+		return
+	}
+	if isLastAdmin(&user) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot delete the last admin"})
+		return
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := releaseOwnership(tx, user.ID); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&APIToken{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&LoginSession{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditUserDelete, "user", user.ID, &user, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+func GetMe(c *gin.Context) {
+	c.JSON(http.StatusOK, currentUser(c))
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// ChangeOwnPassword lets every user, including read-only ones, change
+// their password. Their other sessions are signed out.
+func ChangeOwnPassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := currentUser(c)
+	if _, err := authenticateUser(user.Username, req.CurrentPassword); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is wrong"})
+		return
+	}
+	if err := user.SetPassword(req.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var keep uint
+	if session := currentSession(c); session != nil {
+		keep = session.ID
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("password_hash", user.PasswordHash).Error; err != nil {
+			return err
+		}
+		return revokeUserSessions(tx, user.ID, keep)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "password changed"})
+}
+
+// -- Sessions --
+
+// GetSessions lists the active login sessions of the current user
+func GetSessions(c *gin.Context) {
+	user := currentUser(c)
+	var sessions []LoginSession
+	err := DB.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", user.ID, time.Now()).
+		Order("last_used_at desc").Find(&sessions).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var currentID uint
+	if session := currentSession(c); session != nil {
+		currentID = session.ID
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions, "current": currentID})
+}
+
+func RevokeOwnSession(c *gin.Context) {
+	var session LoginSession
+	if err := DB.Where("id = ? AND user_id = ?", c.Param("id"), currentUser(c).ID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if err := revokeSession(&session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "revoked"})
+}
+
+// RevokeAllSessions signs the current user out everywhere, including this
+// session unless ?keep_current=true
+func RevokeAllSessions(c *gin.Context) {
+	var keep uint
+	if session := currentSession(c); session != nil && c.Query("keep_current") == "true" {
+		keep = session.ID
+	}
+	if err := revokeUserSessions(DB, currentUser(c).ID, keep); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "signed out"})
+}
+
+// RevokeUserSessions lets admins sign another user out everywhere
+func RevokeUserSessions(c *gin.Context) {
+	var user User
+	if err := DB.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err := revokeUserSessions(DB, user.ID, 0); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "signed out"})
+}
+
+// -- API Tokens --
+
+type APITokenRequest struct {
+	Name      string   `json:"name" binding:"required"`
+	Scopes    []string `json:"scopes" binding:"required"`
+	ExpiresIn string   `json:"expires_in"` // Go duration such as "720h", empty never expires
+}
+
+// GetAPITokens lists the tokens of the current user, admins may pass
+// ?all=true to see everyone's
+func GetAPITokens(c *gin.Context) {
+	user := currentUser(c)
+	query := DB.Order("id asc")
+	if !(c.Query("all") == "true" && user.Role == RoleAdmin) {
+		query = query.Where("user_id = ?", user.ID)
+	}
+	var tokens []APIToken
+	if err := query.Find(&tokens).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+func CreateAPIToken(c *gin.Context) {
+	var req APITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var ttl time.Duration
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must be a positive duration such as 720h"})
+			return
+		}
+		ttl = d
+	}
+
+	t, plain, err := createAPIToken(currentUser(c), req.Name, req.Scopes, ttl)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// The token is only shown once, it is stored hashed
+	c.JSON(http.StatusOK, gin.H{"token": plain, "api_token": t})
+}
+
+func RevokeAPIToken(c *gin.Context) {
+	user := currentUser(c)
+	query := DB.Where("id = ?", c.Param("id"))
+	if user.Role != RoleAdmin {
+		query = query.Where("user_id = ?", user.ID)
+	}
+	result := query.Delete(&APIToken{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "revoked"})
+}
+
+// -- Two-Factor Authentication --
+
+// StartTOTPEnrollment creates a pending secret, it becomes active once a
+// code is confirmed at /api/me/totp/enable
+func StartTOTPEnrollment(c *gin.Context) {
+	secret, uri, err := startTOTPEnrollment(currentUser(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_uri": uri})
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func EnableTOTP(c *gin.Context) {
+	var req TOTPCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := currentUser(c)
+	if user.TOTPSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start the enrollment first"})
+		return
+	}
+	codes, err := enableTOTP(user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+type DisableTOTPRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code"`
+}
+
+func DisableTOTP(c *gin.Context) {
+	var req DisableTOTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := currentUser(c)
+	if user.TOTPRequired {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for your account"})
+		return
+	}
+	if _, err := authenticateUser(user.Username, req.Password); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is wrong"})
+		return
+	}
+	if user.TOTPEnabled {
+		if err := verifyTOTP(user, req.Code); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := disableTOTP(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+}
+
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var req TOTPCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := currentUser(c)
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if err := verifyTOTP(user, req.Code); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	codes, err := newRecoveryCodes(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// ResetUserTOTP lets an admin remove the second factor of a user who lost
+// their device
+func ResetUserTOTP(c *gin.Context) {
+	var user User
+	if err := DB.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err := disableTOTP(&user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// -- Audit Log --
+
+// GetAuditLog lists audit entries, newest first. Filters: user_id, username,
+// action (a trailing * matches a prefix such as "account.*"), target,
+// target_id, ip, since and until (RFC 3339).
+func GetAuditLog(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "50"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 500 {
+		pageSize = 50
+	}
+
+	query := DB.Model(&AuditEntry{})
+	for param, column := range map[string]string{
+		"user_id": "user_id", "username": "username", "target": "target", "target_id": "target_id", "ip": "ip",
+	} {
+		if v := c.Query(param); v != "" {
+			query = query.Where(column+" = ?", v)
+		}
+	}
+	if action := c.Query("action"); strings.HasSuffix(action, "*") {
+		query = query.Where("action LIKE ?", strings.TrimSuffix(action, "*")+"%")
+	} else if action != "" {
+		query = query.Where("action = ?", action)
+	}
+	for param, op := range map[string]string{"since": ">=", "until": "<"} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC 3339 time"})
+				return
+			}
+			query = query.Where("created_at "+op+" ?", t.In(time.Local))
+		}
+	}
+
+	var total int64
+	var entries []AuditEntry
+	query.Session(&gorm.Session{}).Count(&total)
+	if err := query.Session(&gorm.Session{}).Order("id desc").Limit(pageSize).Offset((page - 1) * pageSize).Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":  entries,
+		"total": total,
+		"page":  page,
+	})
+}
+
+// -- Settings --
+
+// settingsResponse lists the runtime settings with their effective values
+func settingsResponse() ([]gin.H, error) {
+	var rows []Setting
+	if err := DB.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	stored := make(map[string]Setting, len(rows))
+	for _, row := range rows {
+		stored[row.Key] = row
+	}
+
+	view := settingsView(currentConfig())
+	list := make([]gin.H, 0, len(runtimeSettings))
+	for _, s := range runtimeSettings {
+		item := gin.H{"key": s.Key, "secret": s.Secret}
+		if s.Secret {
+			item["set"] = view[s.Key]
+		} else {
+			item["value"] = view[s.Key]
+		}
+		row, overridden := stored[s.Key]
+		item["overridden"] = overridden
+		if overridden {
+			item["updated_by"] = row.UpdatedBy
+			item["updated_at"] = row.UpdatedAt
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+func GetSettings(c *gin.Context) {
+	list, err := settingsResponse()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"settings": list})
+}
+
+// UpdateSettings stores overrides for the given keys, null removes an
+// override so the value from CONFIG_FILE or the environment applies again
+func UpdateSettings(c *gin.Context) {
+	var input map[string]*string
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cfg := currentConfig()
+	for key, value := range input {
+		if _, ok := findRuntimeSetting(key); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown setting " + key})
+			return
+		}
+		if value != nil {
+			if err := validateSetting(key, *value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
+
+	updatedBy := ""
+	if user := currentUser(c); user != nil {
+		updatedBy = user.Username
+	}
+	before, after := settingsView(cfg), map[string]interface{}{}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		for key, value := range input {
+			s, _ := findRuntimeSetting(key)
+			if value == nil {
+				if err := tx.Delete(&Setting{}, "key = ?", key).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			stored := *value
+			if s.Secret {
+				var err error
+				if stored, err = sealSetting(cfg, key, *value); err != nil {
+					return err
+				}
+			}
+			row := Setting{Key: key, Value: stored, UpdatedBy: updatedBy}
+			if err := tx.Save(&row).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	refreshSettings()
+
+	// Secrets never reach the audit log, only the fact that they were written
+	for k, v := range settingsView(currentConfig()) {
+		after[k] = v
+	}
+	for key, value := range input {
+		if s, _ := findRuntimeSetting(key); s.Secret {
+			before[key] = "(hidden)"
+			after[key] = "(updated)"
+			if value == nil {
+				after[key] = "(removed)"
+			}
+		}
+	}
+	recordAudit(c, AuditSettingsUpdate, "settings", 0, before, after)
+
+	list, err := settingsResponse()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"settings": list})
+}
+
+// TestRelay connects to the relay and runs EHLO, STARTTLS and AUTH without
+// sending anything. The body may hold unsaved relay settings to try. The
+// stored password is only reused for the saved host, port and user, so it
+// can never be sent to another server.
+func TestRelay(c *gin.Context) {
+	var input struct {
+		Host *string `json:"smtp_relay_host"`
+		Port *string `json:"smtp_relay_port"`
+		User *string `json:"smtp_relay_user"`
+		Pass *string `json:"smtp_relay_pass"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	saved := currentConfig()
+	cfg := *saved
+	for field, value := range map[*string]*string{&cfg.SMTPRelayHost: input.Host, &cfg.SMTPRelayPort: input.Port, &cfg.SMTPRelayUser: input.User, &cfg.SMTPRelayPass: input.Pass} {
+		if value != nil {
+			*field = *value
+		}
+	}
+	sameRelay := cfg.SMTPRelayHost == saved.SMTPRelayHost && cfg.SMTPRelayPort == saved.SMTPRelayPort && cfg.SMTPRelayUser == saved.SMTPRelayUser
+	if input.Pass == nil && !sameRelay {
+		if cfg.SMTPRelayUser != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "smtp_relay_pass is required when testing another host, port or user"})
+			return
+		}
+		cfg.SMTPRelayPass = ""
+	}
+	if cfg.SMTPRelayHost == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No relay host configured"})
+		return
+	}
+	if err := validateSetting("smtp_relay_port", cfg.SMTPRelayPort); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	client, err := dialRelay(&cfg)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	_, tlsActive := client.TLSConnectionState()
+	client.Quit()
+	c.JSON(http.StatusOK, gin.H{
+		"ok":   true,
+		"tls":  tlsActive,
+		"auth": cfg.SMTPRelayUser != "" && cfg.SMTPRelayPass != "",
+	})
+}
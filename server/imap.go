@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+var errMailboxNotSupported = errors.New("Only INBOX is available")
+
+// imapBackend is nil unless the IMAP server runs. It is set by main before
+// any server starts and never changes afterwards.
+var imapBackend *IMAPBackend
+
+// IMAPBackend serves the local mailboxes of accounts over IMAP
+type IMAPBackend struct {
+	updates chan backend.Update
+}
+
+// NewIMAPBackend returns nil when IMAP is disabled
+func NewIMAPBackend(cfg *Config) *IMAPBackend {
+	if cfg.IMAPPort == "" {
+		return nil
+	}
+	return &IMAPBackend{updates: make(chan backend.Update, 64)}
+}
+
+func (b *IMAPBackend) Login(conn *imap.ConnInfo, username, password string) (backend.User, error) {
+	account, err := authenticateMailbox(username, password, remoteIP(conn.RemoteAddr))
+	if err == errMailboxLoginLocked {
+		return nil, err
+	}
+	if err != nil {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return &IMAPUser{account: account}, nil
+}
+
+func (b *IMAPBackend) Updates() <-chan backend.Update {
+	return b.updates
+}
+
+// IMAPUser is an account logged in over IMAP
+type IMAPUser struct {
+	account *Account
+}
+
+func (u *IMAPUser) Username() string {
+	return u.account.MailboxUser
+}
+
+func (u *IMAPUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	return []backend.Mailbox{&IMAPMailbox{user: u}}, nil
+}
+
+func (u *IMAPUser) GetMailbox(name string) (backend.Mailbox, error) {
+	if !strings.EqualFold(name, defaultMailbox) {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return &IMAPMailbox{user: u}, nil
+}
+
+func (u *IMAPUser) CreateMailbox(name string) error {
+	return errMailboxNotSupported
+}
+
+func (u *IMAPUser) DeleteMailbox(name string) error {
+	return errMailboxNotSupported
+}
+
+func (u *IMAPUser) RenameMailbox(existingName, newName string) error {
+	return errMailboxNotSupported
+}
+
+func (u *IMAPUser) Logout() error {
+	return nil
+}
+
+// IMAPMailbox is the INBOX of an account. Messages are read from the
+// database on every command, sequence numbers follow UID order.
+type IMAPMailbox struct {
+	user *IMAPUser
+}
+
+func (mbox *IMAPMailbox) Name() string {
+	return defaultMailbox
+}
+
+func (mbox *IMAPMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: "/", Name: defaultMailbox}, nil
+}
+
+func (mbox *IMAPMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	return mailboxStatus(mbox.user.account.ID, items)
+}
+
+// mailboxStatus computes the IMAP status of an account's INBOX
+func mailboxStatus(accountID uint, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	var account Account
+	if err := DB.Select("id", "next_uid", "created_at").First(&account, accountID).Error; err != nil {
+		return nil, err
+	}
+	messages, err := mailboxMessages(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := imap.NewMailboxStatus(defaultMailbox, items)
+	status.Flags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+	status.PermanentFlags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag, "\\*"}
+
+	var unseen uint32
+	for i := range messages {
+		if !messages[i].HasFlag(seenFlag) {
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(messages))
+		case imap.StatusUidNext:
+			status.UidNext = account.NextUID
+		case imap.StatusUidValidity:
+			status.UidValidity = uint32(account.CreatedAt.Unix())
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+	return status, nil
+}
+
+func (mbox *IMAPMailbox) SetSubscribed(subscribed bool) error {
+	return nil
+}
+
+func (mbox *IMAPMailbox) Check() error {
+	return nil
+}
+
+// selected returns the messages addressed by the sequence set along with
+// their sequence numbers
+func (mbox *IMAPMailbox) selected(uid bool, seqSet *imap.SeqSet) ([]Message, []uint32, error) {
+	messages, err := mailboxMessages(mbox.user.account.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var picked []Message
+	var seqNums []uint32
+	for i, m := range messages {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = m.UID
+		}
+		if seqSet == nil || seqSet.Contains(id) {
+			picked = append(picked, m)
+			seqNums = append(seqNums, seqNum)
+		}
+	}
+	return picked, seqNums, nil
+}
+
+func (mbox *IMAPMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	messages, seqNums, err := mbox.selected(uid, seqSet)
+	if err != nil {
+		return err
+	}
+
+	needsRaw := false
+	for _, item := range items {
+		switch item {
+		case imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchUid:
+		default:
+			needsRaw = true
+		}
+	}
+
+	for i := range messages {
+		m := &messages[i]
+		if needsRaw {
+			raw, err := loadRaw(m.ID)
+			if err != nil {
+				continue
+			}
+			m.Raw = raw
+		}
+
+		fetched, err := fetchIMAPMessage(m, seqNums[i], items)
+		if err != nil {
+			continue
+		}
+		ch <- fetched
+
+		// Reading the body implicitly marks the message as seen
+		if needsRaw && !m.HasFlag(seenFlag) && fetchSetsSeen(items) {
+			setFlags(m, append(m.FlagList(), seenFlag))
+		}
+	}
+	return nil
+}
+
+// fetchSetsSeen reports whether a FETCH of these items is not a PEEK
+func fetchSetsSeen(items []imap.FetchItem) bool {
+	for _, item := range items {
+		section, err := imap.ParseBodySectionName(item)
+		if err == nil && !section.Peek {
+			return true
+		}
+	}
+	return false
+}
+
+func fetchIMAPMessage(m *Message, seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, err := headerAndBody(m.Raw)
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, err := headerAndBody(m.Raw)
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = m.FlagList()
+		case imap.FetchInternalDate:
+			fetched.InternalDate = m.CreatedAt
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(m.Size)
+		case imap.FetchUid:
+			fetched.Uid = m.UID
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+			hdr, body, err := headerAndBody(m.Raw)
+			if err != nil {
+				return nil, err
+			}
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+		}
+	}
+	return fetched, nil
+}
+
+func headerAndBody(raw string) (textproto.Header, io.Reader, error) {
+	body := bufio.NewReader(strings.NewReader(raw))
+	hdr, err := textproto.ReadHeader(body)
+	return hdr, body, err
+}
+
+func (mbox *IMAPMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	messages, seqNums, err := mbox.selected(false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	for i := range messages {
+		m := &messages[i]
+		raw, err := loadRaw(m.ID)
+		if err != nil {
+			continue
+		}
+		e, _ := message.Read(strings.NewReader(raw))
+		if e == nil {
+			continue
+		}
+		ok, err := backendutil.Match(e, seqNums[i], m.UID, m.CreatedAt, m.FlagList(), criteria)
+		if err != nil || !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, m.UID)
+		} else {
+			ids = append(ids, seqNums[i])
+		}
+	}
+	return ids, nil
+}
+
+func (mbox *IMAPMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	raw := string(b)
+	m := Message{
+		AccountID: mbox.user.account.ID,
+		Mailbox:   defaultMailbox,
+		Subject:   decodeRFC2047(extractSubject(raw)),
+		Flags:     strings.Join(flags, " "),
+		Size:      len(b),
+		Raw:       raw,
+		CreatedAt: date,
+	}
+	if hdr, _, err := headerAndBody(raw); err == nil {
+		m.From = hdr.Get("From")
+		m.To = hdr.Get("To")
+	}
+	if err := appendMessage(&m); err != nil {
+		return err
+	}
+	notifyMailboxChanged(mbox.user.account.ID)
+	return nil
+}
+
+func (mbox *IMAPMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	messages, _, err := mbox.selected(uid, seqSet)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		if err := setFlags(&messages[i], backendutil.UpdateFlags(messages[i].FlagList(), op, flags)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mbox *IMAPMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	if !strings.EqualFold(dest, defaultMailbox) {
+		return backend.ErrNoSuchMailbox
+	}
+
+	messages, _, err := mbox.selected(uid, seqSet)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		raw, err := loadRaw(m.ID)
+		if err != nil {
+			return err
+		}
+		copied := m
+		copied.ID = 0
+		copied.Raw = raw
+		if err := appendMessage(&copied); err != nil {
+			return err
+		}
+	}
+	notifyMailboxChanged(mbox.user.account.ID)
+	return nil
+}
+
+func (mbox *IMAPMailbox) Expunge() error {
+	messages, err := mailboxMessages(mbox.user.account.ID)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint
+	for i := range messages {
+		if messages[i].HasFlag(deletedFlag) {
+			ids = append(ids, messages[i].ID)
+		}
+	}
+	return deleteMessages(mbox.user.account, ids)
+}
+
+// notifyMailboxChanged tells selected IMAP clients about new messages
+func notifyMailboxChanged(accountID uint) {
+	if imapBackend == nil {
+		return
+	}
+	var account Account
+	if DB.Select("id", "mailbox_user").First(&account, accountID).Error != nil || account.MailboxUser == "" {
+		return
+	}
+	status, err := mailboxStatus(accountID, []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext})
+	if err != nil {
+		return
+	}
+	sendIMAPUpdate(&backend.MailboxUpdate{
+		Update:        backend.NewUpdate(account.MailboxUser, defaultMailbox),
+		MailboxStatus: status,
+	})
+}
+
+// notifyMailboxExpunged tells selected IMAP clients about removed messages.
+// Sequence numbers must be given from the highest to the lowest.
+func notifyMailboxExpunged(username string, seqNums []uint32) {
+	if imapBackend == nil || username == "" {
+		return
+	}
+	for _, seqNum := range seqNums {
+		update := &backend.ExpungeUpdate{Update: backend.NewUpdate(username, defaultMailbox), SeqNum: seqNum}
+		if !sendIMAPUpdate(update) {
+			return
+		}
+		// Keep the order of untagged responses
+		select {
+		case <-update.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func sendIMAPUpdate(update backend.Update) bool {
+	select {
+	case imapBackend.updates <- update:
+		return true
+	default:
+		log.Printf("[IMAP] Update queue full, dropping update for %s", update.Username())
+		return false
+	}
+}
+
+func StartIMAPServer(cfg *Config, be *IMAPBackend) {
+	if be == nil {
+		return
+	}
+
+	s := imapserver.New(be)
+	s.Addr = ":" + cfg.IMAPPort
+	s.AutoLogout = 30 * time.Minute
+
+	tlsConfig, err := serverTLSConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificate: %v", err)
+	}
+	if tlsConfig != nil {
+		s.TLSConfig = tlsConfig
+	} else {
+		log.Printf("[IMAP] No TLS certificate configured, allowing plain text logins")
+		s.AllowInsecureAuth = true
+	}
+
+	log.Printf("Starting IMAP server on %s", s.Addr)
+	if err := s.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
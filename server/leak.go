@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+	"gorm.io/gorm"
+)
+
+// senderDomain returns the lower-cased domain part of an address
+func senderDomain(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at == -1 {
+		return ""
+	}
+	return strings.Trim(strings.ToLower(addr[at+1:]), "> ")
+}
+
+// registrableDomain reduces a host to its registrable domain (eTLD+1), so
+// that mail.example.co.uk and example.co.uk are treated as the same sender
+func registrableDomain(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	if host == "" {
+		return ""
+	}
+	if d, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return d
+	}
+	return host
+}
+
+// hostFromUsedFor extracts a host from a free-form "used for" value such as
+// "https://shop.example.com/signup" or "example.com"
+func hostFromUsedFor(usedFor string) string {
+	usedFor = strings.TrimSpace(usedFor)
+	if usedFor == "" || strings.ContainsAny(usedFor, " \t") {
+		return ""
+	}
+	if !strings.Contains(usedFor, "://") {
+		usedFor = "http://" + usedFor
+	}
+	u, err := url.Parse(usedFor)
+	if err != nil || !strings.Contains(u.Hostname(), ".") {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// expectedSenderDomain returns the registrable domain the alias is supposed
+// to receive mail from, or an empty string when nothing is known yet
+func (a *Account) expectedSenderDomain() string {
+	if a.ServiceDomain != "" {
+		return registrableDomain(a.ServiceDomain)
+	}
+	if host := hostFromUsedFor(a.UsedFor); host != "" {
+		return registrableDomain(host)
+	}
+	return registrableDomain(a.FirstSenderDomain)
+}
+
+// checkLeak compares the sender with the service the alias was registered
+// for. It returns an alert message for unrelated senders and notifies the
+// admin the first time a given unrelated domain shows up.
+func checkLeak(cfg *Config, a *Account, from string) string {
+	sender := registrableDomain(senderDomain(from))
+	expected := a.expectedSenderDomain()
+	if sender == "" || expected == "" || sender == expected {
+		return ""
+	}
+
+	alert := fmt.Sprintf("sender domain %s is unrelated to %s", sender, expected)
+	for _, d := range strings.Split(a.LeakDomains, ",") {
+		if strings.TrimSpace(d) == sender {
+			return alert
+		}
+	}
+
+	// Append in the database, the snapshot taken at RCPT may be stale when
+	// several sessions deliver to the alias. Only the session that adds the
+	// domain sends the alert.
+	result := DB.Model(&Account{}).
+		Where("id = ? AND instr(',' || COALESCE(leak_domains, '') || ',', ?) = 0", a.ID, ","+sender+",").
+		Update("leak_domains", gorm.Expr("CASE WHEN COALESCE(leak_domains, '') = '' THEN ? ELSE leak_domains || ',' || ? END", sender, sender))
+	var stored Account
+	if DB.Select("id", "leak_domains").First(&stored, a.ID).Error == nil {
+		a.LeakDomains = stored.LeakDomains
+	}
+	if result.Error != nil || result.RowsAffected == 0 {
+		return alert
+	}
+
+	log.Printf("[Leak] Alias %s (%s) received mail from unrelated domain %s", a.Pattern, expected, sender)
+	if cfg.AdminEmail != "" {
+		go func(pattern string, usedFor string) {
+			body := fmt.Sprintf("The alias %s was registered for %s (%s) but received mail from %s (%s).\r\n\r\n"+
+				"The service may have leaked or sold the address. Consider disabling the alias or blocking the sender.\r\n",
+				pattern, usedFor, expected, sender, from)
+			if err := sendSystemMail(cfg, cfg.AdminEmail, "[mail-generator] Possible address leak: "+sender, body); err != nil {
+				log.Printf("Failed to send leak alert: %v", err)
+			}
+		}(a.Pattern, a.UsedFor)
+	}
+	return alert
+}
+
+// recordFirstSender remembers the sender domain of the first forwarded mail
+func recordFirstSender(a *Account, from string) {
+	domain := senderDomain(from)
+	if domain == "" {
+		return
+	}
+	DB.Model(&Account{}).
+		Where("id = ? AND (first_sender_domain = '' OR first_sender_domain IS NULL)", a.ID).
+		Update("first_sender_domain", domain)
+}
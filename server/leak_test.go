@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCheckLeak(t *testing.T) {
+	cfg := newTestDB(t)
+	tests := []struct {
+		name    string
+		account Account
+		from    string
+		alert   bool
+	}{
+		{"service domain", Account{ServiceDomain: "shop.test"}, "noreply@mail.shop.test", false},
+		{"used for url", Account{UsedFor: "https://www.shop.co.uk/signup"}, "a@news.shop.co.uk", false},
+		{"first sender", Account{FirstSenderDomain: "shop.test"}, "a@shop.test", false},
+		{"nothing known", Account{}, "a@spam.test", false},
+		{"unrelated", Account{ServiceDomain: "shop.test"}, "a@spam.test", true},
+		{"lookalike", Account{ServiceDomain: "shop.test"}, "a@shop.test.evil.test", true},
+	}
+	for i, tt := range tests {
+		tt.account.Pattern = "^leak" + string(rune('a'+i)) + "@example\\.com$"
+		tt.account.ForwardTo = "local"
+		DB.Create(&tt.account)
+		if got := checkLeak(cfg, &tt.account, tt.from); (got != "") != tt.alert {
+			t.Errorf("%s: alert %q, want %v", tt.name, got, tt.alert)
+		}
+	}
+}
+
+// Sessions check the alias they loaded at RCPT, a stale copy must not drop
+// the domains other sessions recorded in the meantime
+func TestCheckLeakStaleAccount(t *testing.T) {
+	cfg := newTestDB(t)
+	account := Account{Pattern: "^shop@example\\.com$", ForwardTo: "local", ServiceDomain: "shop.test"}
+	DB.Create(&account)
+
+	first, second, third := account, account, account
+	checkLeak(cfg, &first, "a@one.test")
+	checkLeak(cfg, &second, "a@two.test")
+	checkLeak(cfg, &third, "a@one.test")
+	if second.LeakDomains != "one.test,two.test" {
+		t.Errorf("copy after the update: %q", second.LeakDomains)
+	}
+
+	var stored Account
+	DB.First(&stored, account.ID)
+	domains := strings.Split(stored.LeakDomains, ",")
+	sort.Strings(domains)
+	if strings.Join(domains, ",") != "one.test,two.test" {
+		t.Errorf("leak_domains %q", stored.LeakDomains)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	loginBaseDelay = time.Second      // Wait after the second failure, doubled after each further one
+	loginMaxDelay  = 30 * time.Second // Longest progressive delay before a lockout
+)
+
+// failureRecord counts the recent failed logins of one IP or username
+type failureRecord struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// retryAfter returns how long the next attempt has to wait
+func (r *failureRecord) retryAfter(now time.Time) time.Duration {
+	if now.Before(r.lockedUntil) {
+		return r.lockedUntil.Sub(now)
+	}
+	// A single typo is retried right away
+	if r.count < 2 {
+		return 0
+	}
+	// Capped before converting, a large count would overflow the duration
+	delay := loginMaxDelay
+	if d := float64(loginBaseDelay) * math.Pow(2, float64(r.count-2)); d < float64(loginMaxDelay) {
+		delay = time.Duration(d)
+	}
+	if wait := r.last.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// LoginGuard slows down and then locks out IPs and usernames with repeated
+// failed logins. Failures are forgotten after a lockout period without new
+// ones, which also bounds the memory used.
+type LoginGuard struct {
+	mu              sync.Mutex
+	maxUserFailures int
+	maxIPFailures   int
+	lockout         time.Duration
+	ips             map[string]*failureRecord
+	users           map[string]*failureRecord
+	lastSweep       time.Time
+}
+
+func NewLoginGuard(maxUserFailures int, maxIPFailures int, lockout time.Duration) *LoginGuard {
+	return &LoginGuard{
+		maxUserFailures: maxUserFailures,
+		maxIPFailures:   maxIPFailures,
+		lockout:         lockout,
+		ips:             map[string]*failureRecord{},
+		users:           map[string]*failureRecord{},
+		lastSweep:       time.Now(),
+	}
+}
+
+var loginGuard = NewLoginGuard(5, 20, 15*time.Minute)
+
+// SetLimits changes the limits, failures recorded so far are kept
+func (g *LoginGuard) SetLimits(maxUserFailures int, maxIPFailures int, lockout time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maxUserFailures, g.maxIPFailures, g.lockout = maxUserFailures, maxIPFailures, lockout
+}
+
+func guardKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// Check returns how long the IP or username has to wait before it may try
+// to log in again, 0 when it may try now
+func (g *LoginGuard) Check(ip string, username string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	if r, ok := g.ips[ip]; ok {
+		wait = r.retryAfter(now)
+	}
+	if r, ok := g.users[guardKey(username)]; ok {
+		if w := r.retryAfter(now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// Fail records a failed login
+func (g *LoginGuard) Fail(ip string, username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	g.sweep(now)
+	g.fail(g.ips, ip, g.maxIPFailures, now)
+	if key := guardKey(username); key != "" {
+		g.fail(g.users, key, g.maxUserFailures, now)
+	}
+}
+
+func (g *LoginGuard) fail(records map[string]*failureRecord, key string, max int, now time.Time) {
+	r, ok := records[key]
+	if !ok || now.Sub(r.last) > g.lockout {
+		r = &failureRecord{}
+		records[key] = r
+	}
+	r.count++
+	r.last = now
+	if max > 0 && r.count >= max {
+		r.lockedUntil = now.Add(g.lockout)
+		r.count = 0
+	}
+}
+
+// Succeed clears the failures of a username after a complete login. The IP
+// keeps its failures so that logging into an own account does not reset the
+// count of guesses at others.
+func (g *LoginGuard) Succeed(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.users, guardKey(username))
+}
+
+// sweep drops records that neither lock nor slow down anything anymore
+func (g *LoginGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Minute {
+		return
+	}
+	g.lastSweep = now
+	for _, records := range []map[string]*failureRecord{g.ips, g.users} {
+		for key, r := range records {
+			if now.After(r.lockedUntil) && now.Sub(r.last) > g.lockout {
+				delete(records, key)
+			}
+		}
+	}
+}
+
+// tooManyAttempts rejects a throttled login
+func tooManyAttempts(c *gin.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", fmt.Sprint(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Too many failed attempts, try again in %d seconds", seconds)})
+}
+
+// remoteIP is the address of a mail client connection without the port
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		count   int
+		elapsed time.Duration
+		locked  time.Duration
+		want    time.Duration
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 0}, // A single typo is retried right away
+		{2, 0, 0, time.Second},
+		{3, 0, 0, 2 * time.Second},
+		{4, 0, 0, 4 * time.Second},
+		{6, 0, 0, 16 * time.Second},
+		{7, 0, 0, 30 * time.Second}, // Capped
+		{40, 0, 0, 30 * time.Second},
+		{3, 1500 * time.Millisecond, 0, 500 * time.Millisecond},
+		{3, 5 * time.Second, 0, 0},
+		{0, 0, 10 * time.Minute, 10 * time.Minute},
+		{0, 0, -time.Second, 0},
+	}
+	for _, tt := range tests {
+		r := &failureRecord{count: tt.count, last: now.Add(-tt.elapsed), lockedUntil: now.Add(tt.locked)}
+		if got := r.retryAfter(now); got != tt.want {
+			t.Errorf("count %d, %v ago, locked %v: wait %v, want %v", tt.count, tt.elapsed, tt.locked, got, tt.want)
+		}
+	}
+}
+
+func TestLoginGuardLockout(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		wantAbove time.Duration
+		wantBelow time.Duration
+	}{
+		{"first failure", 1, -1, 1},
+		{"second failure", 2, 0, time.Second + 1},
+		{"third failure", 3, 0, 2*time.Second + 1},
+		{"locked out", 4, time.Hour - time.Minute, time.Hour + 1},
+	}
+	for _, tt := range tests {
+		g := NewLoginGuard(4, 100, time.Hour)
+		for i := 0; i < tt.failures; i++ {
+			g.Fail("192.0.2.1", "Alice")
+		}
+		// Usernames are compared without case and surrounding spaces, other
+		// addresses are still slowed down for the username
+		if got := g.Check("198.51.100.1", " alice"); got <= tt.wantAbove || got >= tt.wantBelow {
+			t.Errorf("%s: wait %v, want between %v and %v", tt.name, got, tt.wantAbove, tt.wantBelow)
+		}
+	}
+}
+
+func TestLoginGuardIPLockout(t *testing.T) {
+	g := NewLoginGuard(100, 3, time.Hour)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		g.Fail("192.0.2.1", username)
+	}
+	if got := g.Check("192.0.2.1", "dave"); got < time.Hour-time.Minute {
+		t.Errorf("guessing IP: wait %v", got)
+	}
+	if got := g.Check("192.0.2.2", "alice"); got != 0 {
+		t.Errorf("other IP: wait %v", got)
+	}
+}
+
+func TestLoginGuardSucceed(t *testing.T) {
+	g := NewLoginGuard(100, 100, time.Hour)
+	for i := 0; i < 3; i++ {
+		g.Fail("192.0.2.1", "alice")
+		g.Fail("192.0.2.9", "bob")
+	}
+	g.Succeed("ALICE")
+	if got := g.Check("192.0.2.2", "alice"); got != 0 {
+		t.Errorf("alice after a login: wait %v", got)
+	}
+	// The IP keeps its count, logging into an own account does not reset
+	// guesses at others
+	if got := g.Check("192.0.2.1", "someone"); got == 0 {
+		t.Error("IP was cleared by the login")
+	}
+	if got := g.Check("192.0.2.3", "bob"); got == 0 {
+		t.Error("bob was cleared by alice's login")
+	}
+}
+
+func TestLoginGuardForgets(t *testing.T) {
+	g := NewLoginGuard(3, 100, time.Minute)
+	start := time.Now().Add(-time.Hour)
+	g.fail(g.users, "alice", 3, start)
+	g.fail(g.users, "alice", 3, start)
+	// The next failure is more than a lockout period later and starts over
+	g.fail(g.users, "alice", 3, start.Add(2*time.Minute))
+	if r := g.users["alice"]; r.count != 1 || !r.lockedUntil.IsZero() {
+		t.Errorf("record %+v", r)
+	}
+
+	g.sweep(time.Now().Add(2 * time.Minute)) // Sweeps run at most once a minute
+	if len(g.users) != 0 {
+		t.Errorf("%d stale records kept", len(g.users))
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	localTarget    = "local"
+	defaultMailbox = "INBOX"
+	seenFlag       = "\\Seen"
+	deletedFlag    = "\\Deleted"
+)
+
+// isLocalTarget reports whether a forward target stores mail in the local mailbox
+func isLocalTarget(target string) bool {
+	return strings.EqualFold(strings.TrimSpace(target), localTarget)
+}
+
+// storeLocal appends a message to the local mailbox of the account
+func storeLocal(rule Account, msg InboundMessage) error {
+	stored := Message{
+		AccountID: rule.ID,
+		LogID:     msg.LogID,
+		Mailbox:   defaultMailbox,
+		From:      msg.From,
+		To:        msg.To,
+		Subject:   msg.Subject,
+		Size:      len(msg.Raw),
+		Raw:       msg.Raw,
+		CreatedAt: msg.Received,
+	}
+	if err := appendMessage(&stored); err != nil {
+		return err
+	}
+
+	notifyMailboxChanged(rule.ID)
+	return nil
+}
+
+// appendMessage assigns the next UID of the account and saves the message
+func appendMessage(m *Message) error {
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = time.Now()
+	}
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var account Account
+		if err := tx.Select("id", "next_uid").First(&account, m.AccountID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&Account{}).Where("id = ?", account.ID).
+			Update("next_uid", gorm.Expr("next_uid + 1")).Error; err != nil {
+			return err
+		}
+		m.UID = account.NextUID
+		return tx.Create(m).Error
+	})
+}
+
+// mailboxMessages lists the messages of a mailbox ordered by UID, without
+// their raw content
+func mailboxMessages(accountID uint) ([]Message, error) {
+	var messages []Message
+	err := DB.Omit("raw").Where("account_id = ? AND mailbox = ?", accountID, defaultMailbox).
+		Order("uid asc").Find(&messages).Error
+	return messages, err
+}
+
+// loadRaw fetches the raw content of a stored message
+func loadRaw(id uint) (string, error) {
+	var m Message
+	if err := DB.Select("id", "raw").First(&m, id).Error; err != nil {
+		return "", err
+	}
+	return m.Raw, nil
+}
+
+// deleteMessages removes messages from the mailbox of an account and tells
+// selected IMAP clients about the sequence numbers that went away
+func deleteMessages(account *Account, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	messages, err := mailboxMessages(account.ID)
+	if err != nil {
+		return err
+	}
+
+	remove := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+	var seqNums []uint32
+	for i := len(messages) - 1; i >= 0; i-- {
+		if remove[messages[i].ID] {
+			seqNums = append(seqNums, uint32(i+1))
+		}
+	}
+
+	if err := DB.Where("account_id = ? AND id IN ?", account.ID, ids).Delete(&Message{}).Error; err != nil {
+		return err
+	}
+	notifyMailboxExpunged(account.MailboxUser, seqNums)
+	return nil
+}
+
+// quarantineStored moves a stored message to the quarantine so that it can
+// be released to the other targets of the account later
+func quarantineStored(account *Account, m *Message) (*Quarantine, error) {
+	raw, err := loadRaw(m.ID)
+	if err != nil {
+		return nil, err
+	}
+	q := Quarantine{
+		LogID:     m.LogID,
+		AccountID: account.ID,
+		From:      m.From,
+		To:        m.To,
+		Subject:   m.Subject,
+		Raw:       raw,
+		Reason:    "moved from mailbox",
+	}
+	if err := DB.Create(&q).Error; err != nil {
+		return nil, err
+	}
+	return &q, deleteMessages(account, []uint{m.ID})
+}
+
+// FlagList splits the stored flags
+func (m *Message) FlagList() []string {
+	return strings.Fields(m.Flags)
+}
+
+// HasFlag reports whether the message carries the flag (case-insensitive)
+func (m *Message) HasFlag(flag string) bool {
+	for _, f := range m.FlagList() {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// setFlags stores a new flag list for a message
+func setFlags(m *Message, flags []string) error {
+	m.Flags = strings.Join(flags, " ")
+	return DB.Model(&Message{}).Where("id = ?", m.ID).Update("flags", m.Flags).Error
+}
+
+// setMailboxCredentials stores the login used for IMAP/POP3 access
+func setMailboxCredentials(account *Account, username string, password string) error {
+	username = strings.ToLower(strings.TrimSpace(username))
+	if username == "" {
+		return errors.New("username is required")
+	}
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+
+	var count int64
+	DB.Model(&Account{}).Where("mailbox_user = ? AND id <> ?", username, account.ID).Count(&count)
+	if count > 0 {
+		return errors.New("username is already taken")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	account.MailboxUser = username
+	account.MailboxPasswordHash = string(hash)
+	return DB.Model(&Account{}).Where("id = ?", account.ID).Updates(map[string]interface{}{
+		"mailbox_user":          account.MailboxUser,
+		"mailbox_password_hash": account.MailboxPasswordHash,
+	}).Error
+}
+
+var (
+	errInvalidMailboxLogin = errors.New("invalid credentials")
+	errMailboxLoginLocked  = errors.New("too many failed logins, try again later")
+)
+
+// authenticateMailbox checks mailbox credentials and returns the account.
+// Failures count towards the lockout of the client IP and mailbox user.
+func authenticateMailbox(username string, password string, ip string) (*Account, error) {
+	username = strings.ToLower(strings.TrimSpace(username))
+	guardUser := "mailbox:" + username
+	if loginGuard.Check(ip, guardUser) > 0 {
+		return nil, errMailboxLoginLocked
+	}
+	var account Account
+	if username == "" || DB.Where("mailbox_user = ?", username).First(&account).Error != nil {
+		// Spend the same time as a real comparison
+		bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), []byte(password))
+		loginGuard.Fail(ip, guardUser)
+		return nil, errInvalidMailboxLogin
+	}
+	if account.MailboxPasswordHash == "" ||
+		bcrypt.CompareHashAndPassword([]byte(account.MailboxPasswordHash), []byte(password)) != nil {
+		loginGuard.Fail(ip, guardUser)
+		return nil, errInvalidMailboxLogin
+	}
+	loginGuard.Succeed(guardUser)
+	return &account, nil
+}
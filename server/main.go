@@ -1,20 +1,50 @@
 package main
 
 import (
+	"log"
+
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	cfg := LoadConfig()
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Initialize Database
 	InitDB(cfg)
 
+	// Settings changed from the admin API override the file and environment
+	configBase = cfg
+	cfg = applySettings(cfg, cfg)
+	configs.Store(cfg)
+	applyLimits(cfg)
+	go WatchConfig(cfg)
+
+	// Created before the servers start, SMTP and POP3 send IMAP updates
+	imapBackend = NewIMAPBackend(cfg)
+
 	// Start SMTP Server in background
 	go StartSMTPServer(cfg)
+	go StartIMAPServer(cfg, imapBackend)
+	go StartPOP3Server(cfg)
+
+	// Periodic quarantine digest (disabled unless configured)
+	go StartQuarantineDigest(cfg)
+	go StartDisposableCleanup()
 
 	// Setup Web Server
-	r := gin.Default()
+	// Credentials in the query string are taken out before the request is
+	// logged, access logs must not hold tokens
+	r := gin.New()
+	r.Use(RedactQueryCredentials(), gin.Logger(), gin.Recovery())
+
+	// Only believe X-Forwarded-For from our own reverse proxy, otherwise
+	// clients could pick the IP that rate limits and lockouts apply to
+	if err := r.SetTrustedProxies(splitTargets(cfg.TrustedProxies)); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 
 	// CORS (Simple for now)
 	r.Use(func(c *gin.Context) {
@@ -28,24 +58,109 @@ func main() {
 		c.Next()
 	})
 
-	r.POST("/api/login", RateLimitMiddleware(), LoginHandler(cfg))
+	r.POST("/api/login", RateLimitMiddleware(), LoginHandler())
+	r.POST("/api/login/2fa", RateLimitMiddleware(), SecondFactorLoginHandler())
+	r.POST("/api/login/2fa/setup", RateLimitMiddleware(), SecondFactorSetupHandler())
+	r.POST("/api/token/refresh", RateLimitMiddleware(), RefreshHandler())
+	r.POST("/api/logout", RateLimitMiddleware(), LogoutHandler)
+	r.GET("/api/auth/providers", AuthProvidersHandler())
+	r.GET("/api/auth/oidc/login", RateLimitMiddleware(), OIDCLoginHandler())
+	r.GET("/api/auth/oidc/callback", RateLimitMiddleware(), OIDCCallbackHandler())
+	r.GET("/api/public/inbox/:token", RateLimitMiddleware(), GetPublicInbox)
 
 	authorized := r.Group("/api")
-	authorized.Use(AuthMiddleware(cfg))
+	authorized.Use(AuthMiddleware())
 	{
+		// Current user
+		authorized.GET("/me", GetMe)
+		authorized.PUT("/me/password", ChangeOwnPassword)
+		authorized.POST("/me/totp", StartTOTPEnrollment)
+		authorized.POST("/me/totp/enable", EnableTOTP)
+		authorized.POST("/me/totp/recovery-codes", RegenerateRecoveryCodes)
+		authorized.DELETE("/me/totp", DisableTOTP)
+		authorized.GET("/me/sessions", GetSessions)
+		authorized.DELETE("/me/sessions", RevokeAllSessions)
+		authorized.DELETE("/me/sessions/:id", RevokeOwnSession)
+
+		// API tokens
+		authorized.GET("/tokens", GetAPITokens)
+		authorized.POST("/tokens", CreateAPIToken)
+		authorized.DELETE("/tokens/:id", RevokeAPIToken)
+
+		// Users
+		users := authorized.Group("/users", RequireRole(RoleAdmin))
+		users.GET("", GetUsers)
+		users.POST("", CreateUser)
+		users.PUT("/:id", UpdateUser)
+		users.DELETE("/:id", DeleteUser)
+		users.DELETE("/:id/totp", ResetUserTOTP)
+		users.DELETE("/:id/sessions", RevokeUserSessions)
+
+		// Audit log
+		authorized.GET("/audit", RequireRole(RoleAdmin), GetAuditLog)
+
+		// Runtime settings
+		settings := authorized.Group("/settings", RequireRole(RoleAdmin))
+		settings.GET("", GetSettings)
+		settings.PUT("", UpdateSettings)
+		settings.POST("/relay/test", TestRelay)
+
 		// Domains
 		authorized.GET("/domains", GetDomains)
-		authorized.POST("/domains", CreateDomain)
-		authorized.DELETE("/domains/:id", DeleteDomain)
+		authorized.POST("/domains", RequireRole(RoleAdmin, RoleOperator), CreateDomain)
+		authorized.PUT("/domains/:id/owner", RequireRole(RoleAdmin, RoleOperator), SetDomainOwner)
+		authorized.DELETE("/domains/:id", RequireRole(RoleAdmin, RoleOperator), DeleteDomain)
 
 		// Accounts
 		authorized.GET("/accounts", GetAccounts)
 		authorized.POST("/accounts", CreateAccount)
+		authorized.POST("/accounts/generate", GenerateAccount)
+		authorized.POST("/accounts/disposable", CreateDisposableInbox())
 		authorized.PUT("/accounts/:id", UpdateAccount)
+		authorized.POST("/accounts/:id/preview", PreviewAccountTemplate())
+		authorized.PUT("/accounts/:id/mailbox", SetMailboxCredentials)
+		authorized.GET("/accounts/:id/messages", GetAccountMessages)
 		authorized.DELETE("/accounts/:id", DeleteAccount)
 
+		// Sender allow/block lists
+		authorized.GET("/filters", GetSenderFilters)
+		authorized.POST("/filters", CreateSenderFilter)
+		authorized.PUT("/filters/:id", UpdateSenderFilter)
+		authorized.DELETE("/filters/:id", DeleteSenderFilter)
+
+		// Mailbox
+		authorized.GET("/messages/:id", GetMessage)
+		authorized.GET("/messages/:id/attachments/:index", GetMessageAttachment)
+		authorized.PUT("/messages/:id/read", MarkMessageRead)
+		authorized.POST("/messages/:id/quarantine", QuarantineStoredMessage)
+		authorized.DELETE("/messages/:id", DeleteMessage)
+
 		// Logs
 		authorized.GET("/logs", GetLogs)
+		authorized.GET("/logs/:id", GetLog)
+
+		// Verification codes
+		authorized.GET("/codes/latest", GetLatestCode)
+		authorized.GET("/code-patterns", GetCodePatterns)
+		authorized.POST("/code-patterns", RequireRole(RoleAdmin, RoleOperator), CreateCodePattern)
+		authorized.DELETE("/code-patterns/:id", RequireRole(RoleAdmin, RoleOperator), DeleteCodePattern)
+
+		// Quarantine
+		authorized.GET("/quarantine", GetQuarantine)
+		authorized.GET("/quarantine/:id", GetQuarantineItem)
+		authorized.POST("/quarantine/:id/release", ReleaseQuarantine())
+		authorized.DELETE("/quarantine/:id", DeleteQuarantine)
+	}
+
+	// Live events. EventSource and WebSocket clients cannot set headers,
+	// they pass a ticket from POST /api/events/ticket as ?ticket=
+	live := r.Group("/api/events")
+	live.POST("/ticket", AuthMiddleware(), StreamTicketHandler())
+	live.Use(StreamAuthMiddleware())
+	{
+		live.GET("", StreamEvents)
+		live.GET("/ws", WebSocketEvents)
+		live.GET("/poll", PollEvents)
 	}
 
 	r.Run(":" + cfg.Port)
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/logger"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testConfig is a valid configuration for tests that do not read the
+// environment
+func testConfig() *Config {
+	return &Config{
+		Password:        "admin-password",
+		JWTSecret:       "test-secret-0123456789abcdef0123456789",
+		JWTIssuer:       "mail-generator",
+		JWTAudience:     "mail-generator-api",
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 24 * time.Hour,
+		DefaultEnvelope: "postmaster@localhost",
+	}
+}
+
+// newTestDB points DB at a fresh database holding only the admin user and
+// makes the returned configuration the current one
+func newTestDB(t *testing.T) *Config {
+	t.Helper()
+	cfg := testConfig()
+	cfg.DBFile = filepath.Join(t.TempDir(), "test.db")
+	InitDB(cfg)
+	DB.Logger = logger.Default.LogMode(logger.Silent)
+	configs.Store(cfg)
+	t.Cleanup(func() {
+		if sqlDB, err := DB.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return cfg
+}
+
+// createTestUser adds an enabled user with the role
+func createTestUser(t *testing.T, username string, role string) *User {
+	t.Helper()
+	user := User{Username: username, Role: role}
+	if err := user.SetPassword("password-" + username); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &user
+}
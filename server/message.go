@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+)
+
+// ParsedMessage is the structured form of a raw RFC822 message
+type ParsedMessage struct {
+	Headers     map[string][]string `json:"headers"`
+	From        string              `json:"from"`
+	To          string              `json:"to"`
+	Subject     string              `json:"subject"`
+	Date        string              `json:"date"`
+	Text        string              `json:"text"`
+	HTML        string              `json:"html"`
+	Attachments []Attachment        `json:"attachments"`
+}
+
+// Attachment describes a non-body MIME part. Content is only filled when
+// the caller asks for it and holds the base64 encoded data.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Size        int    `json:"size"`
+	Content     string `json:"content,omitempty"`
+	data        []byte
+}
+
+// parseMessage decodes headers, text and html bodies and attachments
+func parseMessage(raw string) (*ParsedMessage, error) {
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	pm := &ParsedMessage{
+		Headers:     map[string][]string{},
+		Attachments: []Attachment{},
+	}
+	for name, values := range m.Header {
+		decoded := make([]string, len(values))
+		for i, v := range values {
+			decoded[i] = decodeRFC2047(v)
+		}
+		pm.Headers[name] = decoded
+	}
+	pm.From = decodeRFC2047(m.Header.Get("From"))
+	pm.To = decodeRFC2047(m.Header.Get("To"))
+	pm.Subject = decodeRFC2047(m.Header.Get("Subject"))
+	pm.Date = m.Header.Get("Date")
+
+	body, err := io.ReadAll(m.Body)
+	if err != nil {
+		return nil, err
+	}
+	pm.walkPart(m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Header.Get("Content-Disposition"), m.Header.Get("Content-ID"), body)
+
+	if pm.Text == "" && pm.HTML != "" {
+		pm.Text = stripHTML(pm.HTML)
+	}
+	return pm, nil
+}
+
+// walkPart collects the bodies and attachments of one (possibly multipart) MIME part
+func (pm *ParsedMessage) walkPart(contentType string, encoding string, disposition string, contentID string, body []byte) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+		params = map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		boundary := params["boundary"]
+		if boundary == "" {
+			return
+		}
+		reader := multipart.NewReader(bytes.NewReader(body), boundary)
+		for {
+			part, err := reader.NextRawPart()
+			if err != nil {
+				break
+			}
+			content, _ := io.ReadAll(part)
+			pm.walkPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"),
+				part.Header.Get("Content-Disposition"), part.Header.Get("Content-ID"), content)
+		}
+		return
+	}
+
+	dispType, dispParams, _ := mime.ParseMediaType(disposition)
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+
+	isBody := dispType != "attachment" && filename == ""
+	if isBody && mediaType == "text/plain" && pm.Text == "" {
+		pm.Text = decodeBody(string(body), encoding, charsetOf(params))
+		return
+	}
+	if isBody && mediaType == "text/html" && pm.HTML == "" {
+		pm.HTML = decodeBody(string(body), encoding, charsetOf(params))
+		return
+	}
+
+	data := decodeTransfer(body, encoding)
+	pm.Attachments = append(pm.Attachments, Attachment{
+		Filename:    decodeRFC2047(filename),
+		ContentType: mediaType,
+		ContentID:   strings.Trim(contentID, "<>"),
+		Size:        len(data),
+		data:        data,
+	})
+}
+
+// IncludeAttachmentContent fills the base64 content of every attachment
+func (pm *ParsedMessage) IncludeAttachmentContent() {
+	for i := range pm.Attachments {
+		pm.Attachments[i].Content = base64.StdEncoding.EncodeToString(pm.Attachments[i].data)
+	}
+}
+
+func charsetOf(params map[string]string) string {
+	if c, ok := params["charset"]; ok {
+		return c
+	}
+	return "utf-8"
+}
+
+// decodeTransfer undoes the content transfer encoding of binary data
+func decodeTransfer(body []byte, encoding string) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		cleaned := strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, string(body))
+		if decoded, err := base64.StdEncoding.DecodeString(cleaned); err == nil {
+			return decoded
+		}
+	case "quoted-printable":
+		if decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body))); err == nil {
+			return decoded
+		}
+	}
+	return body
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Notification is the short summary of a received mail posted to chat platforms
+type Notification struct {
+	LogID    uint      `json:"log_id"`
+	Alias    string    `json:"alias"`
+	From     string    `json:"from"`
+	Subject  string    `json:"subject"`
+	Snippet  string    `json:"snippet,omitempty"`
+	Code     string    `json:"code,omitempty"`
+	CodeLink string    `json:"code_link,omitempty"`
+	Link     string    `json:"link,omitempty"`
+	Received time.Time `json:"received"`
+	CodeOnly bool      `json:"-"`
+}
+
+// Notifier posts a notification to one chat target
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+type telegramNotifier struct {
+	apiURL string
+	token  string
+	chatID string
+}
+
+type slackNotifier struct {
+	client *http.Client
+	url    string
+}
+
+type discordNotifier struct {
+	client *http.Client
+	url    string
+}
+
+type jsonNotifier struct {
+	client *http.Client
+	url    string
+}
+
+// parseNotifySpec splits a "kind:target" entry of Account.Notify, e.g.
+// "telegram:-1001234", "slack:https://hooks.slack.com/...",
+// "discord:https://discord.com/api/webhooks/..." or "json:https://..."
+func parseNotifySpec(spec string) (string, string, error) {
+	kind, target, ok := strings.Cut(strings.TrimSpace(spec), ":")
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	target = strings.TrimSpace(target)
+	if !ok || target == "" {
+		return "", "", fmt.Errorf("invalid notify target %q, expected kind:target", spec)
+	}
+
+	switch kind {
+	case "telegram":
+		return kind, target, nil
+	case "slack", "discord", "json":
+		if err := validateWebhookTarget(target); err != nil {
+			return "", "", err
+		}
+		return kind, target, nil
+	}
+	return "", "", fmt.Errorf("unknown notify kind %q, expected telegram, slack, discord or json", kind)
+}
+
+// newNotifier builds the notifier for one entry of Account.Notify, owner is
+// the owner of the account
+func newNotifier(cfg *Config, spec string, owner *uint) (Notifier, error) {
+	kind, target, err := parseNotifySpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "telegram":
+		if cfg.TelegramBotToken == "" {
+			return nil, errors.New("telegram notifications need TELEGRAM_BOT_TOKEN")
+		}
+		return &telegramNotifier{apiURL: strings.TrimSuffix(cfg.TelegramAPIURL, "/"), token: cfg.TelegramBotToken, chatID: target}, nil
+	case "slack":
+		return &slackNotifier{client: webhookClientFor(owner), url: target}, nil
+	case "discord":
+		return &discordNotifier{client: webhookClientFor(owner), url: target}, nil
+	}
+	return &jsonNotifier{client: webhookClientFor(owner), url: target}, nil
+}
+
+// validateNotifyTargets checks every entry of Account.Notify
+func validateNotifyTargets(a *Account) error {
+	for _, spec := range splitTargets(a.Notify) {
+		kind, target, err := parseNotifySpec(spec)
+		if err != nil {
+			return err
+		}
+		if kind != "telegram" && a.OwnerID != nil {
+			if err := validateTenantWebhookTarget(target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newNotification summarizes a message for chat targets. With
+// NotifyCodeOnly only the extracted code is sent when one was found.
+func newNotification(cfg *Config, rule Account, msg InboundMessage) Notification {
+	if rule.NotifyCodeOnly && (msg.Code != "" || msg.Link != "") {
+		return Notification{
+			LogID:    msg.LogID,
+			Alias:    msg.To,
+			Code:     msg.Code,
+			CodeLink: msg.Link,
+			Received: msg.Received,
+			CodeOnly: true,
+		}
+	}
+
+	snippet := strings.Join(strings.Fields(msg.Body), " ")
+	if cfg.NotifySnippetLength > 0 && utf8.RuneCountInString(snippet) > cfg.NotifySnippetLength {
+		snippet = string([]rune(snippet)[:cfg.NotifySnippetLength]) + "..."
+	}
+
+	n := Notification{
+		LogID:    msg.LogID,
+		Alias:    msg.To,
+		From:     msg.From,
+		Subject:  msg.Subject,
+		Snippet:  snippet,
+		Code:     msg.Code,
+		CodeLink: msg.Link,
+		Received: msg.Received,
+	}
+	if cfg.PublicURL != "" && msg.LogID != 0 {
+		n.Link = fmt.Sprintf("%s/logs?id=%d", strings.TrimSuffix(cfg.PublicURL, "/"), msg.LogID)
+	}
+	return n
+}
+
+// plainText renders the notification for platforms that take a text message
+func (n Notification) plainText() string {
+	if n.CodeOnly {
+		if n.Code != "" {
+			return n.Code
+		}
+		return n.CodeLink
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("New mail for %s\n", n.Alias))
+	sb.WriteString(fmt.Sprintf("From: %s\n", n.From))
+	sb.WriteString(fmt.Sprintf("Subject: %s\n", n.Subject))
+	if n.Code != "" {
+		sb.WriteString(fmt.Sprintf("Code: %s\n", n.Code))
+	}
+	if n.Snippet != "" {
+		sb.WriteString("\n" + n.Snippet + "\n")
+	}
+	if n.Link != "" {
+		sb.WriteString("\n" + n.Link)
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+func (t *telegramNotifier) Notify(n Notification) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"chat_id":                  t.chatID,
+		"text":                     truncateRunes(n.plainText(), 4096),
+		"disable_web_page_preview": true,
+	})
+	return postJSON(webhookClient, fmt.Sprintf("%s/bot%s/sendMessage", t.apiURL, t.token), body, nil)
+}
+
+func (s *slackNotifier) Notify(n Notification) error {
+	if n.CodeOnly {
+		body, _ := json.Marshal(map[string]string{"text": slackEscape(n.plainText())})
+		return postJSON(s.client, s.url, body, nil)
+	}
+
+	text := fmt.Sprintf("*New mail for %s*\n*From:* %s\n*Subject:* %s", slackEscape(n.Alias), slackEscape(n.From), slackEscape(n.Subject))
+	if n.Code != "" {
+		text += fmt.Sprintf("\n*Code:* `%s`", slackEscape(n.Code))
+	}
+	if n.Snippet != "" {
+		text += "\n>" + slackEscape(n.Snippet)
+	}
+	if n.Link != "" {
+		text += fmt.Sprintf("\n<%s|View in mail-generator>", n.Link)
+	}
+	body, _ := json.Marshal(map[string]string{"text": text})
+	return postJSON(s.client, s.url, body, nil)
+}
+
+func (d *discordNotifier) Notify(n Notification) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"content":          truncateRunes(n.plainText(), 2000),
+		"allowed_mentions": map[string]interface{}{"parse": []string{}},
+	})
+	return postJSON(d.client, d.url, body, nil)
+}
+
+func (j *jsonNotifier) Notify(n Notification) error {
+	body, _ := json.Marshal(n)
+	return postJSON(j.client, j.url, body, nil)
+}
+
+// slackEscape escapes the control characters of Slack's mrkdwn format
+func slackEscape(s string) string {
+	s = strings.ReplaceAll(s, "&", "&amp;")
+	s = strings.ReplaceAll(s, "<", "&lt;")
+	return strings.ReplaceAll(s, ">", "&gt;")
+}
+
+func truncateRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max-3]) + "..."
+}
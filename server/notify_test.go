@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubRequest is what a notifier sent to the stub server
+type stubRequest struct {
+	Method      string
+	Path        string
+	ContentType string
+	Body        map[string]interface{}
+}
+
+// newNotifyStub records every request and answers with status
+func newNotifyStub(t *testing.T, status int) (*httptest.Server, *[]stubRequest) {
+	t.Helper()
+	var requests []stubRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		req := stubRequest{Method: r.Method, Path: r.URL.Path, ContentType: r.Header.Get("Content-Type")}
+		if err := json.Unmarshal(raw, &req.Body); err != nil {
+			t.Errorf("request body is not JSON: %s", raw)
+		}
+		requests = append(requests, req)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func testNotification() Notification {
+	return Notification{
+		LogID:    7,
+		Alias:    "shop@example.com",
+		From:     "news@shop.test",
+		Subject:  "Your <code>",
+		Snippet:  "Use 123456 to sign in",
+		Code:     "123456",
+		Link:     "https://mail.example.com/logs?id=7",
+		Received: time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestNotifierPayloads(t *testing.T) {
+	n := testNotification()
+	text := "New mail for shop@example.com\nFrom: news@shop.test\nSubject: Your <code>\nCode: 123456\n\nUse 123456 to sign in\n\nhttps://mail.example.com/logs?id=7"
+
+	tests := []struct {
+		kind string
+		path string
+		want map[string]interface{}
+	}{
+		{
+			kind: "telegram",
+			path: "/botsecret-token/sendMessage",
+			want: map[string]interface{}{"chat_id": "-1001234", "text": text, "disable_web_page_preview": true},
+		},
+		{
+			kind: "slack",
+			path: "/services/T0/B0",
+			want: map[string]interface{}{"text": "*New mail for shop@example.com*\n*From:* news@shop.test\n*Subject:* Your &lt;code&gt;\n*Code:* `123456`\n>Use 123456 to sign in\n<https://mail.example.com/logs?id=7|View in mail-generator>"},
+		},
+		{
+			kind: "discord",
+			path: "/api/webhooks/1/abc",
+			want: map[string]interface{}{"content": text, "allowed_mentions": map[string]interface{}{"parse": []interface{}{}}},
+		},
+		{
+			kind: "json",
+			path: "/hook",
+			want: map[string]interface{}{
+				"log_id": 7.0, "alias": "shop@example.com", "from": "news@shop.test", "subject": "Your <code>",
+				"snippet": "Use 123456 to sign in", "code": "123456", "link": "https://mail.example.com/logs?id=7",
+				"received": "2024-05-17T12:00:00Z",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		server, requests := newNotifyStub(t, http.StatusOK)
+		cfg := &Config{TelegramAPIURL: server.URL + "/", TelegramBotToken: "secret-token"}
+		spec := tt.kind + ":" + server.URL + tt.path
+		if tt.kind == "telegram" {
+			spec = "telegram:-1001234"
+		}
+
+		notifier, err := newNotifier(cfg, spec, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.kind, err)
+		}
+		if err := notifier.Notify(n); err != nil {
+			t.Fatalf("%s: Notify: %v", tt.kind, err)
+		}
+		if len(*requests) != 1 {
+			t.Fatalf("%s: %d requests, want 1", tt.kind, len(*requests))
+		}
+		got := (*requests)[0]
+		if got.Method != http.MethodPost || got.Path != tt.path || got.ContentType != "application/json" {
+			t.Errorf("%s: %s %s (%s), want POST %s (application/json)", tt.kind, got.Method, got.Path, got.ContentType, tt.path)
+		}
+		if !reflect.DeepEqual(got.Body, tt.want) {
+			t.Errorf("%s: body = %#v, want %#v", tt.kind, got.Body, tt.want)
+		}
+	}
+}
+
+func TestNotifierCodeOnly(t *testing.T) {
+	server, requests := newNotifyStub(t, http.StatusOK)
+	cfg := &Config{}
+	n := newNotification(cfg, Account{NotifyCodeOnly: true}, InboundMessage{To: "a@example.com", From: "x@y.test", Subject: "s", Code: "9876"})
+
+	notifier, _ := newNotifier(cfg, "slack:"+server.URL, nil)
+	if err := notifier.Notify(n); err != nil {
+		t.Fatal(err)
+	}
+	if text := (*requests)[0].Body["text"]; text != "9876" {
+		t.Errorf("text = %q, want only the code", text)
+	}
+}
+
+func TestNotifierErrorStatus(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusInternalServerError} {
+		server, _ := newNotifyStub(t, status)
+		cfg := &Config{TelegramAPIURL: server.URL, TelegramBotToken: "t"}
+		for _, spec := range []string{"telegram:1", "slack:" + server.URL, "discord:" + server.URL, "json:" + server.URL} {
+			notifier, err := newNotifier(cfg, spec, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = notifier.Notify(testNotification())
+			if err == nil || !strings.Contains(err.Error(), http.StatusText(status)) {
+				t.Errorf("%s with status %d: err = %v, want the status reported", spec, status, err)
+			}
+		}
+	}
+}
+
+func TestParseNotifySpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"telegram:-1001234", true},
+		{"slack:https://hooks.slack.com/services/T0/B0", true},
+		{"discord:http://127.0.0.1:9000/hook", true},
+		{"json:http://example.com/hook", false},
+		{"teams:https://example.com", false},
+		{"telegram:", false},
+		{"slack", false},
+	}
+	for _, tt := range tests {
+		if _, _, err := parseNotifySpec(tt.spec); (err == nil) != tt.ok {
+			t.Errorf("parseNotifySpec(%q) = %v, want ok=%v", tt.spec, err, tt.ok)
+		}
+	}
+}
+
+func TestNotificationSnippet(t *testing.T) {
+	cfg := &Config{NotifySnippetLength: 5, PublicURL: "https://mail.example.com/"}
+	n := newNotification(cfg, Account{}, InboundMessage{LogID: 3, Body: "Hello\n  wonderful world"})
+	if n.Snippet != "Hello..." {
+		t.Errorf("snippet = %q", n.Snippet)
+	}
+	if n.Link != "https://mail.example.com/logs?id=3" {
+		t.Errorf("link = %q", n.Link)
+	}
+}
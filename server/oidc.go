@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcPurpose      = "oidc"
+	oidcStateCookie  = "mg_oidc"
+	oidcStateTTL     = 10 * time.Minute
+	oidcKeysMinAge   = time.Minute // Unknown key ids refetch the JWKS at most this often
+	oidcCallbackPath = "/api/auth/oidc/callback"
+)
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider caches the discovery document and signing keys of the issuer
+type oidcProvider struct {
+	mu        sync.Mutex
+	issuer    string // Issuer the cached document and keys belong to
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	keysAt    time.Time
+}
+
+var oidc = &oidcProvider{}
+
+func oidcEnabled(cfg *Config) bool {
+	return cfg.OIDCIssuer != "" && cfg.OIDCClientID != ""
+}
+
+func oidcRedirectURL(cfg *Config) string {
+	if cfg.OIDCRedirectURL != "" {
+		return cfg.OIDCRedirectURL
+	}
+	return strings.TrimSuffix(cfg.PublicURL, "/") + oidcCallbackPath
+}
+
+func fetchJSON(u string, v interface{}) error {
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover loads the provider metadata once per issuer. A configuration
+// with another issuer starts over with its own document and keys.
+func (p *oidcProvider) discover(cfg *Config) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.issuer != cfg.OIDCIssuer {
+		p.issuer = cfg.OIDCIssuer
+		p.discovery = nil
+		p.keys = nil
+		p.keysAt = time.Time{}
+	}
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := fetchJSON(cfg.OIDCIssuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != cfg.OIDCIssuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// key returns the RSA signing key with the id, refreshing the key set when
+// the provider rotated its keys
+func (p *oidcProvider) key(cfg *Config, kid string) (*rsa.PublicKey, error) {
+	d, err := p.discover(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.issuer != cfg.OIDCIssuer {
+		return nil, errors.New("identity provider changed, start the login again")
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysAt) < oidcKeysMinAge {
+		return nil, errors.New("unknown signing key")
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := fetchJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keysAt = time.Now()
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown signing key")
+}
+
+// oidcLogin is the state of a login in progress, kept in a signed cookie
+// so that the callback can only complete logins started by this browser
+type oidcLogin struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// startOIDCLogin returns the provider's authorization url and the signed
+// state cookie value
+func startOIDCLogin(cfg *Config) (string, string, error) {
+	if !strings.HasPrefix(oidcRedirectURL(cfg), "http") {
+		return "", "", errors.New("set PUBLIC_URL or OIDC_REDIRECT_URL")
+	}
+	d, err := oidc.discover(cfg)
+	if err != nil {
+		return "", "", err
+	}
+	login := oidcLogin{State: randomHex(32), Nonce: randomHex(32), Verifier: randomHex(64)}
+
+	cookie, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":      cfg.JWTIssuer,
+		"aud":      cfg.JWTAudience,
+		"purpose":  oidcPurpose,
+		"state":    login.State,
+		"nonce":    login.Nonce,
+		"verifier": login.Verifier,
+		"exp":      time.Now().Add(oidcStateTTL).Unix(),
+	}).SignedString([]byte(cfg.JWTSecret))
+	if err != nil {
+		return "", "", err
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", cfg.OIDCClientID)
+	v.Set("redirect_uri", oidcRedirectURL(cfg))
+	v.Set("scope", cfg.OIDCScopes)
+	v.Set("state", login.State)
+	v.Set("nonce", login.Nonce)
+	v.Set("code_challenge", pkceChallenge(login.Verifier))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), cookie, nil
+}
+
+// parseOIDCLogin reads the state cookie and checks it belongs to the callback
+func parseOIDCLogin(cfg *Config, cookie string, state string) (*oidcLogin, error) {
+	claims, err := parseJWT(cfg, cookie)
+	if err != nil || claims["purpose"] != oidcPurpose {
+		return nil, errors.New("login expired, please try again")
+	}
+	login := &oidcLogin{}
+	login.State, _ = claims["state"].(string)
+	login.Nonce, _ = claims["nonce"].(string)
+	login.Verifier, _ = claims["verifier"].(string)
+	if login.State == "" || login.State != state {
+		return nil, errors.New("state mismatch, please try again")
+	}
+	return login, nil
+}
+
+// exchangeOIDCCode redeems the authorization code for an ID token
+func exchangeOIDCCode(cfg *Config, code string, verifier string) (string, error) {
+	d, err := oidc.discover(cfg)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", oidcRedirectURL(cfg))
+	form.Set("client_id", cfg.OIDCClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.OIDCClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.OIDCClientID), url.QueryEscape(cfg.OIDCClientSecret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: %s %s", body.Error, body.ErrorDescription)
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the signature and claims of an ID token
+func verifyIDToken(cfg *Config, raw string, nonce string) (jwt.MapClaims, error) {
+	d, err := oidc.discover(cfg)
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return oidc.key(cfg, kid)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(cfg.OIDCClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return nil, errors.New("invalid id token: nonce mismatch")
+	}
+	return claims, nil
+}
+
+// claimStrings reads a string or string list claim
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var result []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+var rolePrivilege = map[string]int{RoleReadOnly: 1, RoleOwner: 2, RoleOperator: 3, RoleAdmin: 4}
+
+// oidcRole maps the groups of a user to the most privileged local role,
+// OIDC_DEFAULT_ROLE when none match
+func oidcRole(cfg *Config, groups []string) string {
+	member := map[string]bool{}
+	for _, g := range groups {
+		member[g] = true
+	}
+	role := cfg.OIDCDefaultRole
+	for _, pair := range splitTargets(cfg.OIDCRoleMapping) {
+		group, mapped, ok := strings.Cut(pair, "=")
+		mapped = strings.TrimSpace(mapped)
+		if !ok || !validRoles[mapped] || !member[strings.TrimSpace(group)] {
+			continue
+		}
+		if rolePrivilege[mapped] > rolePrivilege[role] {
+			role = mapped
+		}
+	}
+	return role
+}
+
+// oidcUser finds or creates the local user of a verified ID token. The
+// role follows the provider's groups on every login.
+func oidcUser(cfg *Config, claims jwt.MapClaims) (*User, error) {
+	sub, _ := claims.GetSubject()
+	if sub == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	subject := cfg.OIDCIssuer + "|" + sub
+	role := oidcRole(cfg, claimStrings(claims, cfg.OIDCGroupsClaim))
+
+	var user User
+	if err := DB.Where("sso_subject = ?", subject).First(&user).Error; err == nil {
+		if !user.IsEnabled() {
+			return nil, errors.New("user is disabled")
+		}
+		if role == "" {
+			return nil, errors.New("you are not in a group that may use this application")
+		}
+		if role != user.Role {
+			if isLastAdmin(&user) {
+				log.Printf("[OIDC] Keeping %s admin, it is the last one", user.Username)
+			} else if err := DB.Model(&user).Update("role", role).Error; err != nil {
+				return nil, err
+			}
+		}
+		return &user, nil
+	}
+
+	if role == "" {
+		return nil, errors.New("you are not in a group that may use this application")
+	}
+	username := ""
+	for _, claim := range []string{cfg.OIDCUsernameClaim, "email"} {
+		if v, _ := claims[claim].(string); v != "" {
+			username = v
+			break
+		}
+	}
+	if username == "" {
+		username = sub
+	}
+
+	// Local accounts are never taken over by a provider user of the same name
+	user = User{Username: username, Role: role, SSOSubject: subject}
+	if err := validateUser(&user); err != nil {
+		return nil, err
+	}
+	var count int64
+	DB.Model(&User{}).Where("username = ?", user.Username).Count(&count)
+	if count > 0 {
+		return nil, fmt.Errorf("username %q is already used by a local account", user.Username)
+	}
+	if err := DB.Create(&user).Error; err != nil {
+		return nil, err
+	}
+	log.Printf("[OIDC] Created user %s with role %s", user.Username, user.Role)
+	return &user, nil
+}
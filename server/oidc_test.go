@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIssuer is a minimal OpenID provider serving discovery, JWKS and the
+// token endpoint. Codes are registered by the test together with the PKCE
+// challenge and the claims of the ID token to return.
+type mockIssuer struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]mockCode
+}
+
+type mockCode struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, codes: map[string]mockCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "test", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.mu.Lock()
+		code, ok := m.codes[r.PostForm.Get("code")]
+		delete(m.codes, r.PostForm.Get("code"))
+		m.mu.Unlock()
+		if !ok || r.PostForm.Get("grant_type") != "authorization_code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		if pkceChallenge(r.PostForm.Get("code_verifier")) != code.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(t, code.claims, m.key)})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// claims returns valid ID token claims for the subject and groups, in the
+// form they have after JSON decoding
+func (m *mockIssuer) claims(sub string, nonce string, groups ...string) jwt.MapClaims {
+	list := make([]interface{}, len(groups))
+	for i, g := range groups {
+		list[i] = g
+	}
+	return jwt.MapClaims{
+		"iss":                m.URL,
+		"aud":                "mail-generator",
+		"sub":                sub,
+		"nonce":              nonce,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"preferred_username": sub,
+		"groups":             list,
+	}
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims jwt.MapClaims, key *rsa.PrivateKey) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// authorize plays the provider's login page: it registers a code for the
+// PKCE challenge of the authorization url
+func (m *mockIssuer) authorize(t *testing.T, authURL string, claims func(nonce string) jwt.MapClaims) (code string, state string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil || !strings.HasPrefix(authURL, m.URL+"/authorize?") {
+		t.Fatalf("authorization url %s", authURL)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" || q.Get("client_id") != "mail-generator" {
+		t.Fatalf("authorization url misses PKCE or client id: %s", authURL)
+	}
+	code = randomHex(16)
+	m.mu.Lock()
+	m.codes[code] = mockCode{challenge: q.Get("code_challenge"), claims: claims(q.Get("nonce"))}
+	m.mu.Unlock()
+	return code, q.Get("state")
+}
+
+func oidcTestConfig(t *testing.T, m *mockIssuer) *Config {
+	cfg := newTestDB(t)
+	cfg.PublicURL = "https://mail.example.com"
+	cfg.OIDCIssuer = m.URL
+	cfg.OIDCClientID = "mail-generator"
+	cfg.OIDCScopes = "openid groups"
+	cfg.OIDCUsernameClaim = "preferred_username"
+	cfg.OIDCGroupsClaim = "groups"
+	cfg.OIDCRoleMapping = "mail-admins=admin,mail-ops=operator,mail-users=readonly"
+	oidc = &oidcProvider{}
+	t.Cleanup(func() { oidc = &oidcProvider{} })
+	return cfg
+}
+
+func TestOIDCLogin(t *testing.T) {
+	m := newMockIssuer(t)
+	cfg := oidcTestConfig(t, m)
+
+	authURL, cookie, err := startOIDCLogin(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := m.authorize(t, authURL, func(nonce string) jwt.MapClaims {
+		return m.claims("carol", nonce, "mail-users", "mail-ops")
+	})
+
+	login, err := parseOIDCLogin(cfg, cookie, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := exchangeOIDCCode(cfg, code, login.Verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := verifyIDToken(cfg, raw, login.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := oidcUser(cfg, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "carol" || user.Role != RoleOperator || user.SSOSubject != m.URL+"|carol" {
+		t.Errorf("user = %+v", user)
+	}
+}
+
+func TestOIDCRejectsWrongVerifier(t *testing.T) {
+	m := newMockIssuer(t)
+	cfg := oidcTestConfig(t, m)
+
+	authURL, _, err := startOIDCLogin(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := m.authorize(t, authURL, func(nonce string) jwt.MapClaims { return m.claims("carol", nonce) })
+	if _, err := exchangeOIDCCode(cfg, code, randomHex(64)); err == nil || !strings.Contains(err.Error(), "PKCE") {
+		t.Errorf("exchange with another verifier: err = %v", err)
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	m := newMockIssuer(t)
+	cfg := oidcTestConfig(t, m)
+
+	_, cookie, err := startOIDCLogin(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseOIDCLogin(cfg, cookie, "forged-state"); err == nil {
+		t.Error("callback with another state was accepted")
+	}
+	if _, err := parseOIDCLogin(cfg, "not-a-cookie", "forged-state"); err == nil {
+		t.Error("callback without a valid cookie was accepted")
+	}
+	challenge, _ := issueChallenge(cfg, &User{ID: 1})
+	if _, err := parseOIDCLogin(cfg, challenge, ""); err == nil {
+		t.Error("a 2fa challenge was accepted as state cookie")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	m := newMockIssuer(t)
+	cfg := oidcTestConfig(t, m)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name   string
+		token  func() string
+		nonce  string
+		wantOK bool
+	}{
+		{"valid", func() string { return m.sign(t, m.claims("u", "n1"), m.key) }, "n1", true},
+		{"nonce mismatch", func() string { return m.sign(t, m.claims("u", "n1"), m.key) }, "n2", false},
+		{"missing nonce", func() string { c := m.claims("u", ""); return m.sign(t, c, m.key) }, "", false},
+		{"other audience", func() string { c := m.claims("u", "n1"); c["aud"] = "someone-else"; return m.sign(t, c, m.key) }, "n1", false},
+		{"other issuer", func() string { c := m.claims("u", "n1"); c["iss"] = "https://evil.test"; return m.sign(t, c, m.key) }, "n1", false},
+		{"expired", func() string {
+			c := m.claims("u", "n1")
+			c["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+			return m.sign(t, c, m.key)
+		}, "n1", false},
+		{"within leeway", func() string {
+			c := m.claims("u", "n1")
+			c["exp"] = time.Now().Add(-30 * time.Second).Unix()
+			return m.sign(t, c, m.key)
+		}, "n1", true},
+		{"no expiry", func() string { c := m.claims("u", "n1"); delete(c, "exp"); return m.sign(t, c, m.key) }, "n1", false},
+		{"wrong key", func() string { return m.sign(t, m.claims("u", "n1"), otherKey) }, "n1", false},
+		{"hmac", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, m.claims("u", "n1"))
+			token.Header["kid"] = "test"
+			s, _ := token.SignedString([]byte(cfg.OIDCClientID))
+			return s
+		}, "n1", false},
+	}
+	for _, tt := range tests {
+		_, err := verifyIDToken(cfg, tt.token(), tt.nonce)
+		if (err == nil) != tt.wantOK {
+			t.Errorf("%s: err = %v, want ok=%v", tt.name, err, tt.wantOK)
+		}
+	}
+}
+
+// A configuration with another issuer does not reuse the cached discovery
+// document or signing keys of the previous one
+func TestOIDCIssuerChange(t *testing.T) {
+	first, second := newMockIssuer(t), newMockIssuer(t)
+	cfg := oidcTestConfig(t, first)
+	if _, err := verifyIDToken(cfg, first.sign(t, first.claims("u", "n1"), first.key), "n1"); err != nil {
+		t.Fatal(err)
+	}
+
+	next := *cfg
+	next.OIDCIssuer = second.URL
+	authURL, _, err := startOIDCLogin(&next)
+	if err != nil || !strings.HasPrefix(authURL, second.URL+"/authorize?") {
+		t.Fatalf("authorization url %s, %v", authURL, err)
+	}
+	if _, err := verifyIDToken(&next, second.sign(t, second.claims("u", "n1"), second.key), "n1"); err != nil {
+		t.Errorf("token of the new issuer: %v", err)
+	}
+	// Both providers use the key id "test", the old key must be gone
+	c := second.claims("u", "n1")
+	if _, err := verifyIDToken(&next, second.sign(t, c, first.key), "n1"); err == nil {
+		t.Error("token signed with the key of the previous issuer was accepted")
+	}
+}
+
+func TestOIDCRole(t *testing.T) {
+	cfg := &Config{OIDCRoleMapping: "mail-admins=admin, mail-ops=operator, mail-users=readonly, broken=superuser"}
+	tests := []struct {
+		groups      []string
+		defaultRole string
+		want        string
+	}{
+		{[]string{"mail-admins"}, "", RoleAdmin},
+		{[]string{"mail-users", "mail-ops"}, "", RoleOperator},
+		{[]string{"mail-users", "mail-admins", "mail-ops"}, "", RoleAdmin},
+		{[]string{"engineering"}, "", ""},
+		{[]string{"engineering"}, RoleReadOnly, RoleReadOnly},
+		{[]string{"mail-users"}, RoleOwner, RoleOwner}, // The default wins when it is more privileged
+		{[]string{"broken"}, "", ""},
+		{nil, "", ""},
+	}
+	for _, tt := range tests {
+		cfg.OIDCDefaultRole = tt.defaultRole
+		if got := oidcRole(cfg, tt.groups); got != tt.want {
+			t.Errorf("oidcRole(%v, default %q) = %q, want %q", tt.groups, tt.defaultRole, got, tt.want)
+		}
+	}
+}
+
+func TestOIDCUserRoles(t *testing.T) {
+	m := newMockIssuer(t)
+	cfg := oidcTestConfig(t, m)
+
+	// An unmapped group without a default role may not log in
+	if _, err := oidcUser(cfg, m.claims("dave", "n", "engineering")); err == nil {
+		t.Error("user without a mapped group was created")
+	}
+
+	user, err := oidcUser(cfg, m.claims("dave", "n", "mail-users"))
+	if err != nil || user.Role != RoleReadOnly {
+		t.Fatalf("first login: %+v, %v", user, err)
+	}
+	// Roles follow the groups on every login
+	if user, err = oidcUser(cfg, m.claims("dave", "n", "mail-admins")); err != nil || user.Role != RoleAdmin {
+		t.Errorf("promotion: %+v, %v", user, err)
+	}
+	if _, err = oidcUser(cfg, m.claims("dave", "n", "engineering")); err == nil {
+		t.Error("user who left all mapped groups could still log in")
+	}
+
+	// A local account of the same name is never taken over
+	createTestUser(t, "erin", RoleAdmin)
+	if _, err := oidcUser(cfg, m.claims("erin", "n", "mail-admins")); err == nil {
+		t.Error("provider user took over the local account erin")
+	}
+}
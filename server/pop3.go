@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	pop3Timeout     = 10 * time.Minute
+	pop3MaxFailures = 3
+	pop3MaxLine     = 512 // Longest command line incl. CRLF, RFC 2449 allows 255 octets
+)
+
+// POP3Session is a single POP3 connection (RFC 1939 with STLS from RFC 2595)
+type POP3Session struct {
+	Config    *Config
+	TLSConfig *tls.Config
+
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	secure bool
+
+	user     string
+	account  *Account
+	messages []Message
+	deleted  map[int]bool
+	failures int
+}
+
+func (s *POP3Session) reply(ok bool, format string, args ...interface{}) {
+	status := "+OK"
+	if !ok {
+		status = "-ERR"
+	}
+	line := status
+	if format != "" {
+		line += " " + fmt.Sprintf(format, args...)
+	}
+	s.writer.WriteString(line + "\r\n")
+	s.writer.Flush()
+}
+
+// writeMultiline sends a dot-stuffed multi-line response body
+func (s *POP3Session) writeMultiline(lines []string) {
+	for _, line := range lines {
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		s.writer.WriteString(line + "\r\n")
+	}
+	s.writer.WriteString(".\r\n")
+	s.writer.Flush()
+}
+
+// message returns the message with the 1-based number unless it is deleted
+func (s *POP3Session) message(arg string) (int, *Message) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(s.messages) || s.deleted[n] {
+		return 0, nil
+	}
+	return n, &s.messages[n-1]
+}
+
+func (s *POP3Session) serve() {
+	defer s.conn.Close()
+	s.reader = bufio.NewReaderSize(s.conn, pop3MaxLine)
+	s.writer = bufio.NewWriter(s.conn)
+	s.reply(true, "mail-generator POP3 server ready")
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(pop3Timeout))
+		// The reader buffers at most one line, longer ones are refused
+		// instead of growing without bound
+		raw, err := s.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			s.reply(false, "line too long")
+			return
+		}
+		if err != nil {
+			return
+		}
+		line := strings.TrimRight(string(raw), "\r\n")
+		cmd, arg, _ := strings.Cut(line, " ")
+		cmd = strings.ToUpper(cmd)
+
+		if s.account == nil {
+			if !s.authorization(cmd, arg) {
+				return
+			}
+		} else if !s.transaction(cmd, arg) {
+			return
+		}
+	}
+}
+
+// allowPlainAuth reports whether passwords may be sent on this connection
+func (s *POP3Session) allowPlainAuth() bool {
+	return s.secure || s.TLSConfig == nil
+}
+
+func (s *POP3Session) capabilities() []string {
+	caps := []string{"TOP", "UIDL", "RESP-CODES", "PIPELINING"}
+	if s.allowPlainAuth() {
+		caps = append(caps, "USER")
+	}
+	if s.TLSConfig != nil && !s.secure {
+		caps = append(caps, "STLS")
+	}
+	return append(caps, "IMPLEMENTATION mail-generator")
+}
+
+// authorization handles a command in the AUTHORIZATION state and reports
+// whether the connection stays open
+func (s *POP3Session) authorization(cmd, arg string) bool {
+	switch cmd {
+	case "CAPA":
+		s.reply(true, "Capability list follows")
+		s.writeMultiline(s.capabilities())
+	case "STLS":
+		if s.TLSConfig == nil || s.secure {
+			s.reply(false, "STLS not available")
+			return true
+		}
+		s.reply(true, "Begin TLS negotiation")
+		tlsConn := tls.Server(s.conn, s.TLSConfig)
+		tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("[POP3] TLS handshake failed: %v", err)
+			return false
+		}
+		tlsConn.SetDeadline(time.Time{})
+		s.conn = tlsConn
+		s.reader = bufio.NewReaderSize(tlsConn, pop3MaxLine)
+		s.writer = bufio.NewWriter(tlsConn)
+		s.secure = true
+		s.user = ""
+	case "USER":
+		if !s.allowPlainAuth() {
+			s.reply(false, "[AUTH] Use STLS first")
+			return true
+		}
+		s.user = arg
+		s.reply(true, "")
+	case "PASS":
+		if s.user == "" {
+			s.reply(false, "USER first")
+			return true
+		}
+		account, err := authenticateMailbox(s.user, arg, remoteIP(s.conn.RemoteAddr()))
+		s.user = ""
+		if err == errMailboxLoginLocked {
+			s.reply(false, "[AUTH] Too many failed logins, try again later")
+			return false
+		}
+		if err != nil {
+			s.failures++
+			log.Printf("[POP3] Failed login from %s", s.conn.RemoteAddr())
+			s.reply(false, "[AUTH] Invalid credentials")
+			return s.failures < pop3MaxFailures
+		}
+		messages, err := mailboxMessages(account.ID)
+		if err != nil {
+			s.reply(false, "[SYS/TEMP] Unable to open mailbox")
+			return false
+		}
+		s.account = account
+		s.messages = messages
+		s.deleted = map[int]bool{}
+		s.reply(true, "Mailbox open, %d messages", len(messages))
+	case "QUIT":
+		s.reply(true, "Bye")
+		return false
+	default:
+		s.reply(false, "Unknown command")
+	}
+	return true
+}
+
+// transaction handles a command in the TRANSACTION state and reports
+// whether the connection stays open
+func (s *POP3Session) transaction(cmd, arg string) bool {
+	switch cmd {
+	case "CAPA":
+		s.reply(true, "Capability list follows")
+		s.writeMultiline(s.capabilities())
+	case "STAT":
+		count, size := 0, 0
+		for i := range s.messages {
+			if !s.deleted[i+1] {
+				count++
+				size += s.messages[i].Size
+			}
+		}
+		s.reply(true, "%d %d", count, size)
+	case "LIST", "UIDL":
+		value := func(n int, m *Message) string {
+			if cmd == "UIDL" {
+				return fmt.Sprintf("%d %d", n, m.UID)
+			}
+			return fmt.Sprintf("%d %d", n, m.Size)
+		}
+		if arg != "" {
+			n, m := s.message(arg)
+			if m == nil {
+				s.reply(false, "No such message")
+				return true
+			}
+			s.reply(true, "%s", value(n, m))
+			return true
+		}
+		var lines []string
+		for i := range s.messages {
+			if !s.deleted[i+1] {
+				lines = append(lines, value(i+1, &s.messages[i]))
+			}
+		}
+		s.reply(true, "")
+		s.writeMultiline(lines)
+	case "RETR", "TOP":
+		num, rest, _ := strings.Cut(arg, " ")
+		_, m := s.message(num)
+		if m == nil {
+			s.reply(false, "No such message")
+			return true
+		}
+		bodyLines := -1
+		if cmd == "TOP" {
+			n, err := strconv.Atoi(strings.TrimSpace(rest))
+			if err != nil || n < 0 {
+				s.reply(false, "Invalid line count")
+				return true
+			}
+			bodyLines = n
+		}
+		raw, err := loadRaw(m.ID)
+		if err != nil {
+			s.reply(false, "[SYS/TEMP] Unable to read message")
+			return true
+		}
+		lines := pop3Lines(raw, bodyLines)
+		s.reply(true, "%d octets", pop3Octets(lines))
+		s.writeMultiline(lines)
+		if cmd == "RETR" && !m.HasFlag(seenFlag) {
+			setFlags(m, append(m.FlagList(), seenFlag))
+		}
+	case "DELE":
+		n, m := s.message(arg)
+		if m == nil {
+			s.reply(false, "No such message")
+			return true
+		}
+		s.deleted[n] = true
+		s.reply(true, "Message %d deleted", n)
+	case "RSET":
+		s.deleted = map[int]bool{}
+		s.reply(true, "")
+	case "NOOP":
+		s.reply(true, "")
+	case "QUIT":
+		var ids []uint
+		for n := range s.deleted {
+			ids = append(ids, s.messages[n-1].ID)
+		}
+		if err := deleteMessages(s.account, ids); err != nil {
+			s.reply(false, "[SYS/TEMP] Some deleted messages not removed")
+			return false
+		}
+		s.reply(true, "Bye")
+		return false
+	default:
+		s.reply(false, "Unknown command")
+	}
+	return true
+}
+
+// pop3Lines splits a message into lines, keeping only bodyLines lines of
+// the body unless it is negative
+func pop3Lines(raw string, bodyLines int) []string {
+	lines := strings.Split(strings.TrimSuffix(toCRLF(raw), "\r\n"), "\r\n")
+	if bodyLines < 0 {
+		return lines
+	}
+	for i, line := range lines {
+		if line == "" {
+			end := i + 1 + bodyLines
+			if end > len(lines) {
+				end = len(lines)
+			}
+			return lines[:end]
+		}
+	}
+	return lines
+}
+
+// pop3Octets counts the bytes writeMultiline sends for the lines, including
+// CRLFs and dot-stuffing but not the terminating dot
+func pop3Octets(lines []string) int {
+	n := 0
+	for _, line := range lines {
+		n += len(line) + 2
+		if strings.HasPrefix(line, ".") {
+			n++
+		}
+	}
+	return n
+}
+
+func StartPOP3Server(cfg *Config) {
+	if cfg.POP3Port == "" {
+		return
+	}
+
+	tlsConfig, err := serverTLSConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificate: %v", err)
+	}
+	if tlsConfig == nil {
+		log.Printf("[POP3] No TLS certificate configured, allowing plain text logins")
+	}
+
+	ln, err := net.Listen("tcp", ":"+cfg.POP3Port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Starting POP3 server on %s", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("[POP3] Accept failed: %v", err)
+			continue
+		}
+		session := &POP3Session{Config: cfg, TLSConfig: tlsConfig, conn: conn}
+		go session.serve()
+	}
+}
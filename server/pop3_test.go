@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startPOP3 serves a POP3 session on one end of a pipe and returns the other
+func startPOP3(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go (&POP3Session{Config: &Config{}, conn: server}).serve()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(client)
+	if greeting, _ := r.ReadString('\n'); !strings.HasPrefix(greeting, "+OK") {
+		t.Fatalf("greeting = %q", greeting)
+	}
+	return client, r
+}
+
+func TestPOP3LineTooLong(t *testing.T) {
+	client, r := startPOP3(t)
+	go client.Write([]byte(strings.Repeat("A", 64*1024)))
+
+	if reply, _ := r.ReadString('\n'); reply != "-ERR line too long\r\n" {
+		t.Errorf("reply = %q", reply)
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Errorf("connection still open after an overlong line: %v", err)
+	}
+}
+
+func TestPOP3Capabilities(t *testing.T) {
+	client, r := startPOP3(t)
+	client.Write([]byte("CAPA\r\n"))
+
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == ".\r\n" {
+			break
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	got := strings.Join(lines, "|")
+	// Without TLS plain USER/PASS is allowed and STLS is not offered
+	if !strings.Contains(got, "|USER|") || strings.Contains(got, "STLS") {
+		t.Errorf("capabilities = %s", got)
+	}
+}
+
+// readMultiline reads a multi-line response and returns its size in octets
+// without the terminating dot
+func readMultiline(t *testing.T, r *bufio.Reader) int {
+	t.Helper()
+	n := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == ".\r\n" {
+			return n
+		}
+		n += len(line)
+	}
+}
+
+func TestPOP3Octets(t *testing.T) {
+	newTestDB(t)
+	account := Account{Pattern: "^box@example\\.com$", ForwardTo: "local"}
+	DB.Create(&account)
+	if err := setMailboxCredentials(&account, "box", "box-password"); err != nil {
+		t.Fatal(err)
+	}
+	// Bare LF line endings and a line starting with a dot make the bytes
+	// sent differ from the stored size
+	raw := "From: a@shop.test\nSubject: hi\n\nfirst\n.dotted\nlast\n"
+	appendMessage(&Message{AccountID: account.ID, Mailbox: defaultMailbox, Size: len(raw), Raw: raw})
+
+	client, r := startPOP3(t)
+	for _, cmd := range []string{"USER box", "PASS box-password"} {
+		client.Write([]byte(cmd + "\r\n"))
+		if reply, _ := r.ReadString('\n'); !strings.HasPrefix(reply, "+OK") {
+			t.Fatalf("%s: %q", cmd, reply)
+		}
+	}
+
+	tests := []struct {
+		cmd  string
+		want int
+	}{
+		{"RETR 1", len("From: a@shop.test\r\nSubject: hi\r\n\r\nfirst\r\n..dotted\r\nlast\r\n")},
+		{"TOP 1 0", len("From: a@shop.test\r\nSubject: hi\r\n\r\n")},
+		{"TOP 1 2", len("From: a@shop.test\r\nSubject: hi\r\n\r\nfirst\r\n..dotted\r\n")},
+	}
+	for _, tt := range tests {
+		client.Write([]byte(tt.cmd + "\r\n"))
+		reply, _ := r.ReadString('\n')
+		var announced int
+		if _, err := fmt.Sscanf(reply, "+OK %d octets", &announced); err != nil {
+			t.Fatalf("%s: %q", tt.cmd, reply)
+		}
+		if sent := readMultiline(t, r); announced != tt.want || sent != tt.want {
+			t.Errorf("%s: announced %d octets, sent %d, want %d", tt.cmd, announced, sent, tt.want)
+		}
+	}
+}
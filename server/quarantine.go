@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// quarantineMessage stores the full raw message of an undeliverable mail
+func quarantineMessage(l Log, rule Account, raw string, reason string) error {
+	q := Quarantine{
+		LogID:     l.ID,
+		AccountID: rule.ID,
+		From:      l.From,
+		To:        l.To,
+		Subject:   l.Subject,
+		Raw:       raw,
+		Reason:    reason,
+	}
+	return DB.Create(&q).Error
+}
+
+// releaseQuarantine re-runs delivery of a quarantined message through the
+// forwarding path. The item is removed once at least one target accepted it.
+func releaseQuarantine(cfg *Config, q *Quarantine) (string, string, error) {
+	var rule Account
+	if err := DB.First(&rule, q.AccountID).Error; err != nil {
+		acc := matchAccount(q.To)
+		if acc == nil {
+			return "", "", errors.New("no account matches the recipient anymore")
+		}
+		rule = *acc
+	}
+
+	msg := InboundMessage{
+		LogID:    q.LogID,
+		From:     q.From,
+		To:       q.To,
+		Subject:  q.Subject,
+		Body:     extractTextBody(q.Raw),
+		Raw:      q.Raw,
+		Received: q.CreatedAt,
+	}
+	msg.Code, msg.Link = extractVerification(msg.Body)
+	status, errMsg := deliverMessage(cfg, rule, msg)
+
+	if q.LogID != 0 {
+		DB.Model(&Log{}).Where("id = ?", q.LogID).Updates(map[string]interface{}{
+			"status": status,
+			"error":  errMsg,
+		})
+		var l Log
+		if DB.Omit("raw").First(&l, q.LogID).Error == nil {
+			publishLog(eventLogUpdated, &l)
+		}
+	}
+
+	if status == "failed" {
+		DB.Model(q).Updates(map[string]interface{}{
+			"reason":   errMsg,
+			"attempts": q.Attempts + 1,
+		})
+		return status, errMsg, nil
+	}
+
+	return status, errMsg, DB.Delete(q).Error
+}
+
+// StartQuarantineDigest periodically mails the admin a list of quarantined items
+func StartQuarantineDigest(cfg *Config) {
+	if cfg.QuarantineDigestInterval <= 0 || cfg.AdminEmail == "" {
+		return
+	}
+
+	log.Printf("Quarantine digest enabled, sending to %s every %s", cfg.AdminEmail, cfg.QuarantineDigestInterval)
+	ticker := time.NewTicker(cfg.QuarantineDigestInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := sendQuarantineDigest(currentConfig()); err != nil {
+			log.Printf("Failed to send quarantine digest: %v", err)
+		}
+	}
+}
+
+func sendQuarantineDigest(cfg *Config) error {
+	var total int64
+	DB.Model(&Quarantine{}).Count(&total)
+	if total == 0 {
+		return nil
+	}
+
+	var items []Quarantine
+	if err := DB.Omit("raw").Order("created_at desc").Limit(100).Find(&items).Error; err != nil {
+		return err
+	}
+
+	var body strings.Builder
+	body.WriteString(fmt.Sprintf("%d message(s) are currently quarantined.\r\n\r\n", total))
+	for _, q := range items {
+		body.WriteString(fmt.Sprintf("#%d  %s\r\n", q.ID, q.CreatedAt.Format(time.RFC3339)))
+		body.WriteString(fmt.Sprintf("  From:    %s\r\n", q.From))
+		body.WriteString(fmt.Sprintf("  To:      %s\r\n", q.To))
+		body.WriteString(fmt.Sprintf("  Subject: %s\r\n", q.Subject))
+		body.WriteString(fmt.Sprintf("  Reason:  %s\r\n\r\n", q.Reason))
+	}
+	if total > int64(len(items)) {
+		body.WriteString(fmt.Sprintf("...and %d more.\r\n", total-int64(len(items))))
+	}
+
+	return sendSystemMail(cfg, cfg.AdminEmail, fmt.Sprintf("[mail-generator] %d quarantined message(s)", total), body.String())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReleaseQuarantine(t *testing.T) {
+	cfg := newTestDB(t)
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError)
+	rule := Account{Pattern: "^shop@example\\.com$", ForwardTo: receiver.URL}
+	DB.Create(&rule)
+	in := testInboundMessage()
+	l := Log{AccountID: rule.ID, From: in.From, To: in.To, Subject: in.Subject, Status: "quarantined"}
+	DB.Create(&l)
+	if err := quarantineMessage(l, rule, in.Raw, "target down"); err != nil {
+		t.Fatal(err)
+	}
+	var q Quarantine
+	DB.First(&q)
+
+	// The target still fails, the item stays with the new reason
+	status, errMsg, err := releaseQuarantine(cfg, &q)
+	if err != nil || status != "failed" || errMsg == "" {
+		t.Fatalf("failing release: %s %q %v", status, errMsg, err)
+	}
+	DB.First(&q, q.ID)
+	if q.Attempts != 2 || q.Reason != errMsg {
+		t.Errorf("after a failed release: attempts %d, reason %q", q.Attempts, q.Reason)
+	}
+	DB.First(&l, l.ID)
+	if l.Status != "failed" {
+		t.Errorf("log status %s", l.Status)
+	}
+
+	// Once the target accepts it, the message is re-delivered and released
+	receiver.status = http.StatusOK
+	status, _, err = releaseQuarantine(cfg, &q)
+	if err != nil || status != "success" {
+		t.Fatalf("release: %s %v", status, err)
+	}
+	if hits := receiver.hits.Load(); hits != 2 {
+		t.Errorf("receiver hit %d times", hits)
+	}
+	if !strings.Contains(string(receiver.body), `"code":"123456"`) {
+		t.Errorf("re-delivered payload %s", receiver.body)
+	}
+	var count int64
+	DB.Model(&Quarantine{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d items left in quarantine", count)
+	}
+	DB.First(&l, l.ID)
+	if l.Status != "success" || l.Error != "" {
+		t.Errorf("log %s %q", l.Status, l.Error)
+	}
+}
+
+// A deleted account is replaced by the one that matches the recipient now
+func TestReleaseQuarantineDeletedAccount(t *testing.T) {
+	cfg := newTestDB(t)
+	in := testInboundMessage()
+	q := Quarantine{AccountID: 99, From: in.From, To: in.To, Raw: in.Raw}
+	DB.Create(&q)
+
+	if _, _, err := releaseQuarantine(cfg, &q); err == nil {
+		t.Error("released without a matching account")
+	}
+
+	receiver := newWebhookReceiver(t, http.StatusOK)
+	DB.Create(&Account{Pattern: "^.*@example\\.com$", ForwardTo: receiver.URL})
+	if status, _, err := releaseQuarantine(cfg, &q); err != nil || status != "success" {
+		t.Fatalf("release: %s %v", status, err)
+	}
+	if receiver.hits.Load() != 1 {
+		t.Error("the matching account did not receive the message")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// configPollInterval is how often CONFIG_FILE is checked for changes
+const configPollInterval = 5 * time.Second
+
+// reloadableSettings are the Config fields a reload applies to the running
+// server. Everything else needs a restart.
+var reloadableSettings = []string{
+	"SMTPRelayHost", "SMTPRelayPort", "SMTPRelayUser", "SMTPRelayPass", "DefaultEnvelope",
+	"RateLimit", "RateBurst", "LoginMaxFailures", "LoginMaxIPFailures", "LoginLockout",
+	"TLSCertFile", "TLSKeyFile",
+}
+
+// configs holds the current configuration. SMTP sessions take a copy when
+// they start, so a reload never changes a message in flight.
+var configs atomic.Pointer[Config]
+
+func currentConfig() *Config {
+	return configs.Load()
+}
+
+// applyLimits hands the rate and login limits to the limiters
+func applyLimits(cfg *Config) {
+	globalLimiter.SetLimits(rate.Limit(cfg.RateLimit), cfg.RateBurst)
+	loginGuard.SetLimits(cfg.LoginMaxFailures, cfg.LoginMaxIPFailures, cfg.LoginLockout)
+}
+
+// reloadConfig reads the configuration again and applies the reloadable
+// settings, runtime settings from the database still take precedence. An
+// invalid configuration keeps the running one.
+func reloadConfig() {
+	loaded, err := LoadConfig()
+	if err != nil {
+		log.Printf("[Config] Reload failed, keeping the running configuration: %v", err)
+		return
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	old := currentConfig()
+	next := *old
+	src, dst, prev := reflect.ValueOf(loaded).Elem(), reflect.ValueOf(&next).Elem(), reflect.ValueOf(old).Elem()
+	reloadable := map[string]bool{}
+	for _, name := range reloadableSettings {
+		reloadable[name] = true
+		dst.FieldByName(name).Set(src.FieldByName(name))
+	}
+	for i := 0; i < src.NumField(); i++ {
+		name := src.Type().Field(i).Name
+		if !reloadable[name] && !reflect.DeepEqual(src.Field(i).Interface(), prev.Field(i).Interface()) {
+			log.Printf("[Config] %s changed, restart to apply it", name)
+		}
+	}
+
+	next = *applySettings(&next, loaded)
+
+	if next.TLSCertFile != "" {
+		if err := certificates.Load(next.TLSCertFile, next.TLSKeyFile); err != nil {
+			log.Printf("[Config] Reload failed, keeping the running configuration: %v", err)
+			return
+		}
+	}
+	configBase = loaded
+	configs.Store(&next)
+	applyLimits(&next)
+	log.Printf("[Config] Reloaded")
+}
+
+// WatchConfig reloads the configuration on SIGHUP and when CONFIG_FILE
+// changes
+func WatchConfig(cfg *Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var ticks <-chan time.Time
+	var modified time.Time
+	if cfg.ConfigFile != "" {
+		if info, err := os.Stat(cfg.ConfigFile); err == nil {
+			modified = info.ModTime()
+		}
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+			log.Printf("[Config] SIGHUP received")
+			reloadConfig()
+		case <-ticks:
+			info, err := os.Stat(cfg.ConfigFile)
+			if err != nil || info.ModTime().Equal(modified) {
+				continue
+			}
+			modified = info.ModTime()
+			log.Printf("[Config] %s changed", cfg.ConfigFile)
+			reloadConfig()
+		}
+	}
+}
+
+// certStore holds the TLS certificate so that it can be replaced without
+// restarting the listeners
+type certStore struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+var certificates = &certStore{}
+
+func (s *certStore) Load(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.cert = &cert
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// allowedTags are rendered as-is, anything else is unwrapped to its children
+var allowedTags = map[atom.Atom]bool{
+	atom.A: true, atom.Abbr: true, atom.B: true, atom.Blockquote: true, atom.Br: true,
+	atom.Caption: true, atom.Center: true, atom.Code: true, atom.Col: true, atom.Colgroup: true,
+	atom.Dd: true, atom.Del: true, atom.Div: true, atom.Dl: true, atom.Dt: true, atom.Em: true,
+	atom.Font: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true,
+	atom.H6: true, atom.Hr: true, atom.I: true, atom.Img: true, atom.Ins: true, atom.Li: true,
+	atom.Ol: true, atom.P: true, atom.Pre: true, atom.Q: true, atom.S: true, atom.Small: true,
+	atom.Span: true, atom.Strike: true, atom.Strong: true, atom.Sub: true, atom.Sup: true,
+	atom.Table: true, atom.Tbody: true, atom.Td: true, atom.Tfoot: true, atom.Th: true,
+	atom.Thead: true, atom.Tr: true, atom.U: true, atom.Ul: true,
+}
+
+// droppedTags are removed together with their content
+var droppedTags = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Iframe: true, atom.Frame: true, atom.Frameset: true,
+	atom.Object: true, atom.Embed: true, atom.Applet: true, atom.Form: true, atom.Input: true,
+	atom.Button: true, atom.Select: true, atom.Textarea: true, atom.Title: true, atom.Head: true,
+	atom.Meta: true, atom.Link: true, atom.Base: true, atom.Svg: true, atom.Math: true,
+	atom.Template: true, atom.Noscript: true,
+}
+
+var allowedAttrs = map[string]bool{
+	"href": true, "src": true, "alt": true, "title": true, "width": true, "height": true,
+	"align": true, "valign": true, "colspan": true, "rowspan": true, "border": true,
+	"cellpadding": true, "cellspacing": true, "bgcolor": true, "color": true, "size": true,
+	"face": true, "dir": true, "lang": true,
+}
+
+// sanitizeHTML keeps the formatting of an html mail body and removes
+// scripts, styles, event handlers and unsafe urls. Remote images are
+// dropped unless allowRemote is set, inline cid: images are kept.
+func sanitizeHTML(s string, allowRemote bool) string {
+	nodes, err := html.ParseFragment(strings.NewReader(s), &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div})
+	if err != nil {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		for _, clean := range sanitizeNode(n, allowRemote) {
+			html.Render(&buf, clean)
+		}
+	}
+	return buf.String()
+}
+
+// sanitizeNode returns the safe replacement nodes for n
+func sanitizeNode(n *html.Node, allowRemote bool) []*html.Node {
+	switch n.Type {
+	case html.TextNode:
+		return []*html.Node{{Type: html.TextNode, Data: n.Data}}
+	case html.ElementNode, html.DocumentNode:
+	default:
+		return nil
+	}
+	if droppedTags[n.DataAtom] {
+		return nil
+	}
+
+	var children []*html.Node
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		children = append(children, sanitizeNode(c, allowRemote)...)
+	}
+	if n.Type != html.ElementNode || !allowedTags[n.DataAtom] {
+		return children
+	}
+
+	clean := &html.Node{Type: html.ElementNode, Data: n.Data, DataAtom: n.DataAtom}
+	for _, attr := range n.Attr {
+		key := strings.ToLower(attr.Key)
+		if attr.Namespace != "" || !allowedAttrs[key] {
+			continue
+		}
+		if key == "href" && !safeURL(attr.Val, "http:", "https:", "mailto:") {
+			continue
+		}
+		if key == "src" {
+			schemes := []string{"cid:", "data:image/"}
+			if allowRemote {
+				schemes = append(schemes, "http:", "https:")
+			}
+			if n.DataAtom != atom.Img || !safeURL(attr.Val, schemes...) {
+				continue
+			}
+		}
+		clean.Attr = append(clean.Attr, html.Attribute{Key: key, Val: attr.Val})
+	}
+	if n.DataAtom == atom.Img && !hasAttr(clean, "src") {
+		return nil
+	}
+	if n.DataAtom == atom.A {
+		clean.Attr = append(clean.Attr,
+			html.Attribute{Key: "target", Val: "_blank"},
+			html.Attribute{Key: "rel", Val: "noopener noreferrer"})
+	}
+	for _, c := range children {
+		clean.AppendChild(c)
+	}
+	return []*html.Node{clean}
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// safeURL reports whether the url starts with one of the schemes
+func safeURL(u string, schemes ...string) bool {
+	u = strings.ToLower(strings.TrimSpace(u))
+	for _, scheme := range schemes {
+		if strings.HasPrefix(u, scheme) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          string
+		allowRemote bool
+		want        string
+	}{
+		{"formatting", `<p>Hi <b>there</b><br>bye</p>`, false, `<p>Hi <b>there</b><br/>bye</p>`},
+		{"script", `<p>a</p><script>alert(1)</script>b`, false, `<p>a</p>b`},
+		{"script in case", `<SCRIPT>alert(1)</SCRIPT>ok`, false, `ok`},
+		{"style", `<style>body{display:none}</style><p style="color:red">x</p>`, false, `<p>x</p>`},
+		{"event handlers", `<img src="cid:logo" onerror="alert(1)" ONLOAD="x()"><div onclick="x()">d</div>`, false, `<img src="cid:logo"/><div>d</div>`},
+		{"unknown tags unwrapped", `<article><blink>text</blink></article>`, false, `text`},
+		{"iframe", `<iframe src="https://evil.test"></iframe>after`, false, `after`},
+		{"form", `<form action="https://evil.test"><input name="p"><button>go</button></form>x`, false, `x`},
+		{"svg", `<svg onload="alert(1)"><script>alert(2)</script><a href="https://x.test">l</a></svg>x`, false, `x`},
+		{"math", `<math><mtext><img src=x onerror=alert(1)></mtext></math>x`, false, `x`},
+		{"comment", `<!-- <script>x</script> -->a`, false, `a`},
+		{"link", `<a href="https://shop.test/verify?t=1&amp;u=2">go</a>`, false,
+			`<a href="https://shop.test/verify?t=1&amp;u=2" target="_blank" rel="noopener noreferrer">go</a>`},
+		{"mailto", `<a href="mailto:help@shop.test">help</a>`, false,
+			`<a href="mailto:help@shop.test" target="_blank" rel="noopener noreferrer">help</a>`},
+		{"link target replaced", `<a href="https://x.test" target="_self" rel="opener">x</a>`, false,
+			`<a href="https://x.test" target="_blank" rel="noopener noreferrer">x</a>`},
+		{"javascript href", `<a href="javascript:alert(1)">x</a>`, false, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"javascript href, case", `<a href="JaVaScRiPt:alert(1)">x</a>`, false, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"javascript href, spaces", `<a href="  javascript:alert(1)">x</a>`, false, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"javascript href, tab", "<a href=\"java\tscript:alert(1)\">x</a>", false, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"javascript href, newline", "<a href=\"\njavascript:alert(1)\">x</a>", false, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"javascript href, entities", `<a href="&#106;avascript:alert(1)">x</a>`, false, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"vbscript href", `<a href="vbscript:msgbox(1)">x</a>`, false, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"data href", `<a href="data:text/html,<script>alert(1)</script>">x</a>`, false, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"remote image blocked", `<img src="https://tracker.test/p.gif" alt="p">`, false, ``},
+		{"remote image allowed", `<img src="https://tracker.test/p.gif" alt="p">`, true, `<img src="https://tracker.test/p.gif" alt="p"/>`},
+		{"inline image", `<img src="cid:part1@shop.test">`, false, `<img src="cid:part1@shop.test"/>`},
+		{"data image", `<img src="data:image/png;base64,iVBORw0KGgo=">`, false, `<img src="data:image/png;base64,iVBORw0KGgo="/>`},
+		{"data html image", `<img src="data:text/html;base64,PHNjcmlwdD4=">`, true, ``},
+		{"javascript image", `<img src="javascript:alert(1)">`, true, ``},
+		{"src outside img", `<p src="cid:x">p</p>`, false, `<p>p</p>`},
+		{"text is escaped", `&lt;script&gt;alert(1)&lt;/script&gt;`, false, `&lt;script&gt;alert(1)&lt;/script&gt;`},
+		{"namespaced attribute", `<a xlink:href="javascript:alert(1)">x</a>`, false, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+	}
+	for _, tt := range tests {
+		if got := sanitizeHTML(tt.in, tt.allowRemote); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Whatever goes in, nothing that can run script comes out
+func TestSanitizeHTMLNoScript(t *testing.T) {
+	inputs := []string{
+		`<scr<script>ipt>alert(1)</script>`,
+		`<img src=x onerror=alert(1)//`,
+		`<a href="javascript&colon;alert(1)">x</a>`,
+		`<div><svg><style><img src=x onerror=alert(1)></style></svg></div>`,
+		`<table><td background="javascript:alert(1)">x</td></table>`,
+		`<body onload="alert(1)">x</body>`,
+		`<object data="javascript:alert(1)"></object>`,
+		`<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`,
+		`<base href="javascript:/">`,
+		`<noscript><p title="</noscript><img src=x onerror=alert(1)>"></noscript>`,
+	}
+	for _, in := range inputs {
+		out := strings.ToLower(sanitizeHTML(in, true))
+		for _, bad := range []string{"<script", "javascript:", "onerror", "onload", "<svg", "<object", "<meta", "<base", "<style"} {
+			if strings.Contains(out, bad) {
+				t.Errorf("sanitizeHTML(%q) = %q contains %q", in, out, bad)
+			}
+		}
+	}
+}
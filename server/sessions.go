@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errInvalidRefreshToken = errors.New("invalid or expired refresh token")
+
+func hashRefreshToken(token string) string {
+	return hashAPIToken(token)
+}
+
+// createSession starts a login session and returns its refresh token,
+// which is only shown once
+func createSession(cfg *Config, user *User, userAgent string, ip string) (*LoginSession, string, error) {
+	now := time.Now()
+	plain := randomHex(64)
+	s := LoginSession{
+		UserID:      user.ID,
+		RefreshHash: hashRefreshToken(plain),
+		UserAgent:   userAgent,
+		IP:          ip,
+		ExpiresAt:   now.Add(cfg.RefreshTokenTTL),
+		LastUsedAt:  now,
+	}
+	if err := DB.Create(&s).Error; err != nil {
+		return nil, "", err
+	}
+
+	// Expired sessions are useless, forget them while we are here
+	DB.Where("expires_at < ?", now).Delete(&LoginSession{})
+	return &s, plain, nil
+}
+
+// rotateSession exchanges a refresh token for a new one. Presenting a token
+// that was already rotated out means it leaked, the session is revoked.
+func rotateSession(cfg *Config, plain string, ip string) (*LoginSession, *User, string, error) {
+	hash := hashRefreshToken(plain)
+	var s LoginSession
+	if DB.Where("refresh_hash = ?", hash).First(&s).Error != nil {
+		if DB.Where("previous_hash = ? AND revoked_at IS NULL", hash).First(&s).Error == nil {
+			revokeSession(&s)
+		}
+		return nil, nil, "", errInvalidRefreshToken
+	}
+	now := time.Now()
+	if s.RevokedAt != nil || !now.Before(s.ExpiresAt) {
+		return nil, nil, "", errInvalidRefreshToken
+	}
+	var user User
+	if DB.First(&user, s.UserID).Error != nil || !user.IsEnabled() {
+		return nil, nil, "", errInvalidRefreshToken
+	}
+
+	next := randomHex(64)
+	result := DB.Model(&LoginSession{}).Where("id = ? AND refresh_hash = ?", s.ID, hash).Updates(map[string]interface{}{
+		"refresh_hash":  hashRefreshToken(next),
+		"previous_hash": hash,
+		"ip":            ip,
+		"expires_at":    now.Add(cfg.RefreshTokenTTL),
+		"last_used_at":  now,
+	})
+	// A concurrent refresh with the same token won the race
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, nil, "", errInvalidRefreshToken
+	}
+	return &s, &user, next, nil
+}
+
+// activeSession loads a session that access tokens may still use
+func activeSession(id uint, userID uint) (*LoginSession, error) {
+	var s LoginSession
+	if DB.Where("id = ? AND user_id = ?", id, userID).First(&s).Error != nil {
+		return nil, errors.New("unknown session")
+	}
+	if s.RevokedAt != nil || !time.Now().Before(s.ExpiresAt) {
+		return nil, errors.New("session ended")
+	}
+	return &s, nil
+}
+
+func revokeSession(s *LoginSession) error {
+	now := time.Now()
+	s.RevokedAt = &now
+	return DB.Model(&LoginSession{}).Where("id = ? AND revoked_at IS NULL", s.ID).Update("revoked_at", &now).Error
+}
+
+// revokeUserSessions signs a user out everywhere except the kept session
+func revokeUserSessions(tx *gorm.DB, userID uint, keep uint) error {
+	return tx.Model(&LoginSession{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, keep).
+		Update("revoked_at", time.Now()).Error
+}
+
+// currentSession is the login session of the request, nil for API tokens
+func currentSession(c *gin.Context) *LoginSession {
+	if v, ok := c.Get("session"); ok {
+		return v.(*LoginSession)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRotateSession(t *testing.T) {
+	cfg := newTestDB(t)
+	user := createTestUser(t, "alice", RoleOperator)
+	session, first, err := createSession(cfg, user, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, got, second, err := rotateSession(cfg, first, "10.0.0.1")
+	if err != nil || got.ID != user.ID || second == first {
+		t.Fatalf("rotation: user %v, %v", got, err)
+	}
+	var stored LoginSession
+	DB.First(&stored, session.ID)
+	if stored.RefreshHash == hashRefreshToken(first) || stored.RefreshHash == second || stored.IP != "10.0.0.1" {
+		t.Errorf("stored session %+v", stored)
+	}
+
+	_, _, third, err := rotateSession(cfg, second, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotated-out token shows up again: it leaked, end the session
+	if _, _, _, err := rotateSession(cfg, second, "192.0.2.1"); err == nil {
+		t.Fatal("rotated-out token was accepted")
+	}
+	if _, err := activeSession(session.ID, user.ID); err == nil {
+		t.Error("session survived the reuse of a refresh token")
+	}
+	if _, _, _, err := rotateSession(cfg, third, "10.0.0.1"); err == nil {
+		t.Error("current token of a revoked session was accepted")
+	}
+}
+
+func TestRotateSessionRejects(t *testing.T) {
+	cfg := newTestDB(t)
+	user := createTestUser(t, "alice", RoleOperator)
+
+	expired, expiredPlain, _ := createSession(cfg, user, "test", "")
+	revoked, revokedPlain, _ := createSession(cfg, user, "test", "")
+	revokeSession(revoked)
+	disabled := createTestUser(t, "bob", RoleOperator)
+	_, disabledPlain, _ := createSession(cfg, disabled, "test", "")
+	DB.Model(disabled).Update("enabled", false)
+	// Last, creating a session deletes expired ones
+	DB.Model(expired).Update("expires_at", time.Now().Add(-time.Minute))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"unknown", randomHex(64)},
+		{"expired", expiredPlain},
+		{"revoked", revokedPlain},
+		{"disabled user", disabledPlain},
+	}
+	for _, tt := range tests {
+		if _, _, _, err := rotateSession(cfg, tt.token, ""); err != errInvalidRefreshToken {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestRevokeUserSessions(t *testing.T) {
+	cfg := newTestDB(t)
+	alice := createTestUser(t, "alice", RoleOperator)
+	bob := createTestUser(t, "bob", RoleOperator)
+	keep, _, _ := createSession(cfg, alice, "laptop", "")
+	other, _, _ := createSession(cfg, alice, "phone", "")
+	bobs, _, _ := createSession(cfg, bob, "laptop", "")
+
+	if err := revokeUserSessions(DB, alice.ID, keep.ID); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		session *LoginSession
+		user    *User
+		active  bool
+	}{
+		{keep, alice, true},
+		{other, alice, false},
+		{bobs, bob, true},
+	}
+	for _, tt := range tests {
+		if _, err := activeSession(tt.session.ID, tt.user.ID); (err == nil) != tt.active {
+			t.Errorf("session %s of %s: active = %v, want %v", tt.session.UserAgent, tt.user.Username, err == nil, tt.active)
+		}
+	}
+	// A session id only counts for its own user
+	if _, err := activeSession(bobs.ID, alice.ID); err == nil {
+		t.Error("alice used bob's session")
+	}
+}
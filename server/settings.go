@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// runtimeSetting is a Config field that admins may override from the API
+type runtimeSetting struct {
+	Key    string
+	Field  string
+	Secret bool // Never returned by the API and encrypted at rest
+}
+
+var runtimeSettings = []runtimeSetting{
+	{Key: "smtp_relay_host", Field: "SMTPRelayHost"},
+	{Key: "smtp_relay_port", Field: "SMTPRelayPort"},
+	{Key: "smtp_relay_user", Field: "SMTPRelayUser"},
+	{Key: "smtp_relay_pass", Field: "SMTPRelayPass", Secret: true},
+	{Key: "default_envelope", Field: "DefaultEnvelope"},
+}
+
+func findRuntimeSetting(key string) (runtimeSetting, bool) {
+	for _, s := range runtimeSettings {
+		if s.Key == key {
+			return s, true
+		}
+	}
+	return runtimeSetting{}, false
+}
+
+// validateSetting checks a value before it is stored
+func validateSetting(key string, value string) error {
+	switch key {
+	case "smtp_relay_port":
+		if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+			return errors.New("smtp_relay_port must be a port number")
+		}
+	case "default_envelope":
+		if !strings.Contains(value, "@") {
+			return errors.New("default_envelope must be an email address")
+		}
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("%s must be a single line", key)
+	}
+	return nil
+}
+
+// settingsCipher seals secret settings with AES-256-GCM. The key is
+// SETTINGS_KEY or, when that is not set, derived from JWT_SECRET.
+func settingsCipher(cfg *Config) (cipher.AEAD, error) {
+	secret := cfg.SettingsKey
+	if secret == "" {
+		secret = "settings:" + cfg.JWTSecret
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSetting encrypts a secret, the key is bound as additional data so a
+// value cannot be moved to another setting
+func sealSetting(cfg *Config, key string, plain string) (string, error) {
+	aead, err := settingsCipher(cfg)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(key))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openSetting(cfg *Config, key string, value string) (string, error) {
+	aead, err := settingsCipher(cfg)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed secret")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return "", errors.New("cannot decrypt, was SETTINGS_KEY or JWT_SECRET changed?")
+	}
+	return string(plain), nil
+}
+
+// configMu serializes reloads and settings changes, configBase is the
+// configuration from the environment and CONFIG_FILE without overrides
+var (
+	configMu   sync.Mutex
+	configBase *Config
+)
+
+// applySettings returns cfg with the runtime settings of base replaced by
+// the values stored in the database
+func applySettings(cfg *Config, base *Config) *Config {
+	next := *cfg
+	dst, src := reflect.ValueOf(&next).Elem(), reflect.ValueOf(base).Elem()
+	for _, s := range runtimeSettings {
+		dst.FieldByName(s.Field).Set(src.FieldByName(s.Field))
+	}
+
+	var rows []Setting
+	if err := DB.Find(&rows).Error; err != nil {
+		log.Printf("[Settings] Failed to load: %v", err)
+		return &next
+	}
+	for _, row := range rows {
+		s, ok := findRuntimeSetting(row.Key)
+		if !ok {
+			continue
+		}
+		value := row.Value
+		if s.Secret {
+			var err error
+			if value, err = openSetting(&next, row.Key, row.Value); err != nil {
+				log.Printf("[Settings] Ignoring %s: %v", row.Key, err)
+				continue
+			}
+		}
+		dst.FieldByName(s.Field).SetString(value)
+	}
+	return &next
+}
+
+// refreshSettings makes stored settings take effect
+func refreshSettings() {
+	configMu.Lock()
+	defer configMu.Unlock()
+	configs.Store(applySettings(currentConfig(), configBase))
+}
+
+// settingsView lists the runtime settings for the API, secrets only say
+// whether they are set
+func settingsView(cfg *Config) map[string]interface{} {
+	v := reflect.ValueOf(cfg).Elem()
+	view := make(map[string]interface{}, len(runtimeSettings))
+	for _, s := range runtimeSettings {
+		value := v.FieldByName(s.Field).String()
+		if s.Secret {
+			view[s.Key] = value != ""
+		} else {
+			view[s.Key] = value
+		}
+	}
+	return view
+}
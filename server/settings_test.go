@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSealSetting(t *testing.T) {
+	cfg := testConfig()
+	sealed, err := sealSetting(cfg, "smtp_relay_pass", "hunter22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "hunter22") {
+		t.Fatal("secret stored in clear text")
+	}
+	again, _ := sealSetting(cfg, "smtp_relay_pass", "hunter22")
+	if again == sealed {
+		t.Error("sealing the same value twice gave the same ciphertext")
+	}
+	if plain, err := openSetting(cfg, "smtp_relay_pass", sealed); err != nil || plain != "hunter22" {
+		t.Errorf("openSetting = %q, %v", plain, err)
+	}
+
+	other := testConfig()
+	other.JWTSecret = "another-secret-0123456789abcdef0123"
+	withKey := testConfig()
+	withKey.SettingsKey = "explicit-settings-key"
+	tests := []struct {
+		name  string
+		cfg   *Config
+		key   string
+		value string
+	}{
+		{"other JWT secret", other, "smtp_relay_pass", sealed},
+		{"explicit settings key", withKey, "smtp_relay_pass", sealed},
+		{"moved to another setting", cfg, "smtp_relay_user", sealed},
+		{"tampered", cfg, "smtp_relay_pass", sealed[:len(sealed)-4] + "AAAA"},
+		{"not base64", cfg, "smtp_relay_pass", "%%%"},
+		{"too short", cfg, "smtp_relay_pass", "AAAA"},
+	}
+	for _, tt := range tests {
+		if _, err := openSetting(tt.cfg, tt.key, tt.value); err == nil {
+			t.Errorf("%s: secret was decrypted", tt.name)
+		}
+	}
+}
+
+func TestValidateSetting(t *testing.T) {
+	tests := []struct {
+		key, value string
+		ok         bool
+	}{
+		{"smtp_relay_port", "587", true},
+		{"smtp_relay_port", "0", false},
+		{"smtp_relay_port", "", false},
+		{"default_envelope", "postmaster@example.com", true},
+		{"default_envelope", "postmaster", false},
+		{"smtp_relay_host", "", true},
+		{"smtp_relay_user", "me@example.com\r\nRCPT TO:<x@y>", false},
+	}
+	for _, tt := range tests {
+		if err := validateSetting(tt.key, tt.value); (err == nil) != tt.ok {
+			t.Errorf("validateSetting(%q, %q) = %v, want ok=%v", tt.key, tt.value, err, tt.ok)
+		}
+	}
+}
+
+// mockRelay is an SMTP server that records the AUTH commands it receives
+type mockRelay struct {
+	net.Listener
+	mu    sync.Mutex
+	auths []string
+}
+
+func newMockRelay(t *testing.T) *mockRelay {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockRelay{Listener: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *mockRelay) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("220 mock\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			conn.Write([]byte("250-mock\r\n250 AUTH PLAIN\r\n"))
+		case strings.HasPrefix(cmd, "AUTH"):
+			m.mu.Lock()
+			m.auths = append(m.auths, strings.TrimSpace(line))
+			m.mu.Unlock()
+			conn.Write([]byte("235 ok\r\n"))
+		case strings.HasPrefix(cmd, "QUIT"):
+			conn.Write([]byte("221 bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("250 ok\r\n"))
+		}
+	}
+}
+
+// seen returns the AUTH commands received so far
+func (m *mockRelay) seen() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.auths...)
+}
+
+func (m *mockRelay) port() string {
+	_, port, _ := net.SplitHostPort(m.Addr().String())
+	return port
+}
+
+func settingsRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	var admin User
+	DB.Where("username = ?", "admin").First(&admin)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("user", &admin) })
+	r.GET("/api/settings", GetSettings)
+	r.PUT("/api/settings", UpdateSettings)
+	r.POST("/api/settings/relay/test", TestRelay)
+	return r
+}
+
+func settingsRequest(r *gin.Engine, method string, path string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestSettingsAPI(t *testing.T) {
+	cfg := newTestDB(t)
+	configBase = cfg
+	r := settingsRouter(t)
+
+	w := settingsRequest(r, http.MethodPut, "/api/settings", `{"smtp_relay_host":"127.0.0.1","smtp_relay_pass":"hunter22"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "hunter22") {
+		t.Error("PUT response contains the secret")
+	}
+	if currentConfig().SMTPRelayHost != "127.0.0.1" || currentConfig().SMTPRelayPass != "hunter22" {
+		t.Errorf("settings not applied: %+v", currentConfig())
+	}
+	var row Setting
+	DB.First(&row, "key = ?", "smtp_relay_pass")
+	if row.Value == "" || strings.Contains(row.Value, "hunter22") || row.UpdatedBy != "admin" {
+		t.Errorf("stored secret = %+v", row)
+	}
+
+	w = settingsRequest(r, http.MethodGet, "/api/settings", "")
+	var got struct {
+		Settings []map[string]interface{} `json:"settings"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	for _, s := range got.Settings {
+		if s["key"] == "smtp_relay_pass" {
+			if _, ok := s["value"]; ok || s["set"] != true {
+				t.Errorf("GET shows the secret: %v", s)
+			}
+		}
+	}
+
+	for _, body := range []string{`{"smtp_relay_port":"abc"}`, `{"jwt_secret":"x"}`} {
+		if w := settingsRequest(r, http.MethodPut, "/api/settings", body); w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: status %d", body, w.Code)
+		}
+	}
+
+	// null removes the override, the configured value applies again
+	settingsRequest(r, http.MethodPut, "/api/settings", `{"smtp_relay_host":null,"smtp_relay_pass":null}`)
+	if currentConfig().SMTPRelayHost != "" || currentConfig().SMTPRelayPass != "" {
+		t.Errorf("override not removed: %+v", currentConfig())
+	}
+}
+
+func TestRelayTestKeepsPasswordAtSavedRelay(t *testing.T) {
+	cfg := newTestDB(t)
+	configBase = cfg
+	r := settingsRouter(t)
+	saved, attacker := newMockRelay(t), newMockRelay(t)
+
+	body := `{"smtp_relay_host":"127.0.0.1","smtp_relay_port":"` + saved.port() + `","smtp_relay_user":"u","smtp_relay_pass":"pw"}`
+	if w := settingsRequest(r, http.MethodPut, "/api/settings", body); w.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	// The saved relay gets the stored password
+	if w := settingsRequest(r, http.MethodPost, "/api/settings/relay/test", ""); w.Code != http.StatusOK {
+		t.Fatalf("test saved relay: %d %s", w.Code, w.Body)
+	}
+	if auths := saved.seen(); len(auths) != 1 || auths[0] != "AUTH PLAIN AHUAcHc=" {
+		t.Errorf("saved relay AUTH = %v", auths)
+	}
+
+	// Any other host, port or user needs the password in the request
+	for _, body := range []string{
+		`{"smtp_relay_port":"` + attacker.port() + `"}`,
+		`{"smtp_relay_host":"localhost"}`,
+		`{"smtp_relay_user":"other"}`,
+	} {
+		if w := settingsRequest(r, http.MethodPost, "/api/settings/relay/test", body); w.Code != http.StatusBadRequest {
+			t.Errorf("test %s: status %d", body, w.Code)
+		}
+	}
+	if auths := attacker.seen(); len(auths) != 0 {
+		t.Errorf("the stored password reached another relay: %v", auths)
+	}
+
+	body = `{"smtp_relay_port":"` + attacker.port() + `","smtp_relay_pass":"typed"}`
+	if w := settingsRequest(r, http.MethodPost, "/api/settings/relay/test", body); w.Code != http.StatusOK {
+		t.Fatalf("test with a typed password: %d %s", w.Code, w.Body)
+	}
+	if auths := attacker.seen(); len(auths) != 1 || auths[0] != "AUTH PLAIN AHUAdHlwZWQ=" {
+		t.Errorf("other relay AUTH = %v", auths)
+	}
+}
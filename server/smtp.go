@@ -23,12 +23,12 @@ import (
 	"golang.org/x/text/transform"
 )
 
-type Backend struct {
-	Config *Config
-}
+type Backend struct{}
 
+// NewSession starts with the configuration of the moment, a reload does
+// not affect sessions that are already open
 func (b *Backend) NewSession(c *gosmtp.Conn) (gosmtp.Session, error) {
-	return &Session{Config: b.Config}, nil
+	return &Session{Config: currentConfig()}, nil
 }
 
 type Session struct {
@@ -36,6 +36,7 @@ type Session struct {
 	From   string
 	To     string
 	Rule   *Account
+	Drop   string // Reason for silently discarding the message, if any
 }
 
 func (s *Session) AuthPlain(username, password string) error {
@@ -43,6 +44,10 @@ func (s *Session) AuthPlain(username, password string) error {
 }
 
 func (s *Session) Mail(from string, opts *gosmtp.MailOptions) error {
+	if f := checkSender(nil, from); f != nil {
+		recordRejection(f, 0, from, "")
+		return errSenderRejected
+	}
 	s.From = from
 	return nil
 }
@@ -53,19 +58,56 @@ func (s *Session) Rcpt(to string, opts *gosmtp.RcptOptions) error {
 		return errors.New("invalid address")
 	}
 
+	if acc := matchAccount(to); acc != nil {
+		if reason := acc.InactiveReason(time.Now()); reason != "" {
+			if inactiveAction(s.Config, acc) == "drop" {
+				s.To = to
+				s.Rule = acc
+				s.Drop = reason
+				return nil
+			}
+			recordInactive(acc, "rejected", reason, s.From, to, "")
+			return errAliasInactive
+		}
+		if f := checkSender(&acc.ID, s.From); f != nil {
+			recordRejection(f, acc.ID, s.From, to)
+			return errSenderRejected
+		}
+		s.To = to
+		s.Rule = acc
+		return nil
+	}
+
+	return errors.New("no relay allowed")
+}
+
+// matchAccount returns the account routing the address. Exact aliases take
+// precedence over wildcard patterns, otherwise the first match wins. Only
+// accounts of the owner of the recipient domain are considered, so tenants
+// never receive each other's mail.
+func matchAccount(to string) *Account {
+	query := DB.Where("owner_id IS NULL")
+	if owner := domainOwner(to); owner != nil {
+		query = DB.Where("owner_id = ?", *owner)
+	}
 	var accounts []Account
-	DB.Find(&accounts)
+	query.Find(&accounts)
 
-	for _, acc := range accounts {
+	var fallback *Account
+	for i := range accounts {
+		acc := &accounts[i]
 		matched, err := regexp.MatchString(acc.Pattern, to)
-		if err == nil && matched {
-			s.To = to
-			s.Rule = &acc
-			return nil
+		if err != nil || !matched {
+			continue
+		}
+		if isLiteralPattern(acc.Pattern) {
+			return acc
+		}
+		if fallback == nil {
+			fallback = acc
 		}
 	}
-
-	return errors.New("no relay allowed")
+	return fallback
 }
 
 func (s *Session) Data(r io.Reader) error {
@@ -82,85 +124,173 @@ func (s *Session) Data(r io.Reader) error {
 
 	// Parse the email
 	subject := extractSubject(rawData)
-	textBody := extractTextBody(rawData)
 
 	// Decode subject if encoded
 	decodedSubject := decodeRFC2047(subject)
 
+	if s.Drop == "" && !consumeMessageQuota(s.Rule) {
+		s.Drop = "used up"
+		if inactiveAction(s.Config, s.Rule) == "reject" {
+			recordInactive(s.Rule, "rejected", s.Drop, s.From, s.To, decodedSubject)
+			return errAliasInactive
+		}
+	}
+	if s.Drop != "" {
+		recordInactive(s.Rule, "dropped", s.Drop, s.From, s.To, decodedSubject)
+		return nil
+	}
+
+	textBody := extractTextBody(rawData)
+
 	// Limit content length for DB
 	contentToLog := textBody
 	if len(contentToLog) > 10000 {
 		contentToLog = contentToLog[:10000] + "...(truncated)"
 	}
 
+	code, link := extractVerification(textBody)
+
 	logEntry := Log{
+		AccountID: s.Rule.ID,
+		OwnerID:   s.Rule.OwnerID,
 		From:      s.From,
 		To:        s.To,
 		Subject:   decodedSubject,
 		Content:   contentToLog,
 		Status:    "processing",
 		ClientIP:  "",
+		Alert:     checkLeak(s.Config, s.Rule, s.From),
+		Code:      code,
+		Link:      link,
 		CreatedAt: time.Now(),
 	}
 	DB.Create(&logEntry)
+	publishLog(eventLogCreated, &logEntry)
 
-	// Forward asynchronously
-	go func(l Log, rule Account, originalFrom string, decodedSubj string, body string, cfg *Config) {
-		// Split multiple recipients
-		recipients := strings.Split(rule.ForwardTo, ",")
-		var allErrors []string
-		successCount := 0
-
-		for _, rcpt := range recipients {
-			rcpt = strings.TrimSpace(rcpt)
-			if rcpt == "" {
-				continue
-			}
-
-			var err error
-			if cfg.SMTPRelayHost != "" {
-				err = forwardEmailViaRelay(cfg, rcpt, originalFrom, decodedSubj, body)
-			} else {
-				err = forwardEmailDirectly(cfg, rcpt, originalFrom, decodedSubj, body)
-			}
-
-			if err != nil {
-				log.Printf("Failed to forward email to %s: %v", rcpt, err)
-				allErrors = append(allErrors, fmt.Sprintf("%s: %v", rcpt, err))
-			} else {
-				log.Printf("Successfully forwarded email to %s", rcpt)
-				successCount++
-			}
-		}
+	msg := InboundMessage{
+		LogID:    logEntry.ID,
+		From:     s.From,
+		To:       s.To,
+		Subject:  decodedSubject,
+		Body:     textBody,
+		Raw:      rawData,
+		Code:     code,
+		Link:     link,
+		Received: logEntry.CreatedAt,
+	}
 
-		status := "success"
-		errMsg := ""
-		if len(allErrors) > 0 {
-			if successCount == 0 {
-				status = "failed"
+	// Forward asynchronously
+	go func(l Log, rule Account, msg InboundMessage, cfg *Config) {
+		status, errMsg := deliverMessage(cfg, rule, msg)
+		if status == "failed" {
+			if err := quarantineMessage(l, rule, msg.Raw, errMsg); err != nil {
+				log.Printf("Failed to quarantine message %d: %v", l.ID, err)
 			} else {
-				status = "partial"
+				status = "quarantined"
 			}
-			errMsg = strings.Join(allErrors, "; ")
 		}
 
 		DB.Model(&l).Updates(map[string]interface{}{
 			"status": status,
 			"error":  errMsg,
 		})
+		l.Status, l.Error = status, errMsg
+		publishLog(eventLogUpdated, &l)
 
-		DB.Model(&rule).Update("hit_count", rule.HitCount+1)
-	}(logEntry, *s.Rule, s.From, decodedSubject, textBody, s.Config)
+		if status == "success" || status == "partial" {
+			recordFirstSender(&rule, msg.From)
+		}
+	}(logEntry, *s.Rule, msg, s.Config)
 
 	return nil
 }
 
-func (s *Session) Reset() {}
+func (s *Session) Reset() {
+	s.From = ""
+	s.To = ""
+	s.Rule = nil
+	s.Drop = ""
+}
 
 func (s *Session) Logout() error {
 	return nil
 }
 
+// InboundMessage carries a received mail through the delivery path
+type InboundMessage struct {
+	LogID    uint
+	From     string // Envelope sender
+	To       string // Alias the mail was addressed to
+	Subject  string // Decoded subject
+	Body     string // Decoded text body
+	Raw      string // Full raw RFC822 content
+	Code     string // Extracted one-time code
+	Link     string // Extracted verification link
+	Received time.Time
+}
+
+// deliverMessage forwards a message to every target of the rule and
+// reports the aggregated status ("success", "partial" or "failed").
+func deliverMessage(cfg *Config, rule Account, msg InboundMessage) (string, string) {
+	// Split multiple recipients, filling in capture groups of the pattern
+	recipients := expandForwardTargets(rule, msg.To)
+	var allErrors []string
+	successCount := 0
+
+	for _, rcpt := range recipients {
+		var err error
+		if isWebhookTarget(rcpt) {
+			err = deliverWebhook(cfg, rule, msg, rcpt)
+		} else if isLocalTarget(rcpt) {
+			err = storeLocal(rule, msg)
+		} else if strings.Index(rcpt, "@") <= 0 {
+			err = errors.New("invalid forward target")
+		} else {
+			err = forwardEmail(cfg, rule, msg, rcpt)
+		}
+
+		if err != nil {
+			log.Printf("Failed to forward email to %s: %v", rcpt, err)
+			allErrors = append(allErrors, fmt.Sprintf("%s: %v", rcpt, err))
+		} else {
+			log.Printf("Successfully forwarded email to %s", rcpt)
+			successCount++
+		}
+	}
+
+	// Chat notifications count as delivery targets as well
+	if targets := splitTargets(rule.Notify); len(targets) > 0 {
+		n := newNotification(cfg, rule, msg)
+		for _, spec := range targets {
+			notifier, err := newNotifier(cfg, spec, rule.OwnerID)
+			if err == nil {
+				err = notifier.Notify(n)
+			}
+
+			kind, _, _ := strings.Cut(spec, ":")
+			if err != nil {
+				log.Printf("Failed to notify %s: %v", kind, err)
+				allErrors = append(allErrors, fmt.Sprintf("notify %s: %v", kind, err))
+			} else {
+				log.Printf("Successfully notified %s", kind)
+				successCount++
+			}
+		}
+	}
+
+	status := "success"
+	errMsg := ""
+	if len(allErrors) > 0 {
+		if successCount == 0 {
+			status = "failed"
+		} else {
+			status = "partial"
+		}
+		errMsg = strings.Join(allErrors, "; ")
+	}
+	return status, errMsg
+}
+
 // decodeRFC2047 decodes RFC 2047 encoded-word (e.g. =?gb2312?B?...?=)
 func decodeRFC2047(s string) string {
 	dec := new(mime.WordDecoder)
@@ -376,52 +506,51 @@ func stripHTML(s string) string {
 	return strings.TrimSpace(result)
 }
 
-// forwardEmailViaRelay sends email using a configured SMTP relay (e.g. 163.com)
-func forwardEmailViaRelay(cfg *Config, to string, originalFrom string, subject string, textBody string) error {
-	addr := net.JoinHostPort(cfg.SMTPRelayHost, cfg.SMTPRelayPort)
+// forwardEmail renders the rule's templates and sends the result to one target
+func forwardEmail(cfg *Config, rule Account, msg InboundMessage, to string) error {
+	envelopeFrom := envelopeSender(cfg)
+	fullMsg, err := buildForwardMessage(envelopeFrom, to, rule, msg)
+	if err != nil {
+		return err
+	}
 
-	envelopeFrom := cfg.SMTPRelayUser
-	if envelopeFrom == "" {
-		envelopeFrom = cfg.DefaultEnvelope
+	if cfg.SMTPRelayHost != "" {
+		return sendViaRelay(cfg, envelopeFrom, to, fullMsg)
 	}
+	return sendDirect(cfg, to, fullMsg)
+}
 
-	// Build a clean, simple email
-	newSubject := fmt.Sprintf("[Fwd: %s] %s", originalFrom, subject)
-	if len(newSubject) > 78 { // RFC 2822 recommends max 78 chars for Subject
-		newSubject = newSubject[:75] + "..."
+// envelopeSender returns the MAIL FROM address used for outgoing mail
+func envelopeSender(cfg *Config) string {
+	if cfg.SMTPRelayHost != "" && cfg.SMTPRelayUser != "" {
+		return cfg.SMTPRelayUser
 	}
+	return cfg.DefaultEnvelope
+}
 
-	var fullMsg bytes.Buffer
-	fullMsg.WriteString(fmt.Sprintf("From: %s\r\n", envelopeFrom))
-	fullMsg.WriteString(fmt.Sprintf("To: %s\r\n", to))
-	fullMsg.WriteString(fmt.Sprintf("Subject: %s\r\n", newSubject))
-	fullMsg.WriteString("MIME-Version: 1.0\r\n")
-	fullMsg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
-	fullMsg.WriteString("Content-Transfer-Encoding: 8bit\r\n")
-	fullMsg.WriteString("\r\n")
-	fullMsg.WriteString(fmt.Sprintf("Original Sender: %s\r\n", originalFrom))
-	fullMsg.WriteString(fmt.Sprintf("Original Subject: %s\r\n", subject))
-	fullMsg.WriteString("---\r\n\r\n")
-	fullMsg.WriteString(textBody)
+// dialRelay connects to the configured SMTP relay and gets it ready to
+// send: EHLO, STARTTLS when offered and AUTH when credentials are set
+func dialRelay(cfg *Config) (*smtp.Client, error) {
+	addr := net.JoinHostPort(cfg.SMTPRelayHost, cfg.SMTPRelayPort)
 
 	// Use low-level SMTP client for better control and debugging
 	log.Printf("[Relay] Connecting to %s...", addr)
 
 	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
 	if err != nil {
-		return fmt.Errorf("dial failed: %v", err)
+		return nil, fmt.Errorf("dial failed: %v", err)
 	}
 
 	c, err := smtp.NewClient(conn, cfg.SMTPRelayHost)
 	if err != nil {
 		conn.Close()
-		return fmt.Errorf("new client failed: %v", err)
+		return nil, fmt.Errorf("new client failed: %v", err)
 	}
-	defer c.Close()
 
 	// Say hello
 	if err := c.Hello("localhost"); err != nil {
-		return fmt.Errorf("HELO failed: %v", err)
+		c.Close()
+		return nil, fmt.Errorf("HELO failed: %v", err)
 	}
 
 	// STARTTLS if available (required by 163.com on port 25)
@@ -441,9 +570,20 @@ func forwardEmailViaRelay(cfg *Config, to string, originalFrom string, subject s
 		log.Printf("[Relay] Authenticating as %s...", cfg.SMTPRelayUser)
 		auth := smtp.PlainAuth("", cfg.SMTPRelayUser, cfg.SMTPRelayPass, cfg.SMTPRelayHost)
 		if err := c.Auth(auth); err != nil {
-			return fmt.Errorf("auth failed: %v", err)
+			c.Close()
+			return nil, fmt.Errorf("auth failed: %v", err)
 		}
 	}
+	return c, nil
+}
+
+// sendViaRelay delivers an already built message using the configured SMTP relay (e.g. 163.com)
+func sendViaRelay(cfg *Config, envelopeFrom string, to string, msgBytes []byte) error {
+	c, err := dialRelay(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
 
 	// MAIL FROM
 	log.Printf("[Relay] MAIL FROM: %s", envelopeFrom)
@@ -471,7 +611,6 @@ func forwardEmailViaRelay(cfg *Config, to string, originalFrom string, subject s
 		return fmt.Errorf("DATA command failed: %v", err)
 	}
 
-	msgBytes := fullMsg.Bytes()
 	log.Printf("[Relay] Writing %d bytes...", len(msgBytes))
 
 	_, err = wc.Write(msgBytes)
@@ -491,8 +630,8 @@ func forwardEmailViaRelay(cfg *Config, to string, originalFrom string, subject s
 	return nil
 }
 
-// forwardEmailDirectly looks up MX records and delivers mail directly
-func forwardEmailDirectly(cfg *Config, to string, originalFrom string, subject string, textBody string) error {
+// sendDirect looks up MX records and delivers an already built message directly
+func sendDirect(cfg *Config, to string, msgBytes []byte) error {
 	parts := strings.Split(to, "@")
 	if len(parts) != 2 {
 		return errors.New("invalid to address")
@@ -511,25 +650,6 @@ func forwardEmailDirectly(cfg *Config, to string, originalFrom string, subject s
 		return mxs[i].Pref < mxs[j].Pref
 	})
 
-	// Build message
-	newSubject := fmt.Sprintf("[Fwd: %s] %s", originalFrom, subject)
-	if len(newSubject) > 200 {
-		newSubject = newSubject[:197] + "..."
-	}
-
-	var fullMsg bytes.Buffer
-	fullMsg.WriteString(fmt.Sprintf("From: %s\r\n", cfg.DefaultEnvelope))
-	fullMsg.WriteString(fmt.Sprintf("To: %s\r\n", to))
-	fullMsg.WriteString(fmt.Sprintf("Subject: %s\r\n", newSubject))
-	fullMsg.WriteString("MIME-Version: 1.0\r\n")
-	fullMsg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
-	fullMsg.WriteString("\r\n")
-
-	fullMsg.WriteString(fmt.Sprintf("Original Sender: %s\r\n", originalFrom))
-	fullMsg.WriteString(fmt.Sprintf("Subject: %s\r\n", subject))
-	fullMsg.WriteString("---\r\n\r\n")
-	fullMsg.WriteString(textBody)
-
 	var lastErr error
 	for _, mx := range mxs {
 		address := net.JoinHostPort(strings.TrimSuffix(mx.Host, "."), "25")
@@ -568,7 +688,7 @@ func forwardEmailDirectly(cfg *Config, to string, originalFrom string, subject s
 			continue
 		}
 
-		_, err = wc.Write(fullMsg.Bytes())
+		_, err = wc.Write(msgBytes)
 		if err != nil {
 			lastErr = err
 			wc.Close()
@@ -593,8 +713,28 @@ func forwardEmailDirectly(cfg *Config, to string, originalFrom string, subject s
 	return errors.New("delivery failed")
 }
 
+// sendSystemMail sends a notification generated by the server itself (digests, alerts)
+func sendSystemMail(cfg *Config, to string, subject string, textBody string) error {
+	envelopeFrom := envelopeSender(cfg)
+
+	var fullMsg bytes.Buffer
+	fullMsg.WriteString(fmt.Sprintf("From: %s\r\n", envelopeFrom))
+	fullMsg.WriteString(fmt.Sprintf("To: %s\r\n", to))
+	fullMsg.WriteString(fmt.Sprintf("Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", subject)))
+	fullMsg.WriteString("MIME-Version: 1.0\r\n")
+	fullMsg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	fullMsg.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	fullMsg.WriteString("\r\n")
+	fullMsg.WriteString(textBody)
+
+	if cfg.SMTPRelayHost != "" {
+		return sendViaRelay(cfg, envelopeFrom, to, fullMsg.Bytes())
+	}
+	return sendDirect(cfg, to, fullMsg.Bytes())
+}
+
 func StartSMTPServer(cfg *Config) {
-	be := &Backend{Config: cfg}
+	be := &Backend{}
 	s := gosmtp.NewServer(be)
 	s.Addr = ":" + cfg.SMTPPort
 	s.Domain = "localhost"
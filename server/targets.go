@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matches $1, ${1}, $name, ${name} and the $$ escape in forward targets
+var targetRefRe = regexp.MustCompile(`\$(\$|\{[^}]*\}|[A-Za-z0-9_]+)`)
+
+// splitTargets returns the non-empty entries of a comma separated target list
+func splitTargets(list string) []string {
+	var targets []string
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// expandForwardTargets substitutes capture groups of the account pattern
+// into its forward targets, e.g. "$1@real.test" for "^(\w+)\.team@corp\.test$".
+// Only mail targets are expanded, the kind of a target is decided by its
+// template so a sender cannot turn an address into a webhook URL or the
+// local mailbox. Expanded values that are not exactly one mailbox are
+// dropped.
+func expandForwardTargets(rule Account, alias string) []string {
+	targets := splitTargets(rule.ForwardTo)
+	if !strings.Contains(rule.ForwardTo, "$") {
+		return targets
+	}
+
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return targets
+	}
+	match := re.FindStringSubmatchIndex(alias)
+
+	expanded := make([]string, 0, len(targets))
+	for _, t := range targets {
+		if !strings.Contains(t, "$") || isWebhookTarget(t) || isLocalTarget(t) {
+			expanded = append(expanded, t)
+			continue
+		}
+		if match == nil {
+			log.Printf("Dropping forward target %s: %s does not match the pattern", t, alias)
+			continue
+		}
+		address := string(re.ExpandString(nil, t, alias, match))
+		if !isSingleMailbox(address) {
+			log.Printf("Dropping forward target %q expanded from %s for %s: not a single mailbox", address, t, alias)
+			continue
+		}
+		expanded = append(expanded, address)
+	}
+	return expanded
+}
+
+// isSingleMailbox reports whether s is one bare address. Quoted local parts
+// may hold ',', '/' and ':', which would split into several recipients or
+// look like a URL further down, so those are refused.
+func isSingleMailbox(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" || addr.Address != s {
+		return false
+	}
+	at := strings.LastIndex(s, "@")
+	return at > 0 && !strings.ContainsAny(s[:at], ",/:\" \t")
+}
+
+// validateForwardTargets makes sure every capture group referenced by a
+// forward target exists in the account pattern
+func validateForwardTargets(a *Account) error {
+	re, err := regexp.Compile(a.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+
+	names := map[string]bool{}
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			names[name] = true
+		}
+	}
+
+	for _, target := range splitTargets(a.ForwardTo) {
+		if isLocalTarget(target) {
+			continue
+		}
+		if isWebhookTarget(target) {
+			if err := validateWebhookTarget(target); err != nil {
+				return err
+			}
+			if a.OwnerID != nil {
+				if err := validateTenantWebhookTarget(target); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		for _, ref := range targetRefRe.FindAllStringSubmatch(target, -1) {
+			name := ref[1]
+			if name == "$" {
+				continue
+			}
+			braced := strings.HasPrefix(name, "{")
+			name = strings.TrimSuffix(strings.TrimPrefix(name, "{"), "}")
+
+			if n, err := strconv.Atoi(name); err == nil {
+				if n > re.NumSubexp() {
+					return fmt.Errorf("forward target %s references group %d but the pattern only has %d", target, n, re.NumSubexp())
+				}
+				continue
+			}
+			if names[name] {
+				continue
+			}
+			if !braced && name != "" && name[0] >= '0' && name[0] <= '9' {
+				return fmt.Errorf("forward target %s: use ${N} when letters follow a group number", target)
+			}
+			return fmt.Errorf("forward target %s references unknown group %q", target, name)
+		}
+	}
+	return nil
+}
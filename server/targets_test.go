@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandForwardTargets(t *testing.T) {
+	team := Account{Pattern: `^(.+)\.team@corp\.test$`, ForwardTo: "$1@real.test, audit@real.test"}
+	tests := []struct {
+		name  string
+		rule  Account
+		alias string
+		want  []string
+	}{
+		{"plain", Account{Pattern: `^a@corp\.test$`, ForwardTo: "x@real.test, local"}, "a@corp.test", []string{"x@real.test", "local"}},
+		{"group", team, "alice.team@corp.test", []string{"alice@real.test", "audit@real.test"}},
+		{"named", Account{Pattern: `^(?P<user>\w+)\+(?P<tag>\w+)@corp\.test$`, ForwardTo: "${user}+${tag}@real.test"}, "bob+news@corp.test", []string{"bob+news@real.test"}},
+		{"no match", team, "other@corp.test", []string{"audit@real.test"}},
+		{"comma", team, `"a,b.x".team@corp.test`, []string{"audit@real.test"}},
+		{"quoted comma", Account{Pattern: `^"(.+)\.team"@corp\.test$`, ForwardTo: "$1@real.test"}, `"a,b"@corp.test`, []string{}},
+		{"url", Account{Pattern: `^"?(.+)\.team"?@corp\.test$`, ForwardTo: "$1"}, `"https://evil/x.team"@corp.test`, []string{}},
+		{"becomes local", Account{Pattern: `^(\w+)@corp\.test$`, ForwardTo: "$1"}, "local@corp.test", []string{}},
+		{"several addresses", Account{Pattern: `^(.+)@corp\.test$`, ForwardTo: "$1@real.test"}, "a@b.c, d@corp.test", []string{}},
+		{"webhook template", Account{Pattern: `^(\w+)@corp\.test$`, ForwardTo: "https://hooks.example.com/$1"}, "bob@corp.test", []string{"https://hooks.example.com/$1"}},
+	}
+	for _, tt := range tests {
+		got := expandForwardTargets(tt.rule, tt.alias)
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expandForwardTargets(%q) = %q, want %q", tt.name, tt.alias, got, tt.want)
+		}
+	}
+}
+
+func TestIsSingleMailbox(t *testing.T) {
+	tests := map[string]bool{
+		"alice@real.test":            true,
+		"a.b+tag@real.test":          true,
+		"":                           false,
+		"local":                      false,
+		"Alice <alice@real.test>":    false,
+		"a@real.test, b@real.test":   false,
+		`"a,b"@real.test`:            false,
+		`"a:b"@real.test`:            false,
+		`"https://evil/x"@real.test`: false,
+		"https://evil/x":             false,
+	}
+	for input, want := range tests {
+		if got := isSingleMailbox(input); got != want {
+			t.Errorf("isSingleMailbox(%q) = %v, want %v", input, got, want)
+		}
+	}
+}
+
+func TestValidateForwardTargets(t *testing.T) {
+	tests := []struct {
+		pattern, forward string
+		ok               bool
+	}{
+		{`^(\w+)@corp\.test$`, "$1@real.test", true},
+		{`^(\w+)@corp\.test$`, "$2@real.test", false},
+		{`^(?P<user>\w+)@corp\.test$`, "${user}@real.test", true},
+		{`^(?P<user>\w+)@corp\.test$`, "${nobody}@real.test", false},
+		{`^(\w+)@corp\.test$`, "$1x@real.test", false},
+		{`^a@corp\.test$`, "http://example.com/hook", false},
+	}
+	for _, tt := range tests {
+		err := validateForwardTargets(&Account{Pattern: tt.pattern, ForwardTo: tt.forward})
+		if (err == nil) != tt.ok {
+			t.Errorf("validateForwardTargets(%q, %q) = %v, want ok=%v", tt.pattern, tt.forward, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultSubjectTemplate = "[Fwd: {{.From}}] {{.Subject}}"
+	defaultBannerTemplate  = "Original Sender: {{.From}}\nOriginal Subject: {{.Subject}}\n---\n\n"
+
+	// Keep the rendered subject within a single reasonable header line
+	maxSubjectRunes = 200
+)
+
+// Headers that every forwarded message needs and that cannot be removed
+var protectedHeaders = map[string]bool{
+	"from":                      true,
+	"to":                        true,
+	"mime-version":              true,
+	"content-type":              true,
+	"content-transfer-encoding": true,
+}
+
+var headerNameRe = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// TemplateData is exposed to the subject, banner and header templates
+type TemplateData struct {
+	Alias        string            // Address the mail was sent to
+	From         string            // Original sender
+	SenderDomain string            // Domain part of the original sender
+	Subject      string            // Decoded original subject
+	Received     time.Time         // Time the mail was received
+	Groups       []string          // Capture groups of the account pattern, Groups[0] is the full match
+	Named        map[string]string // Named capture groups of the account pattern
+	Account      TemplateAccount
+}
+
+// TemplateAccount holds the account fields templates may use. Credentials
+// and other internal fields are deliberately left out, rendered values can
+// end up at external targets.
+type TemplateAccount struct {
+	Pattern     string
+	Description string
+	UsedFor     string
+	Tags        string
+}
+
+// ForwardHeader is a single rendered header of a forwarded message
+type ForwardHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// RenderedForward holds the parts of a forwarded message produced by the templates
+type RenderedForward struct {
+	Subject string          `json:"subject"`
+	Banner  string          `json:"banner"`
+	Headers []ForwardHeader `json:"headers"` // Extra headers after additions and removals
+}
+
+// captureGroups matches the account pattern against the alias
+func captureGroups(pattern string, alias string) ([]string, map[string]string) {
+	named := map[string]string{}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, named
+	}
+	groups := re.FindStringSubmatch(alias)
+	for i, name := range re.SubexpNames() {
+		if name != "" && i < len(groups) {
+			named[name] = groups[i]
+		}
+	}
+	return groups, named
+}
+
+func newTemplateData(rule Account, msg InboundMessage) TemplateData {
+	groups, named := captureGroups(rule.Pattern, msg.To)
+	return TemplateData{
+		Alias:        msg.To,
+		From:         msg.From,
+		SenderDomain: senderDomain(msg.From),
+		Subject:      msg.Subject,
+		Received:     msg.Received,
+		Groups:       groups,
+		Named:        named,
+		Account: TemplateAccount{
+			Pattern:     rule.Pattern,
+			Description: rule.Description,
+			UsedFor:     rule.UsedFor,
+			Tags:        rule.Tags,
+		},
+	}
+}
+
+func executeTemplate(name string, text string, data TemplateData) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("%s template: %v", name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("%s template: %v", name, err)
+	}
+	return buf.String(), nil
+}
+
+// headerValue makes a rendered value safe to use in a header line
+func headerValue(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			// Fold between encoded-words to keep lines short
+			return strings.ReplaceAll(mime.BEncoding.Encode("UTF-8", s), "?= =?", "?=\r\n =?")
+		}
+	}
+	return s
+}
+
+// renderForward evaluates the account templates for a message
+func renderForward(rule Account, msg InboundMessage) (*RenderedForward, error) {
+	return renderForwardData(rule, msg, newTemplateData(rule, msg))
+}
+
+func renderForwardData(rule Account, msg InboundMessage, data TemplateData) (*RenderedForward, error) {
+	subjectTmpl := rule.SubjectTemplate
+	if subjectTmpl == "" {
+		subjectTmpl = defaultSubjectTemplate
+	}
+	subject, err := executeTemplate("subject", subjectTmpl, data)
+	if err != nil {
+		return nil, err
+	}
+	subject = strings.Join(strings.Fields(subject), " ")
+	if utf8.RuneCountInString(subject) > maxSubjectRunes {
+		subject = string([]rune(subject)[:maxSubjectRunes-3]) + "..."
+	}
+
+	bannerTmpl := rule.BannerTemplate
+	if bannerTmpl == "" {
+		bannerTmpl = defaultBannerTemplate
+	}
+	banner, err := executeTemplate("banner", bannerTmpl, data)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := map[string]bool{}
+	for _, name := range strings.Split(rule.RemoveHeaders, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			removed[name] = true
+		}
+	}
+
+	headers := []ForwardHeader{
+		{Name: "X-Original-From", Value: msg.From},
+		{Name: "X-Original-To", Value: msg.To},
+	}
+	for _, line := range strings.Split(rule.AddHeaders, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, valueTmpl, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || !headerNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid header line %q", line)
+		}
+		// A second From or Content-Type would make the message ambiguous,
+		// the subject has its own template
+		if lower := strings.ToLower(name); protectedHeaders[lower] || lower == "subject" {
+			return nil, fmt.Errorf("header %s cannot be added", name)
+		}
+		value, err := executeTemplate("header "+name, strings.TrimSpace(valueTmpl), data)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, ForwardHeader{Name: name, Value: value})
+	}
+
+	rendered := &RenderedForward{Subject: subject, Banner: banner}
+	for _, h := range headers {
+		if !removed[strings.ToLower(h.Name)] {
+			rendered.Headers = append(rendered.Headers, h)
+		}
+	}
+	if removed["subject"] {
+		rendered.Subject = ""
+	}
+	return rendered, nil
+}
+
+// buildForwardMessage produces the RFC822 message sent to one forward target
+func buildForwardMessage(envelopeFrom string, to string, rule Account, msg InboundMessage) ([]byte, error) {
+	rendered, err := renderForward(rule, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var fullMsg bytes.Buffer
+	fullMsg.WriteString(fmt.Sprintf("From: %s\r\n", envelopeFrom))
+	fullMsg.WriteString(fmt.Sprintf("To: %s\r\n", to))
+	if rendered.Subject != "" {
+		fullMsg.WriteString(fmt.Sprintf("Subject: %s\r\n", headerValue(rendered.Subject)))
+	}
+	fullMsg.WriteString("MIME-Version: 1.0\r\n")
+	fullMsg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	fullMsg.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	for _, h := range rendered.Headers {
+		fullMsg.WriteString(fmt.Sprintf("%s: %s\r\n", h.Name, headerValue(h.Value)))
+	}
+	fullMsg.WriteString("\r\n")
+	fullMsg.WriteString(toCRLF(rendered.Banner))
+	fullMsg.WriteString(msg.Body)
+
+	return fullMsg.Bytes(), nil
+}
+
+func toCRLF(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// validateTemplates renders the account templates against sample data so
+// that syntax errors and unknown fields are reported when saving
+func validateTemplates(a *Account) error {
+	for _, name := range strings.Split(a.RemoveHeaders, ",") {
+		if protectedHeaders[strings.ToLower(strings.TrimSpace(name))] {
+			return fmt.Errorf("header %s cannot be removed", strings.TrimSpace(name))
+		}
+	}
+
+	sample := InboundMessage{
+		From:     "sender@example.com",
+		To:       "alias@example.com",
+		Subject:  "Sample subject",
+		Received: time.Now(),
+	}
+	data := newTemplateData(*a, sample)
+
+	// Fill every capture group so that templates referencing them can run
+	re, err := regexp.Compile(a.Pattern)
+	if err != nil {
+		return err
+	}
+	data.Groups = make([]string, re.NumSubexp()+1)
+	data.Groups[0] = sample.To
+	for i, name := range re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		data.Groups[i] = fmt.Sprintf("group%d", i)
+		if name != "" {
+			data.Named[name] = data.Groups[i]
+		}
+	}
+
+	if _, err := renderForwardData(*a, sample, data); err != nil {
+		return errors.New("invalid " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderForward(t *testing.T) {
+	rule := Account{
+		Pattern:         `^(?P<service>[a-z]+)\.shop@example\.com$`,
+		Description:     "Shopping",
+		UsedFor:         "shop.example.net",
+		Tags:            "shopping",
+		SubjectTemplate: "[{{.Named.service}}] {{.Subject}}",
+		BannerTemplate:  "From {{.From}} via {{.Account.Description}}\n",
+		AddHeaders:      "X-Tags: {{.Account.Tags}}\nX-Used-For: {{.Account.UsedFor}}",
+		RemoveHeaders:   "X-Original-To",
+	}
+	msg := InboundMessage{
+		From:     "news@shop.example.net",
+		To:       "acme.shop@example.com",
+		Subject:  "Your order",
+		Received: time.Now(),
+	}
+
+	rendered, err := renderForward(rule, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rendered.Subject != "[acme] Your order" {
+		t.Errorf("subject = %q", rendered.Subject)
+	}
+	if rendered.Banner != "From news@shop.example.net via Shopping\n" {
+		t.Errorf("banner = %q", rendered.Banner)
+	}
+	want := []ForwardHeader{
+		{Name: "X-Original-From", Value: "news@shop.example.net"},
+		{Name: "X-Tags", Value: "shopping"},
+		{Name: "X-Used-For", Value: "shop.example.net"},
+	}
+	if len(rendered.Headers) != len(want) {
+		t.Fatalf("headers = %+v, want %+v", rendered.Headers, want)
+	}
+	for i, h := range want {
+		if rendered.Headers[i] != h {
+			t.Errorf("header %d = %+v, want %+v", i, rendered.Headers[i], h)
+		}
+	}
+}
+
+func TestValidateTemplatesHidesInternalFields(t *testing.T) {
+	for _, field := range []string{"MailboxPasswordHash", "InboxTokenHash", "ForwardTo", "OwnerID"} {
+		a := Account{Pattern: `^a@example\.com$`, AddHeaders: "X-Leak: {{.Account." + field + "}}"}
+		err := validateTemplates(&a)
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("template using .Account.%s: err = %v, want an unknown field error", field, err)
+		}
+	}
+}
+
+func TestValidateTemplatesProtectedHeaders(t *testing.T) {
+	a := Account{Pattern: `^a@example\.com$`, RemoveHeaders: "X-Original-To, Content-Type"}
+	if err := validateTemplates(&a); err == nil {
+		t.Error("removing Content-Type was accepted")
+	}
+
+	tests := []struct {
+		add string
+		ok  bool
+	}{
+		{"X-Alias: {{.Alias}}", true},
+		{"Reply-To: {{.From}}", true},
+		{"From: attacker@example.com", false},
+		{"to: other@example.com", false},
+		{"Subject: {{.Subject}}", false},
+		{"Content-Type: text/html", false},
+		{"X-Tag: a\nMIME-Version: 2.0", false},
+		{"Content-Transfer-Encoding: base64", false},
+	}
+	for _, tt := range tests {
+		a := Account{Pattern: `^a@example\.com$`, AddHeaders: tt.add}
+		if err := validateTemplates(&a); (err == nil) != tt.ok {
+			t.Errorf("adding %q: err = %v, want ok=%v", tt.add, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// IsTenant reports whether the user only sees the domains they own and the
+// accounts, logs and mail belonging to them
+func (u *User) IsTenant() bool {
+	return u.Role == RoleOwner
+}
+
+// tenantID returns the id rows must be owned by, nil for staff users who
+// see everything
+func tenantID(c *gin.Context) *uint {
+	if user := currentUser(c); user != nil && user.IsTenant() {
+		return &user.ID
+	}
+	return nil
+}
+
+// ownedBy limits a query to rows whose owner column matches the tenant
+func ownedBy(c *gin.Context, column string) func(*gorm.DB) *gorm.DB {
+	owner := tenantID(c)
+	return func(db *gorm.DB) *gorm.DB {
+		if owner == nil {
+			return db
+		}
+		return db.Where(column+" = ?", *owner)
+	}
+}
+
+// ownedAccounts limits a query to rows whose account column references an
+// account of the tenant
+func ownedAccounts(c *gin.Context, column string) func(*gorm.DB) *gorm.DB {
+	owner := tenantID(c)
+	return func(db *gorm.DB) *gorm.DB {
+		if owner == nil {
+			return db
+		}
+		return db.Where(column+" IN (?)", DB.Model(&Account{}).Select("id").Where("owner_id = ?", *owner))
+	}
+}
+
+// findAccount loads an account visible to the user or answers 404
+func findAccount(c *gin.Context, id interface{}) (*Account, bool) {
+	var account Account
+	if err := DB.Scopes(ownedBy(c, "owner_id")).First(&account, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return nil, false
+	}
+	return &account, true
+}
+
+// canManageFilter reports whether the user may save the filter, tenants
+// cannot touch global filters
+func canManageFilter(c *gin.Context, f *SenderFilter) bool {
+	owner := tenantID(c)
+	if owner == nil {
+		return true
+	}
+	if f.AccountID == nil {
+		return false
+	}
+	var count int64
+	DB.Model(&Account{}).Where("id = ? AND owner_id = ?", *f.AccountID, *owner).Count(&count)
+	return count > 0
+}
+
+// findDomain loads a domain visible to the user
+func findDomain(c *gin.Context, id interface{}) (*Domain, error) {
+	var domain Domain
+	if err := DB.Scopes(ownedBy(c, "owner_id")).First(&domain, id).Error; err != nil {
+		return nil, errors.New("domain not found")
+	}
+	return &domain, nil
+}
+
+// domainOwner returns the owner of the managed domain of an address, nil
+// when the domain is unknown or belongs to no one
+func domainOwner(address string) *uint {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return nil
+	}
+	var domain Domain
+	if DB.Where("LOWER(name) = ?", strings.ToLower(address[at+1:])).First(&domain).Error != nil {
+		return nil
+	}
+	return domain.OwnerID
+}
+
+// patternDomain returns the managed domain a pattern is anchored to, i.e.
+// ending in "@example\.com$", or nil
+func patternDomain(pattern string) *Domain {
+	var domains []Domain
+	DB.Find(&domains)
+	for i := range domains {
+		if strings.HasSuffix(strings.ToLower(pattern), "@"+regexp.QuoteMeta(strings.ToLower(domains[i].Name))+"$") {
+			return &domains[i]
+		}
+	}
+	return nil
+}
+
+// assignAccountOwner decides who owns an account. Tenants always own what
+// they create, staff may pick an owner and otherwise the owner of the
+// domain the pattern is anchored to is used.
+func assignAccountOwner(c *gin.Context, a *Account) error {
+	if owner := tenantID(c); owner != nil {
+		a.OwnerID = owner
+		return nil
+	}
+	if a.OwnerID == nil {
+		if d := patternDomain(a.Pattern); d != nil {
+			a.OwnerID = d.OwnerID
+		}
+		return nil
+	}
+	return validateOwner(a.OwnerID)
+}
+
+// validateOwner checks that an owner id references an owner user
+func validateOwner(id *uint) error {
+	if id == nil {
+		return nil
+	}
+	var user User
+	if DB.First(&user, *id).Error != nil || user.Role != RoleOwner {
+		return errors.New("owner_id must reference a user with the owner role")
+	}
+	return nil
+}
+
+// transferDomain hands a domain, the accounts anchored to it and their logs
+// to a new owner. Stored mail follows its account.
+func transferDomain(d *Domain, owner *uint) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(d).Update("owner_id", owner).Error; err != nil {
+			return err
+		}
+		var accounts []Account
+		tx.Find(&accounts)
+		suffix := "@" + regexp.QuoteMeta(strings.ToLower(d.Name)) + "$"
+		for _, a := range accounts {
+			if strings.HasSuffix(strings.ToLower(a.Pattern), suffix) {
+				if err := tx.Model(&Account{}).Where("id = ?", a.ID).Update("owner_id", owner).Error; err != nil {
+					return err
+				}
+				if err := tx.Model(&Log{}).Where("account_id = ?", a.ID).Update("owner_id", owner).Error; err != nil {
+					return err
+				}
+			}
+		}
+		d.OwnerID = owner
+		return nil
+	})
+}
+
+// releaseOwnership returns everything a deleted user owned to the staff
+func releaseOwnership(tx *gorm.DB, userID uint) error {
+	for _, model := range []interface{}{&Domain{}, &Account{}, &Log{}} {
+		if err := tx.Model(model).Where("owner_id = ?", userID).Update("owner_id", nil).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
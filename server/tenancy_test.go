@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// contextFor returns a request context authenticated as the user
+func contextFor(user *User) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.Set("user", user)
+	return c, w
+}
+
+// tenancyFixture creates two tenants with a domain, an account and a log
+// each, plus a staff-managed domain
+func tenancyFixture(t *testing.T) (alice *User, bob *User, staff *User) {
+	t.Helper()
+	newTestDB(t)
+	alice = createTestUser(t, "alice", RoleOwner)
+	bob = createTestUser(t, "bob", RoleOwner)
+	staff = createTestUser(t, "ops", RoleOperator)
+	for _, owner := range []*User{alice, bob, nil} {
+		var id *uint
+		name := "staff.test"
+		if owner != nil {
+			id = &owner.ID
+			name = owner.Username + ".test"
+		}
+		DB.Create(&Domain{Name: name, OwnerID: id})
+		account := Account{Pattern: `^.*@` + regexp.QuoteMeta(name) + `$`, ForwardTo: "x@example.com", OwnerID: id}
+		DB.Create(&account)
+		DB.Create(&Log{AccountID: account.ID, OwnerID: id, To: "a@" + name})
+	}
+	return alice, bob, staff
+}
+
+func TestOwnedScopes(t *testing.T) {
+	alice, bob, staff := tenancyFixture(t)
+	tests := []struct {
+		user    *User
+		domains []string
+		logs    []string
+	}{
+		{alice, []string{"alice.test"}, []string{"a@alice.test"}},
+		{bob, []string{"bob.test"}, []string{"a@bob.test"}},
+		{staff, []string{"alice.test", "bob.test", "staff.test"}, []string{"a@alice.test", "a@bob.test", "a@staff.test"}},
+	}
+	for _, tt := range tests {
+		c, _ := contextFor(tt.user)
+		var domains []string
+		DB.Model(&Domain{}).Scopes(ownedBy(c, "owner_id")).Order("name").Pluck("name", &domains)
+		if !slices.Equal(domains, tt.domains) {
+			t.Errorf("%s sees domains %v, want %v", tt.user.Username, domains, tt.domains)
+		}
+		var logs []string
+		DB.Model(&Log{}).Scopes(ownedAccounts(c, "account_id")).Pluck("`to`", &logs)
+		sort.Strings(logs)
+		if !slices.Equal(logs, tt.logs) {
+			t.Errorf("%s sees logs %v, want %v", tt.user.Username, logs, tt.logs)
+		}
+	}
+}
+
+func TestFindAccountOfAnotherTenant(t *testing.T) {
+	alice, bob, staff := tenancyFixture(t)
+	var bobs Account
+	DB.Where("owner_id = ?", bob.ID).First(&bobs)
+
+	c, w := contextFor(alice)
+	if _, ok := findAccount(c, bobs.ID); ok || w.Code != http.StatusNotFound {
+		t.Errorf("alice found bob's account, status %d", w.Code)
+	}
+	if _, err := findDomain(c, 2); err == nil {
+		t.Error("alice found bob's domain")
+	}
+	for _, user := range []*User{bob, staff} {
+		c, _ := contextFor(user)
+		if _, ok := findAccount(c, bobs.ID); !ok {
+			t.Errorf("%s cannot find bob's account", user.Username)
+		}
+	}
+}
+
+func TestCanManageFilter(t *testing.T) {
+	alice, bob, staff := tenancyFixture(t)
+	var accounts []Account
+	DB.Order("id").Find(&accounts)
+	alices, bobs := accounts[0].ID, accounts[1].ID
+
+	tests := []struct {
+		user    *User
+		account *uint
+		want    bool
+	}{
+		{alice, &alices, true},
+		{alice, &bobs, false},
+		{alice, nil, false}, // Global filters are staff only
+		{bob, &bobs, true},
+		{staff, nil, true},
+		{staff, &alices, true},
+	}
+	for _, tt := range tests {
+		c, _ := contextFor(tt.user)
+		if got := canManageFilter(c, &SenderFilter{AccountID: tt.account}); got != tt.want {
+			t.Errorf("%s, account %v: canManageFilter = %v, want %v", tt.user.Username, tt.account, got, tt.want)
+		}
+	}
+}
+
+func TestAssignAccountOwner(t *testing.T) {
+	alice, bob, staff := tenancyFixture(t)
+	tests := []struct {
+		name    string
+		user    *User
+		account Account
+		want    *uint
+		wantErr bool
+	}{
+		{"tenant always owns", alice, Account{Pattern: `^x@bob\.test$`, OwnerID: &bob.ID}, &alice.ID, false},
+		{"staff, anchored pattern", staff, Account{Pattern: `^x@bob\.test$`}, &bob.ID, false},
+		{"staff, staff domain", staff, Account{Pattern: `^x@staff\.test$`}, nil, false},
+		{"staff picks owner", staff, Account{Pattern: `^x@staff\.test$`, OwnerID: &alice.ID}, &alice.ID, false},
+		{"owner is not a tenant", staff, Account{Pattern: `^x@staff\.test$`, OwnerID: &staff.ID}, nil, true},
+	}
+	for _, tt := range tests {
+		c, _ := contextFor(tt.user)
+		err := assignAccountOwner(c, &tt.account)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v", tt.name, err)
+			continue
+		}
+		if !tt.wantErr && !equalOwner(tt.account.OwnerID, tt.want) {
+			t.Errorf("%s: owner %v, want %v", tt.name, tt.account.OwnerID, tt.want)
+		}
+	}
+}
+
+func TestTransferAndReleaseOwnership(t *testing.T) {
+	alice, bob, _ := tenancyFixture(t)
+	var domain Domain
+	DB.Where("name = ?", "alice.test").First(&domain)
+
+	if err := transferDomain(&domain, &bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	var owned int64
+	DB.Model(&Account{}).Where("owner_id = ?", bob.ID).Count(&owned)
+	if owned != 2 {
+		t.Errorf("bob owns %d accounts after the transfer, want 2", owned)
+	}
+	// The mail logs of the domain move along
+	for _, tt := range []struct {
+		user *User
+		want []string
+	}{
+		{alice, nil},
+		{bob, []string{"a@alice.test", "a@bob.test"}},
+	} {
+		c, _ := contextFor(tt.user)
+		var logs []string
+		DB.Model(&Log{}).Scopes(ownedBy(c, "owner_id")).Order("`to`").Pluck("`to`", &logs)
+		if !slices.Equal(logs, tt.want) {
+			t.Errorf("%s sees logs %v after the transfer, want %v", tt.user.Username, logs, tt.want)
+		}
+	}
+
+	if err := releaseOwnership(DB, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range []interface{}{&Domain{}, &Account{}, &Log{}} {
+		var left int64
+		DB.Model(model).Where("owner_id = ?", bob.ID).Count(&left)
+		if left != 0 {
+			t.Errorf("%d %T rows still owned by a deleted tenant", left, model)
+		}
+	}
+}
+
+// tenantRouter serves the update routes as the user
+func tenantRouter(user *User) *gin.Engine {
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("user", user) })
+	r.PUT("/api/accounts/:id", UpdateAccount)
+	r.PUT("/api/filters/:id", UpdateSenderFilter)
+	return r
+}
+
+func TestUpdateKeepsTheCheckedRow(t *testing.T) {
+	alice, bob, _ := tenancyFixture(t)
+	var alices, bobs Account
+	DB.Where("owner_id = ?", alice.ID).First(&alices)
+	DB.Where("owner_id = ?", bob.ID).First(&bobs)
+	DB.Model(&bobs).Updates(map[string]interface{}{"hit_count": 3, "first_sender_domain": "shop.test"})
+	DB.Model(&alices).Updates(map[string]interface{}{"hit_count": 5, "first_sender_domain": "shop.test", "leak_domains": "spam.test"})
+	alicesFilter := SenderFilter{AccountID: &alices.ID, Action: "block", MatchType: "domain", Value: "a.test"}
+	bobsFilter := SenderFilter{AccountID: &bobs.ID, Action: "block", MatchType: "domain", Value: "b.test"}
+	global := SenderFilter{Action: "block", MatchType: "domain", Value: "g.test"}
+	DB.Create(&alicesFilter)
+	DB.Create(&bobsFilter)
+	DB.Create(&global)
+
+	r := tenantRouter(alice)
+	body := fmt.Sprintf(`{"id":%d,"pattern":"^x@alice\\.test$","forward_to":"evil@example.com","hit_count":0,"first_sender_domain":"","leak_domains":""}`, bobs.ID)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/accounts/%d", alices.ID), strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+
+	var stored Account
+	DB.First(&stored, bobs.ID)
+	if stored.ForwardTo != "x@example.com" || stored.OwnerID == nil || *stored.OwnerID != bob.ID {
+		t.Errorf("alice changed bob's account: %+v", stored)
+	}
+	stored = Account{}
+	DB.First(&stored, alices.ID)
+	if stored.ForwardTo != "evil@example.com" || stored.HitCount != 5 || stored.FirstSenderDomain != "shop.test" || stored.LeakDomains != "spam.test" {
+		t.Errorf("alice's account after the update: %+v", stored)
+	}
+
+	for _, target := range []SenderFilter{bobsFilter, global} {
+		body := fmt.Sprintf(`{"id":%d,"account_id":%d,"action":"allow","match_type":"domain","value":"x.test"}`, target.ID, alices.ID)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/filters/%d", alicesFilter.ID), strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("filter update: %d %s", w.Code, w.Body)
+		}
+		var f SenderFilter
+		DB.First(&f, target.ID)
+		if f.Action != "block" || f.Value != target.Value {
+			t.Errorf("alice changed filter %d: %+v", target.ID, f)
+		}
+	}
+
+	// Moving an own filter to another tenant's account is refused
+	body = fmt.Sprintf(`{"account_id":%d,"action":"allow","match_type":"domain","value":"x.test"}`, bobs.ID)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/filters/%d", alicesFilter.ID), strings.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("filter moved to bob's account: status %d", w.Code)
+	}
+}
+
+func equalOwner(a, b *uint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
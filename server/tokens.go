@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const apiTokenPrefix = "mg_"
+
+const (
+	ScopeLogsRead        = "logs:read"        // Logs, verification codes and live events
+	ScopeAccountsRead    = "accounts:read"    // Domains, aliases, filters, quarantine and stored mail
+	ScopeAccountsWrite   = "accounts:write"   // Create, change and delete aliases and their mail
+	ScopeAliasesGenerate = "aliases:generate" // Generate aliases and disposable inboxes
+)
+
+// tokenRouteScopes lists the routes API tokens may call and the scope each
+// one needs. Anything missing, such as user and token management, is only
+// reachable with a login session.
+var tokenRouteScopes = map[string]string{
+	"GET /api/logs":                            ScopeLogsRead,
+	"GET /api/logs/:id":                        ScopeLogsRead,
+	"GET /api/codes/latest":                    ScopeLogsRead,
+	"GET /api/events":                          ScopeLogsRead,
+	"GET /api/events/ws":                       ScopeLogsRead,
+	"GET /api/events/poll":                     ScopeLogsRead,
+	"POST /api/events/ticket":                  ScopeLogsRead,
+	"GET /api/domains":                         ScopeAccountsRead,
+	"GET /api/accounts":                        ScopeAccountsRead,
+	"GET /api/accounts/:id/messages":           ScopeAccountsRead,
+	"GET /api/messages/:id":                    ScopeAccountsRead,
+	"GET /api/messages/:id/attachments/:index": ScopeAccountsRead,
+	"GET /api/filters":                         ScopeAccountsRead,
+	"GET /api/code-patterns":                   ScopeAccountsRead,
+	"GET /api/quarantine":                      ScopeAccountsRead,
+	"GET /api/quarantine/:id":                  ScopeAccountsRead,
+	"POST /api/accounts":                       ScopeAccountsWrite,
+	"PUT /api/accounts/:id":                    ScopeAccountsWrite,
+	"POST /api/accounts/:id/preview":           ScopeAccountsWrite,
+	"PUT /api/accounts/:id/mailbox":            ScopeAccountsWrite,
+	"DELETE /api/accounts/:id":                 ScopeAccountsWrite,
+	"POST /api/filters":                        ScopeAccountsWrite,
+	"PUT /api/filters/:id":                     ScopeAccountsWrite,
+	"DELETE /api/filters/:id":                  ScopeAccountsWrite,
+	"PUT /api/messages/:id/read":               ScopeAccountsWrite,
+	"POST /api/messages/:id/quarantine":        ScopeAccountsWrite,
+	"DELETE /api/messages/:id":                 ScopeAccountsWrite,
+	"POST /api/quarantine/:id/release":         ScopeAccountsWrite,
+	"DELETE /api/quarantine/:id":               ScopeAccountsWrite,
+	"POST /api/accounts/generate":              ScopeAliasesGenerate,
+	"POST /api/accounts/disposable":            ScopeAliasesGenerate,
+}
+
+var validScopes = map[string]bool{
+	ScopeLogsRead: true, ScopeAccountsRead: true, ScopeAccountsWrite: true, ScopeAliasesGenerate: true,
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func isAPIToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+// normalizeScopes validates and deduplicates the requested scopes
+func normalizeScopes(scopes []string) (string, error) {
+	if len(scopes) == 0 {
+		return "", errors.New("at least one scope is required")
+	}
+	seen := map[string]bool{}
+	var result []string
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if !validScopes[scope] {
+			return "", errors.New("unknown scope " + scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			result = append(result, scope)
+		}
+	}
+	sort.Strings(result)
+	return strings.Join(result, ","), nil
+}
+
+// createAPIToken issues a token for the user and returns the plain value,
+// which is only shown once
+func createAPIToken(user *User, name string, scopes []string, ttl time.Duration) (*APIToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", errors.New("name is required")
+	}
+	normalized, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	plain := apiTokenPrefix + randomHex(40)
+	t := APIToken{
+		UserID:    user.ID,
+		Name:      name,
+		Prefix:    plain[:len(apiTokenPrefix)+6],
+		TokenHash: hashAPIToken(plain),
+		Scopes:    normalized,
+	}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl)
+		t.ExpiresAt = &expires
+	}
+	if err := DB.Create(&t).Error; err != nil {
+		return nil, "", err
+	}
+	return &t, plain, nil
+}
+
+// authenticateAPIToken resolves a token to its user
+func authenticateAPIToken(plain string) (*APIToken, *User, error) {
+	var t APIToken
+	if DB.Where("token_hash = ?", hashAPIToken(plain)).First(&t).Error != nil {
+		return nil, nil, errors.New("invalid token")
+	}
+	if t.ExpiresAt != nil && !time.Now().Before(*t.ExpiresAt) {
+		return nil, nil, errors.New("token expired")
+	}
+	var user User
+	if DB.First(&user, t.UserID).Error != nil || !user.IsEnabled() {
+		return nil, nil, errors.New("invalid token")
+	}
+
+	now := time.Now()
+	DB.Model(&t).UpdateColumn("last_used_at", &now)
+	return &t, &user, nil
+}
+
+// Allows reports whether the token may call the route
+func (t *APIToken) Allows(method string, route string) bool {
+	required, ok := tokenRouteScopes[method+" "+route]
+	if !ok {
+		return false
+	}
+	for _, scope := range strings.Split(t.Scopes, ",") {
+		if scope == required {
+			return true
+		}
+	}
+	return false
+}
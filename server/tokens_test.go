@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNormalizeScopes(t *testing.T) {
+	tests := []struct {
+		scopes  []string
+		want    string
+		wantErr bool
+	}{
+		{[]string{"logs:read"}, "logs:read", false},
+		{[]string{" accounts:write", "logs:read", "accounts:write"}, "accounts:write,logs:read", false},
+		{[]string{"aliases:generate", "accounts:read"}, "accounts:read,aliases:generate", false},
+		{nil, "", true},
+		{[]string{"logs:read", "users:write"}, "", true},
+		{[]string{"LOGS:READ"}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeScopes(tt.scopes)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeScopes(%q) = %q, %v; want %q", tt.scopes, got, err, tt.want)
+		}
+	}
+}
+
+func TestTokenRouteScopes(t *testing.T) {
+	for route, scope := range tokenRouteScopes {
+		method, path, ok := strings.Cut(route, " ")
+		if !ok || !strings.HasPrefix(path, "/api/") || method != strings.ToUpper(method) {
+			t.Errorf("malformed route %q", route)
+		}
+		if !validScopes[scope] {
+			t.Errorf("%s needs unknown scope %q", route, scope)
+		}
+		// Reading never needs a write scope
+		if method == http.MethodGet && scope == ScopeAccountsWrite {
+			t.Errorf("%s needs %s", route, scope)
+		}
+	}
+
+	tests := []struct {
+		scopes string
+		method string
+		route  string
+		want   bool
+	}{
+		{"logs:read", "GET", "/api/logs", true},
+		{"logs:read", "GET", "/api/codes/latest", true},
+		{"logs:read", "GET", "/api/accounts", false},
+		{"accounts:read", "GET", "/api/accounts", true},
+		{"accounts:read", "POST", "/api/accounts", false},
+		{"accounts:read,accounts:write", "POST", "/api/accounts", true},
+		{"accounts:write", "GET", "/api/accounts", false}, // Write does not imply read
+		{"aliases:generate", "POST", "/api/accounts/generate", true},
+		{"aliases:generate", "POST", "/api/accounts", false},
+		{"logs:read", "GET", "/api/logs/1", false}, // Routes, not paths
+		{"accounts:read,accounts:write,aliases:generate,logs:read", "GET", "/api/users", false},
+		{"accounts:read,accounts:write,aliases:generate,logs:read", "POST", "/api/tokens", false},
+		{"accounts:read,accounts:write,aliases:generate,logs:read", "GET", "/api/settings", false},
+	}
+	for _, tt := range tests {
+		token := &APIToken{Scopes: tt.scopes}
+		if got := token.Allows(tt.method, tt.route); got != tt.want {
+			t.Errorf("[%s] Allows(%s %s) = %v, want %v", tt.scopes, tt.method, tt.route, got, tt.want)
+		}
+	}
+}
+
+func TestAPITokenAuthentication(t *testing.T) {
+	newTestDB(t)
+	operator := createTestUser(t, "ci", RoleOperator)
+	viewer := createTestUser(t, "viewer", RoleReadOnly)
+	_, reader, _ := createAPIToken(operator, "reader", []string{ScopeAccountsRead}, 0)
+	_, writer, _ := createAPIToken(operator, "writer", []string{ScopeAccountsWrite}, 0)
+	_, viewerWriter, _ := createAPIToken(viewer, "writer", []string{ScopeAccountsWrite}, 0)
+	expired, expiredPlain, _ := createAPIToken(operator, "old", []string{ScopeAccountsRead}, time.Hour)
+	DB.Model(expired).Update("expires_at", time.Now().Add(-time.Minute))
+	disabled := createTestUser(t, "gone", RoleOperator)
+	_, disabledPlain, _ := createAPIToken(disabled, "gone", []string{ScopeAccountsRead}, 0)
+	DB.Model(disabled).Update("enabled", false)
+
+	r := gin.New()
+	api := r.Group("/api", AuthMiddleware())
+	ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	api.GET("/accounts", ok)
+	api.POST("/accounts", ok)
+	api.GET("/users", ok)
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		status int
+	}{
+		{"read with read scope", reader, "GET", "/api/accounts", http.StatusNoContent},
+		{"write with read scope", reader, "POST", "/api/accounts", http.StatusForbidden},
+		{"write with write scope", writer, "POST", "/api/accounts", http.StatusNoContent},
+		{"session-only route", reader, "GET", "/api/users", http.StatusForbidden},
+		{"write scope of a read-only user", viewerWriter, "POST", "/api/accounts", http.StatusForbidden},
+		{"expired", expiredPlain, "GET", "/api/accounts", http.StatusUnauthorized},
+		{"disabled user", disabledPlain, "GET", "/api/accounts", http.StatusUnauthorized},
+		{"unknown", "mg_" + strings.Repeat("0", 40), "GET", "/api/accounts", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer        = "mail-generator"
+	totpPeriod        = 30 // Seconds per code (RFC 6238 default)
+	totpDigits        = 6
+	totpSkew          = 1 // Accepted steps before and after the current one
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var errInvalidSecondFactor = errors.New("invalid verification code")
+
+// newTOTPSecret returns a random 160 bit base32 secret
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpURI is the otpauth:// provisioning URI shown as a QR code by the UI
+func totpURI(username string, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// totpCode computes the HOTP value (RFC 4226) of a time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// matchTOTP returns the time step the code belongs to, allowing for clock
+// skew, or 0 when it does not match
+func matchTOTP(secret string, code string, now time.Time) int64 {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+// verifyTOTP checks a code against the user's secret. Every code is only
+// accepted once.
+func verifyTOTP(u *User, code string) error {
+	if u.TOTPSecret == "" {
+		return errInvalidSecondFactor
+	}
+	step := matchTOTP(u.TOTPSecret, code, time.Now())
+	if step == 0 {
+		return errInvalidSecondFactor
+	}
+	result := DB.Model(&User{}).Where("id = ? AND totp_last_step < ?", u.ID, step).Update("totp_last_step", step)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return errInvalidSecondFactor
+	}
+	u.TOTPLastStep = step
+	return nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes replaces the recovery codes of a user and returns them,
+// they are stored hashed and only shown once
+func newRecoveryCodes(u *User) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := randomHex(10)
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = hashRecoveryCode(raw)
+	}
+	u.RecoveryCodes = strings.Join(hashes, ",")
+	return codes, DB.Model(&User{}).Where("id = ?", u.ID).Update("recovery_codes", u.RecoveryCodes).Error
+}
+
+// useRecoveryCode consumes one recovery code
+func useRecoveryCode(u *User, code string) error {
+	hash := hashRecoveryCode(code)
+	hashes := strings.Split(u.RecoveryCodes, ",")
+	for i, h := range hashes {
+		if h != "" && subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			remaining := strings.Join(append(hashes[:i:i], hashes[i+1:]...), ",")
+			result := DB.Model(&User{}).Where("id = ? AND recovery_codes = ?", u.ID, u.RecoveryCodes).Update("recovery_codes", remaining)
+			if result.Error != nil || result.RowsAffected == 0 {
+				return errInvalidSecondFactor
+			}
+			u.RecoveryCodes = remaining
+			return nil
+		}
+	}
+	return errInvalidSecondFactor
+}
+
+// verifySecondFactor accepts either a TOTP code or a recovery code
+func verifySecondFactor(u *User, code string, recoveryCode string) error {
+	if recoveryCode != "" {
+		return useRecoveryCode(u, recoveryCode)
+	}
+	return verifyTOTP(u, code)
+}
+
+// enableTOTP turns on two-factor login after the first code was verified
+// and returns fresh recovery codes
+func enableTOTP(u *User, code string) ([]string, error) {
+	if u.TOTPEnabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+	if err := verifyTOTP(u, code); err != nil {
+		return nil, err
+	}
+	u.TOTPEnabled = true
+	if err := DB.Model(&User{}).Where("id = ?", u.ID).Update("totp_enabled", true).Error; err != nil {
+		return nil, err
+	}
+	return newRecoveryCodes(u)
+}
+
+// startTOTPEnrollment stores a new pending secret for the user
+func startTOTPEnrollment(u *User) (string, string, error) {
+	if u.TOTPEnabled {
+		return "", "", errors.New("two-factor authentication is already enabled")
+	}
+	u.TOTPSecret = newTOTPSecret()
+	if err := DB.Model(&User{}).Where("id = ?", u.ID).Update("totp_secret", u.TOTPSecret).Error; err != nil {
+		return "", "", err
+	}
+	return u.TOTPSecret, totpURI(u.Username, u.TOTPSecret), nil
+}
+
+// disableTOTP removes the second factor of a user
+func disableTOTP(u *User) error {
+	u.TOTPEnabled = false
+	u.TOTPSecret = ""
+	u.RecoveryCodes = ""
+	return DB.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{
+		"totp_enabled":   false,
+		"totp_secret":    "",
+		"recovery_codes": "",
+	}).Error
+}
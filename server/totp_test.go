@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 key of the RFC 6238 test vectors
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B, SHA1, truncated to the last six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil || got != tt.want {
+			t.Errorf("T=%d: code %q, %v; want %q", tt.unix, got, err, tt.want)
+		}
+		// Authenticator apps may show the secret in lower case
+		if got, _ := totpCode(strings.ToLower(rfc6238Secret), tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("T=%d, lower case secret: code %q", tt.unix, got)
+		}
+	}
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("invalid secret was accepted")
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+	code := func(s int64) string {
+		c, _ := totpCode(rfc6238Secret, s)
+		return c
+	}
+	tests := []struct {
+		name string
+		code string
+		want int64
+	}{
+		{"current", code(step), step},
+		{"previous step", code(step - 1), step - 1},
+		{"next step", code(step + 1), step + 1},
+		{"two steps old", code(step - 2), 0},
+		{"two steps ahead", code(step + 2), 0},
+		{"spaces", " 050 471 ", step},
+		{"too short", "50471", 0},
+		{"too long", "0504710", 0},
+		{"wrong", "123456", 0},
+		{"empty", "", 0},
+	}
+	for _, tt := range tests {
+		if got := matchTOTP(rfc6238Secret, tt.code, now); got != tt.want {
+			t.Errorf("%s (%q): step %d, want %d", tt.name, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTPOnce(t *testing.T) {
+	newTestDB(t)
+	user := createTestUser(t, "alice", RoleOperator)
+	if err := verifyTOTP(user, "123456"); err == nil {
+		t.Fatal("code accepted without a secret")
+	}
+	DB.Model(user).Update("totp_secret", rfc6238Secret)
+	user.TOTPSecret = rfc6238Secret
+
+	code, _ := totpCode(rfc6238Secret, time.Now().Unix()/totpPeriod)
+	if err := verifyTOTP(user, code); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyTOTP(user, code); err == nil {
+		t.Error("code was accepted twice")
+	}
+	// Neither may an older code that is still within the skew
+	previous, _ := totpCode(rfc6238Secret, time.Now().Unix()/totpPeriod-1)
+	if err := verifyTOTP(user, previous); err == nil {
+		t.Error("older code was accepted after a newer one")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	newTestDB(t)
+	user := createTestUser(t, "alice", RoleOperator)
+	codes, err := newRecoveryCodes(user)
+	if err != nil || len(codes) != recoveryCodeCount {
+		t.Fatalf("newRecoveryCodes: %d codes, %v", len(codes), err)
+	}
+	if strings.Contains(user.RecoveryCodes, strings.ReplaceAll(codes[0], "-", "")) {
+		t.Error("recovery codes are stored in clear text")
+	}
+
+	// Codes are accepted without the dash and in upper case, once
+	if err := verifySecondFactor(user, "", strings.ToUpper(strings.ReplaceAll(codes[3], "-", ""))); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySecondFactor(user, "", codes[3]); err == nil {
+		t.Error("recovery code was accepted twice")
+	}
+	if err := verifySecondFactor(user, "", codes[4]); err != nil {
+		t.Errorf("another recovery code: %v", err)
+	}
+	var stored User
+	DB.First(&stored, user.ID)
+	if n := len(strings.Split(stored.RecoveryCodes, ",")); n != recoveryCodeCount-2 {
+		t.Errorf("%d recovery codes left, want %d", n, recoveryCodeCount-2)
+	}
+	if err := verifySecondFactor(user, "", "00000-00000"); err == nil {
+		t.Error("unknown recovery code was accepted")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RoleAdmin    = "admin"    // Everything, including user management
+	RoleOperator = "operator" // Manages domains, aliases and mail, but not users
+	RoleOwner    = "owner"    // Manages aliases and mail of the domains they own
+	RoleReadOnly = "readonly" // Can only read
+)
+
+const minPasswordLength = 8
+
+var validRoles = map[string]bool{RoleAdmin: true, RoleOperator: true, RoleOwner: true, RoleReadOnly: true}
+
+// dummyPasswordHash is compared against when a user does not exist so that
+// unknown usernames take as long as wrong passwords
+const dummyPasswordHash = "$2a$10$7EqJtq98hPqEX7fNZaFWoOhi5BWX4Z3NJ8yJNZ1dVV6YVHdGvsW4y"
+
+// ensureAdminUser creates the "admin" user from PASSWORD on first start so
+// that existing single-password installs keep working
+func ensureAdminUser(cfg *Config) error {
+	var count int64
+	DB.Model(&User{}).Count(&count)
+	if count > 0 {
+		return nil
+	}
+
+	// Older installs had no minimum length, an upgrade must still start and
+	// let the admin log in with the PASSWORD they already use
+	hash, err := bcrypt.GenerateFromPassword([]byte(cfg.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user := User{Username: "admin", Role: RoleAdmin, PasswordHash: string(hash)}
+	log.Printf("Created initial admin user \"admin\" with the configured PASSWORD")
+	if len(cfg.Password) < minPasswordLength {
+		log.Printf("WARNING: PASSWORD is shorter than %d characters, change the admin password after logging in", minPasswordLength)
+	}
+	return DB.Create(&user).Error
+}
+
+// SetPassword hashes and stores a new password
+func (u *User) SetPassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+func (u *User) IsEnabled() bool {
+	return u.Enabled == nil || *u.Enabled
+}
+
+// CanWrite reports whether the user may change anything
+func (u *User) CanWrite() bool {
+	return u.Role != RoleReadOnly
+}
+
+// authenticateUser checks a username and password
+func authenticateUser(username string, password string) (*User, error) {
+	var user User
+	if DB.Where("username = ?", strings.ToLower(strings.TrimSpace(username))).First(&user).Error != nil {
+		bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), []byte(password))
+		return nil, errors.New("invalid username or password")
+	}
+	// Single sign-on users have no password, still spend the time of a
+	// comparison so they cannot be told apart
+	hash := user.PasswordHash
+	if hash == "" {
+		hash = dummyPasswordHash
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil || user.PasswordHash == "" {
+		return nil, errors.New("invalid username or password")
+	}
+	if !user.IsEnabled() {
+		return nil, errors.New("user is disabled")
+	}
+	return &user, nil
+}
+
+// validateUser checks a user before it is saved
+func validateUser(u *User) error {
+	u.Username = strings.ToLower(strings.TrimSpace(u.Username))
+	if u.Username == "" {
+		return errors.New("username is required")
+	}
+	if !validRoles[u.Role] {
+		return errors.New("role must be admin, operator, owner or readonly")
+	}
+	return nil
+}
+
+// isLastAdmin reports whether removing or demoting the user would leave no
+// enabled admin behind
+func isLastAdmin(u *User) bool {
+	if u.Role != RoleAdmin || !u.IsEnabled() {
+		return false
+	}
+	var count int64
+	DB.Model(&User{}).Where("role = ? AND id <> ? AND (enabled IS NULL OR enabled = ?)", RoleAdmin, u.ID, true).Count(&count)
+	return count == 0
+}
+
+// currentUser returns the user authenticated by AuthMiddleware
+func currentUser(c *gin.Context) *User {
+	if v, ok := c.Get("user"); ok {
+		return v.(*User)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// An install upgraded from the single-password version may use a PASSWORD
+// below the minimum length, it still has to start and log in
+func TestEnsureAdminUserShortPassword(t *testing.T) {
+	cfg := testConfig()
+	cfg.Password = "admin"
+	cfg.DBFile = filepath.Join(t.TempDir(), "test.db")
+	InitDB(cfg)
+	t.Cleanup(func() {
+		if sqlDB, err := DB.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	user, err := authenticateUser("admin", "admin")
+	if err != nil || user.Role != RoleAdmin {
+		t.Fatalf("admin login: %+v, %v", user, err)
+	}
+	// New passwords still need the minimum length
+	if err := user.SetPassword("short"); err == nil {
+		t.Error("short password was accepted")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// webhookClient posts to the targets of staff accounts, which may be
+// internal services
+var webhookClient = &http.Client{Timeout: 15 * time.Second}
+
+// tenantWebhookClient posts to the targets of tenant accounts. It refuses
+// to connect to internal addresses, checked on the resolved address so that
+// DNS names and redirects cannot point into the mail host's network either.
+var tenantWebhookClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: publicAddressOnly}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// webhookClientFor returns the client for the targets of an account owner
+func webhookClientFor(owner *uint) *http.Client {
+	if owner != nil {
+		return tenantWebhookClient
+	}
+	return webhookClient
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598)
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isInternalIP reports whether an address belongs to the host or a private
+// network rather than the internet
+func isInternalIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 0 {
+		return true
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || sharedAddressSpace.Contains(ip)
+}
+
+// publicAddressOnly is a dialer control that rejects internal addresses
+func publicAddressOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isInternalIP(ip) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// WebhookPayload is the JSON document posted to webhook targets
+type WebhookPayload struct {
+	Event     string         `json:"event"`
+	LogID     uint           `json:"log_id"`
+	AccountID uint           `json:"account_id"`
+	Alias     string         `json:"alias"`
+	Sender    string         `json:"sender"` // Envelope sender
+	Received  time.Time      `json:"received"`
+	Code      string         `json:"code,omitempty"`
+	Link      string         `json:"link,omitempty"`
+	Message   *ParsedMessage `json:"message,omitempty"` // Omitted for code-only accounts when a code was found
+}
+
+// isWebhookTarget reports whether a forward target is a webhook URL
+func isWebhookTarget(target string) bool {
+	lower := strings.ToLower(target)
+	return strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://")
+}
+
+// validateWebhookTarget only allows plain http for loopback hosts (local testing)
+func validateWebhookTarget(target string) error {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %s", target)
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	return fmt.Errorf("webhook %s must use https", target)
+}
+
+// validateTenantWebhookTarget keeps webhooks of tenant accounts away from
+// the mail host and its network. Names are checked again when connecting.
+func validateTenantWebhookTarget(target string) error {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %s", target)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	ip := net.ParseIP(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || (ip != nil && isInternalIP(ip)) {
+		return fmt.Errorf("webhook %s must not point to an internal address", target)
+	}
+	return nil
+}
+
+// signWebhook computes the HMAC-SHA256 signature over "<timestamp>.<body>"
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts the parsed message to a webhook target
+func deliverWebhook(cfg *Config, rule Account, msg InboundMessage, target string) error {
+	payload := WebhookPayload{
+		Event:     "message.received",
+		LogID:     msg.LogID,
+		AccountID: rule.ID,
+		Alias:     msg.To,
+		Sender:    msg.From,
+		Received:  msg.Received,
+		Code:      msg.Code,
+		Link:      msg.Link,
+	}
+	if rule.NotifyCodeOnly && (msg.Code != "" || msg.Link != "") {
+		return postWebhook(cfg, webhookClientFor(rule.OwnerID), target, payload)
+	}
+
+	parsed, err := parseMessage(msg.Raw)
+	if err != nil {
+		return fmt.Errorf("parse message failed: %v", err)
+	}
+	if cfg.WebhookAttachmentContent {
+		parsed.IncludeAttachmentContent()
+	}
+
+	payload.Message = parsed
+	return postWebhook(cfg, webhookClientFor(rule.OwnerID), target, payload)
+}
+
+// postWebhook sends a signed JSON document
+func postWebhook(cfg *Config, client *http.Client, target string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	headers := map[string]string{"X-Mail-Generator-Timestamp": timestamp}
+	if cfg.WebhookSecret != "" {
+		headers["X-Mail-Generator-Signature"] = signWebhook(cfg.WebhookSecret, timestamp, body)
+	}
+	return postJSON(client, target, body, headers)
+}
+
+// postJSON posts a JSON body and treats any non-2xx reply as failure
+func postJSON(client *http.Client, target string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mail-generator")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	got := signWebhook("secret", "1700000000", []byte(`{"a":1}`))
+	if want := "sha256=49f24e537407743fa4a0242bb63b94b9a47ee99cbbe071ccd8a22550ae411686"; got != want {
+		t.Errorf("signature %s, want %s", got, want)
+	}
+	if signWebhook("secret", "1700000001", []byte(`{"a":1}`)) == got {
+		t.Error("the timestamp is not signed")
+	}
+}
+
+func TestValidateWebhookTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		ok     bool
+		tenant bool // Also allowed for tenant accounts
+	}{
+		{"https://hooks.example.com/in", true, true},
+		{"HTTPS://hooks.example.com/in", true, true},
+		{"http://hooks.example.com/in", false, false},
+		{"http://localhost:8080/in", true, false},
+		{"http://127.0.0.1:8080/in", true, false},
+		{"http://[::1]/in", true, false},
+		{"https://localhost/in", true, false},
+		{"https://app.localhost/in", true, false},
+		{"https://127.0.0.1/in", true, false},
+		{"https://10.1.2.3/in", true, false},
+		{"https://192.168.1.1/in", true, false},
+		{"https://169.254.169.254/latest/meta-data", true, false},
+		{"https://[fd00::1]/in", true, false},
+		{"https://[::ffff:127.0.0.1]/in", true, false},
+		{"https://100.64.0.1/in", true, false},
+		{"https://0.0.0.0/in", true, false},
+		{"https://93.184.216.34/in", true, true},
+		{"https:///in", false, false},
+	}
+	for _, tt := range tests {
+		if err := validateWebhookTarget(tt.target); (err == nil) != tt.ok {
+			t.Errorf("validateWebhookTarget(%q) = %v, want ok=%v", tt.target, err, tt.ok)
+		}
+		if !tt.ok {
+			continue
+		}
+		if err := validateTenantWebhookTarget(tt.target); (err == nil) != tt.tenant {
+			t.Errorf("validateTenantWebhookTarget(%q) = %v, want ok=%v", tt.target, err, tt.tenant)
+		}
+	}
+}
+
+func TestTenantWebhookValidation(t *testing.T) {
+	owner := uint(1)
+	tests := []struct {
+		name    string
+		account Account
+		ok      bool
+	}{
+		{"staff forward to loopback", Account{Pattern: "^a@x$", ForwardTo: "http://127.0.0.1:9000/in"}, true},
+		{"tenant forward to loopback", Account{Pattern: "^a@x$", ForwardTo: "http://127.0.0.1:9000/in", OwnerID: &owner}, false},
+		{"tenant forward to metadata", Account{Pattern: "^a@x$", ForwardTo: "https://169.254.169.254/", OwnerID: &owner}, false},
+		{"tenant forward to the internet", Account{Pattern: "^a@x$", ForwardTo: "https://hooks.example.com/in", OwnerID: &owner}, true},
+		{"tenant notify to private", Account{Pattern: "^a@x$", ForwardTo: "local", Notify: "json:https://10.0.0.5/in", OwnerID: &owner}, false},
+		{"tenant telegram", Account{Pattern: "^a@x$", ForwardTo: "local", Notify: "telegram:-100123", OwnerID: &owner}, true},
+	}
+	for _, tt := range tests {
+		if err := validateAccount(&tt.account); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestPublicAddressOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		ok      bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1::]:443", true},
+		{"127.0.0.1:443", false},
+		{"[::1]:443", false},
+		{"10.0.0.1:443", false},
+		{"172.16.0.1:443", false},
+		{"192.168.0.1:443", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:443", false},
+		{"100.100.100.100:443", false},
+		{"0.1.2.3:443", false},
+	}
+	for _, tt := range tests {
+		if err := publicAddressOnly("tcp", tt.address, nil); (err == nil) != tt.ok {
+			t.Errorf("publicAddressOnly(%s) = %v, want ok=%v", tt.address, err, tt.ok)
+		}
+	}
+}
+
+// webhookReceiver records the last request of a webhook test server
+type webhookReceiver struct {
+	*httptest.Server
+	status   int
+	hits     atomic.Int32
+	method   string
+	header   http.Header
+	body     []byte
+	received time.Time
+}
+
+func newWebhookReceiver(t *testing.T, status int) *webhookReceiver {
+	w := &webhookReceiver{status: status}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w.hits.Add(1)
+		w.method = r.Method
+		w.header = r.Header.Clone()
+		w.body, _ = io.ReadAll(r.Body)
+		w.received = time.Now()
+		rw.WriteHeader(w.status)
+	}))
+	t.Cleanup(w.Close)
+	return w
+}
+
+func testInboundMessage() InboundMessage {
+	return InboundMessage{
+		LogID:    42,
+		From:     "noreply@shop.test",
+		To:       "shop@example.com",
+		Subject:  "Your code",
+		Body:     "Your code is 123456",
+		Raw:      "From: Shop <noreply@shop.test>\r\nTo: shop@example.com\r\nSubject: Your code\r\n\r\nYour code is 123456\r\n",
+		Code:     "123456",
+		Received: time.Unix(1700000000, 0).UTC(),
+	}
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	cfg := testConfig()
+	cfg.WebhookSecret = "hook-secret"
+	receiver := newWebhookReceiver(t, http.StatusNoContent)
+	rule := Account{ID: 7, Pattern: "^shop@example\\.com$"}
+
+	if err := deliverWebhook(cfg, rule, testInboundMessage(), receiver.URL+"/in"); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.method != http.MethodPost || receiver.header.Get("Content-Type") != "application/json" {
+		t.Errorf("%s with Content-Type %q", receiver.method, receiver.header.Get("Content-Type"))
+	}
+
+	// The receiver checks the signature the way the README describes it
+	timestamp := receiver.header.Get("X-Mail-Generator-Timestamp")
+	if ts, err := strconv.ParseInt(timestamp, 10, 64); err != nil || receiver.received.Unix()-ts > 5 {
+		t.Errorf("timestamp %q", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("hook-secret"))
+	mac.Write([]byte(timestamp + "." + string(receiver.body)))
+	if got, want := receiver.header.Get("X-Mail-Generator-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signature %s, want %s", got, want)
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(receiver.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != "message.received" || payload.LogID != 42 || payload.AccountID != 7 || payload.Alias != "shop@example.com" ||
+		payload.Sender != "noreply@shop.test" || payload.Code != "123456" {
+		t.Errorf("payload %+v", payload)
+	}
+	if payload.Message == nil || payload.Message.Subject != "Your code" || payload.Message.From != "Shop <noreply@shop.test>" {
+		t.Errorf("message %+v", payload.Message)
+	}
+
+	// Code-only accounts leave the message out once a code was found
+	rule.NotifyCodeOnly = true
+	if err := deliverWebhook(cfg, rule, testInboundMessage(), receiver.URL); err != nil {
+		t.Fatal(err)
+	}
+	payload = WebhookPayload{}
+	json.Unmarshal(receiver.body, &payload)
+	if payload.Message != nil || payload.Code != "123456" {
+		t.Errorf("code-only payload %s", receiver.body)
+	}
+
+	// Without a secret nothing is signed
+	cfg.WebhookSecret = ""
+	deliverWebhook(cfg, rule, testInboundMessage(), receiver.URL)
+	if receiver.header.Get("X-Mail-Generator-Signature") != "" || receiver.header.Get("X-Mail-Generator-Timestamp") == "" {
+		t.Errorf("headers without a secret: %v", receiver.header)
+	}
+}
+
+func TestDeliverWebhookErrors(t *testing.T) {
+	cfg := testConfig()
+	for _, status := range []int{http.StatusMovedPermanently, http.StatusBadRequest, http.StatusUnauthorized, http.StatusInternalServerError} {
+		receiver := newWebhookReceiver(t, status)
+		if err := deliverWebhook(cfg, Account{}, testInboundMessage(), receiver.URL); err == nil {
+			t.Errorf("status %d was accepted", status)
+		}
+	}
+
+	// A listener that is gone
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	l.Close()
+	if err := deliverWebhook(cfg, Account{}, testInboundMessage(), "http://"+l.Addr().String()); err == nil {
+		t.Error("unreachable endpoint was accepted")
+	}
+}
+
+// Tenant accounts cannot reach the mail host even with a target that passed
+// validation, e.g. a name that resolves to a loopback address
+func TestDeliverWebhookTenantDial(t *testing.T) {
+	cfg := testConfig()
+	receiver := newWebhookReceiver(t, http.StatusNoContent)
+	owner := uint(3)
+	tenant := Account{OwnerID: &owner}
+
+	if err := deliverWebhook(cfg, tenant, testInboundMessage(), receiver.URL); err == nil {
+		t.Error("tenant webhook reached a loopback address")
+	}
+	notifier, _ := newNotifier(cfg, "json:"+receiver.URL, &owner)
+	if err := notifier.Notify(Notification{Alias: "a@x"}); err == nil {
+		t.Error("tenant notification reached a loopback address")
+	}
+	if hits := receiver.hits.Load(); hits != 0 {
+		t.Errorf("receiver hit %d times", hits)
+	}
+}
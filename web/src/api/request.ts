@@ -19,20 +19,68 @@ service.interceptors.request.use(
   }
 );
 
+const clearTokens = () => {
+  localStorage.removeItem('token');
+  localStorage.removeItem('refresh_token');
+};
+
+// refreshing is shared by all requests that failed while the access token
+// was expired, a refresh token only works once
+let refreshing: Promise<string> | null = null;
+
+const refreshToken = () => {
+  if (!refreshing) {
+    const token = localStorage.getItem('refresh_token');
+    refreshing = (token
+      ? axios.post('/api/token/refresh', { refresh_token: token }).then((res) => {
+          localStorage.setItem('token', res.data.token);
+          localStorage.setItem('refresh_token', res.data.refresh_token);
+          return res.data.token as string;
+        })
+      : Promise.reject(new Error('no refresh token'))
+    ).finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+};
+
 service.interceptors.response.use(
   (response) => {
     return response.data;
   },
-  (error) => {
-    if (error.response && error.response.status === 401) {
-      localStorage.removeItem('token');
+  async (error) => {
+    // A failed login step answers 401 as well, the login page handles it
+    const isLogin = error.config?.url?.startsWith('/login');
+    if (error.response && error.response.status === 401 && !isLogin) {
+      if (!error.config._retried) {
+        try {
+          const token = await refreshToken();
+          error.config._retried = true;
+          error.config.headers['Authorization'] = `Bearer ${token}`;
+          return service(error.config);
+        } catch {
+          // The session ended, log in again
+        }
+      }
+      clearTokens();
       window.location.href = '/login';
+      return Promise.reject(error);
     }
     message.error(error.response?.data?.error || 'Request Failed');
     return Promise.reject(error);
   }
 );
 
-export default service;
-
+// logout ends the session on the server, the access token alone would stay
+// valid until it expires
+export const logout = async () => {
+  const token = localStorage.getItem('refresh_token');
+  clearTokens();
+  if (token) {
+    await axios.post('/api/logout', { refresh_token: token }).catch(() => {});
+  }
+  window.location.href = '/login';
+};
 
+export default service;
@@ -15,14 +15,34 @@ export default {
   },
   login: {
     title: 'Mail Generator Login',
+    username: 'Username',
+    usernamePlaceholder: 'Please input your username!',
     password: 'Password',
     loginButton: 'Login',
     passwordPlaceholder: 'Please input your password!',
+    ssoButton: 'Sign in with {name}',
+    or: 'or',
+    codeHint: 'Enter the 6-digit code from your authenticator app.',
+    code: 'Verification code',
+    codePlaceholder: 'Please input the verification code!',
+    recoveryHint: 'Enter one of your recovery codes. Each code works only once.',
+    recoveryCode: 'Recovery code',
+    recoveryCodePlaceholder: 'Please input a recovery code!',
+    useRecoveryCode: 'Use a recovery code',
+    useCode: 'Use the authenticator app',
+    verify: 'Verify',
+    back: 'Back',
+    setupHint: 'Your account requires two-factor authentication. Add this secret to an authenticator app, then enter the code it shows.',
+    secret: 'Secret',
+    openAuthenticator: 'Open in authenticator app',
+    recoveryCodesHint: 'Save these recovery codes somewhere safe. They are shown only once and let you log in without your phone.',
+    continue: 'Continue',
   },
   menu: {
     domains: 'Domains',
     accounts: 'Accounts',
     logs: 'Logs',
+    logout: 'Logout',
   },
   domain: {
     addTitle: 'Add Domain',
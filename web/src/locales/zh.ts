@@ -15,14 +15,34 @@ export default {
   },
   login: {
     title: '邮件转发系统登录',
+    username: '用户名',
+    usernamePlaceholder: '请输入用户名！',
     password: '密码',
     loginButton: '登录',
     passwordPlaceholder: '请输入密码！',
+    ssoButton: '使用 {name} 登录',
+    or: '或',
+    codeHint: '请输入身份验证器应用中的 6 位验证码。',
+    code: '验证码',
+    codePlaceholder: '请输入验证码！',
+    recoveryHint: '请输入一个恢复码，每个恢复码只能使用一次。',
+    recoveryCode: '恢复码',
+    recoveryCodePlaceholder: '请输入恢复码！',
+    useRecoveryCode: '使用恢复码',
+    useCode: '使用身份验证器',
+    verify: '验证',
+    back: '返回',
+    setupHint: '你的账号需要开启两步验证。请将下面的密钥添加到身份验证器应用，然后输入其显示的验证码。',
+    secret: '密钥',
+    openAuthenticator: '在身份验证器中打开',
+    recoveryCodesHint: '请妥善保存这些恢复码。它们只显示这一次，可在手机不在身边时用于登录。',
+    continue: '继续',
   },
   menu: {
     domains: '域名管理',
     accounts: '账号规则',
     logs: '转发日志',
+    logout: '退出登录',
   },
   domain: {
     addTitle: '添加域名',